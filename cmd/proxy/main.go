@@ -1,12 +1,19 @@
 package main
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
 
+	"github.com/dhontecillas/dynlimits/pkg/adaptive"
 	"github.com/dhontecillas/dynlimits/pkg/catalog"
 	"github.com/dhontecillas/dynlimits/pkg/config"
+	"github.com/dhontecillas/dynlimits/pkg/metrics"
 	"github.com/dhontecillas/dynlimits/pkg/middleware"
 	"github.com/dhontecillas/dynlimits/pkg/pathmatcher"
 	"github.com/dhontecillas/dynlimits/pkg/proxy"
@@ -60,12 +67,19 @@ func main() {
 	globalSharedPathMatcher = pathmatcher.NewSharedPathMatcher(
 		pathmatcher.NewPathMatcher())
 
-	catalog.UpdateSharedMatcher(&indexedLimits, globalSharedPathMatcher)
+	if err := catalog.UpdateSharedMatcher(&indexedLimits,
+		globalSharedPathMatcher); err != nil {
+		fmt.Printf("cannot build the catalog routes: %s\n", err.Error())
+		return
+	}
+
+	apiKeys := catalog.NewIndexedAPIKeys()
+	apiKeys.Update(&indexedLimits)
 
 	// TODO: move this to a unit test case:
 	// checking that the route was added
 	/*
-		rtest := globalSharedPathMatcher.LookupRoute("GET",
+		rtest, _ := globalSharedPathMatcher.LookupRoute("GET",
 			"/api/filipid/recipients/foooo/preferences")
 		if rtest == nil {
 			fmt.Printf("the routes were not well loaded\nIMPLEMENT ROUTE LOADING\n")
@@ -76,29 +90,299 @@ func main() {
 	// now update all api keys in the redis server
 	catalog.RedisUpdate(conn, &indexedLimits)
 
+	unknownPathsPolicy, err := middleware.ParseUnknownPathsPolicy(
+		conf.UnknownPathsPolicy)
+	if err != nil {
+		fmt.Printf("bad configuration: %s\n", err.Error())
+		return
+	}
+
+	refundStatus, err := middleware.ParseStatusRules(conf.RefundStatus)
+	if err != nil {
+		fmt.Printf("bad configuration: %s\n", err.Error())
+		return
+	}
+
+	pathsDecoding, err := pathmatcher.ParsePercentDecoding(conf.PathsDecoding)
+	if err != nil {
+		fmt.Printf("bad configuration: %s\n", err.Error())
+		return
+	}
+	trailingSlash, err := pathmatcher.ParseTrailingSlashPolicy(
+		conf.PathsTrailingSlash)
+	if err != nil {
+		fmt.Printf("bad configuration: %s\n", err.Error())
+		return
+	}
+	normalizer := &pathmatcher.Normalizer{
+		Decoding:          pathsDecoding,
+		CollapseSlashes:   conf.PathsCollapseSlashes,
+		RemoveDotSegments: conf.PathsDotSegments,
+		TrailingSlash:     trailingSlash,
+		CaseInsensitive:   conf.PathsCaseInsensitive,
+	}
+
+	trustedProxies, err := proxy.ParseTrustedProxies(
+		conf.ForwardToTrustedProxies)
+	if err != nil {
+		fmt.Printf("bad configuration: %s\n", err.Error())
+		return
+	}
+
+	var concurrencyLimiter ratelimit.ConcurrencyLimiter
+	switch conf.ConcurrencyBackend {
+	case "inmem":
+		concurrencyLimiter = ratelimit.NewInMemConcurrencyLimiter()
+	case "redis":
+		concurrencyLimiter = ratelimit.NewRedisConcurrencyLimiter(pool,
+			time.Duration(conf.ConcurrencyLeaseSecs)*time.Second)
+	default:
+		fmt.Printf("bad configuration: unknown concurrency backend %q\n",
+			conf.ConcurrencyBackend)
+		return
+	}
+
+	upstreams, err := proxy.ParseUpstreams(conf.Upstreams())
+	if err != nil {
+		fmt.Printf("bad configuration: %s\n", err.Error())
+		return
+	}
+	balancing, err := proxy.ParseBalancingStrategy(conf.UpstreamsBalancing)
+	if err != nil {
+		fmt.Printf("bad configuration: %s\n", err.Error())
+		return
+	}
+	services, err := proxy.ParseServices(conf.UpstreamsServices)
+	if err != nil {
+		fmt.Printf("bad configuration: %s\n", err.Error())
+		return
+	}
+	serviceRoutes, err := proxy.ParseServiceRoutes(conf.UpstreamsRoutes)
+	if err != nil {
+		fmt.Printf("bad configuration: %s\n", err.Error())
+		return
+	}
+	upstreamTLS, err := proxy.NewUpstreamTLSConfig(proxy.UpstreamTLS{
+		CAFile:             conf.UpstreamTLSCAFile,
+		CertFile:           conf.UpstreamTLSCertFile,
+		KeyFile:            conf.UpstreamTLSKeyFile,
+		ServerName:         conf.UpstreamTLSServerName,
+		InsecureSkipVerify: conf.UpstreamTLSInsecure,
+	})
+	if err != nil {
+		fmt.Printf("bad configuration: %s\n", err.Error())
+		return
+	}
+	transport := proxy.NewTransport(proxy.Timeouts{
+		Dial:           time.Duration(conf.DialTimeoutMs) * time.Millisecond,
+		ResponseHeader: time.Duration(conf.ResponseHeaderTimeoutMs) * time.Millisecond,
+		IdleConn:       time.Duration(conf.IdleConnTimeoutMs) * time.Millisecond,
+	}, upstreamTLS)
+
+	servicePools := make(map[string]*proxy.UpstreamPool, len(services))
+	for name, serviceUpstreams := range services {
+		servicePools[name] = newUpstreamPool(conf, serviceUpstreams,
+			balancing, transport)
+	}
+
+	proxyH := proxy.NewPoolProxyHandler(
+		newUpstreamPool(conf, upstreams, balancing, transport))
+	proxyH.SetTransport(transport)
+	proxyH.SetServices(servicePools)
+	if err := proxyH.SetServiceRoutes(serviceRoutes); err != nil {
+		fmt.Printf("bad configuration: %s\n", err.Error())
+		return
+	}
+	if errs := indexedLimits.ValidateUpstreams(proxyH.HasService); len(errs) > 0 {
+		fmt.Printf("bad configuration: %s\n", errs[0].Error())
+		return
+	}
+
+	// the catalogs from the server are validated against the
+	// upstream services too, so the poller starts after them
 	if len(conf.CatalogServerURL) > 0 {
 		_, err := catalog.LaunchUpdatesPoller(
 			pool, conf.CatalogServerURL, conf.CatalogServerAPIKey,
-			globalSharedPathMatcher, conf.CatalogRedisPollSecs,
-			conf.CatalogServerPollSecs)
+			globalSharedPathMatcher, apiKeys, proxyH.HasService,
+			conf.CatalogRedisPollSecs, conf.CatalogServerPollSecs)
 		if err != nil {
 			// TODO: log the error and decide what to do with it
 			fmt.Printf("cannot launch the policy updater: %s\n", err.Error())
 			return
 		}
 	}
+	proxyH.SetFlushInterval(
+		time.Duration(conf.ForwardToFlushIntervalMs) * time.Millisecond)
+	proxyH.SetForwardedHeaders(proxy.ForwardedHeaders{
+		XForwardedFor:   conf.ForwardToXForwardedFor,
+		XForwardedProto: conf.ForwardToXForwardedProto,
+		XForwardedHost:  conf.ForwardToXForwardedHost,
+		Forwarded:       conf.ForwardToForwarded,
+		TrustedProxies:  trustedProxies,
+		PreserveHost:    conf.ForwardToPreserveHost,
+	})
 
-	proxyH := proxy.NewProxyHandler(conf.ForwardToScheme, conf.ForwardAddr())
+	var limitedH http.Handler = proxyH
+	if len(conf.MirrorUpstream) > 0 {
+		mirrorUpstream, err := proxy.ParseUpstream(conf.MirrorUpstream)
+		if err != nil {
+			fmt.Printf("bad configuration: %s\n", err.Error())
+			return
+		}
+		limitedH = proxy.NewMirrorHandler(proxyH, proxy.Mirror{
+			Upstream:     mirrorUpstream,
+			Percent:      conf.MirrorPercent,
+			Endpoints:    splitList(conf.MirrorEndpoints),
+			APIKeys:      splitList(conf.MirrorAPIKeys),
+			APIKeyHeader: "X-Api-Key",
+			Compare:      conf.MirrorCompare,
+			MaxBodyBytes: conf.MirrorMaxBodyBytes,
+			Timeout:      time.Duration(conf.MirrorTimeoutMs) * time.Millisecond,
+			MaxInFlight:  conf.MirrorMaxInFlight,
+		}, transport)
+	}
+
+	rateLimitH := middleware.NewRateLimitMiddleware(limitedH,
+		"X-Api-Key", apiKeys, pool, globalSharedPathMatcher)
+	if err := rateLimitH.SetUnknownPathsPolicy(unknownPathsPolicy,
+		conf.UnknownPathsReqPerMin); err != nil {
+		fmt.Printf("bad configuration: %s\n", err.Error())
+		return
+	}
+	rateLimitH.SetTrustedProxies(trustedProxies)
+	rateLimitH.SetShadowMode(conf.Shadow)
+	rateLimitH.SetRefundStatusRules(refundStatus)
+	rateLimitH.SetConcurrencyLimiter(concurrencyLimiter)
+	rateLimitH.SetDelayQueueLimits(conf.DelayMaxQueuedPerKey,
+		conf.DelayMaxQueued)
+	rateLimitH.SetUpgradedMessagesLimit(conf.WebSocketMsgPerMin)
+	rateLimitH.SetPathNormalizer(normalizer)
+
+	var adaptiveController *adaptive.Controller
+	if conf.AdaptiveEnabled {
+		adaptiveController = adaptive.NewController(&adaptive.Conf{
+			Interval:      time.Duration(conf.AdaptiveIntervalMs) * time.Millisecond,
+			MaxErrorRate:  conf.AdaptiveMaxErrorRate,
+			MaxLatency:    time.Duration(conf.AdaptiveMaxLatencyMs) * time.Millisecond,
+			MinRequests:   conf.AdaptiveMinRequests,
+			DecreaseRatio: conf.AdaptiveDecrease,
+			IncreaseStep:  conf.AdaptiveIncrease,
+			MinFactor:     conf.AdaptiveMinFactor,
+			MaxPriority:   conf.AdaptiveMaxPriority,
+		})
+		adaptiveController.Start()
+		proxyH.SetObserver(adaptiveController)
+		rateLimitH.SetLimitScaler(adaptiveController)
+	}
 
-	defApiKeyCatalog := catalog.DefaultAPIKeys{}
-	rateLimitH := middleware.NewRateLimitMiddleware(proxyH,
-		"X-Api-Key", &defApiKeyCatalog, pool, globalSharedPathMatcher)
+	if len(conf.AdminAddress) > 0 {
+		adminMux := http.NewServeMux()
+		adminMux.Handle("/metrics", metrics.Handler())
+		if adaptiveController != nil {
+			adminMux.Handle("/adaptive", adaptiveController)
+		}
+		server.LaunchBackgroundServer(conf.AdminAddress, adminMux)
+	}
 
+	serverConf := server.ServerConf{
+		HTTP2: server.HTTP2Conf{
+			Enabled:              conf.ListenHTTP2Enabled,
+			H2C:                  conf.ListenHTTP2H2C,
+			MaxConcurrentStreams: uint32(conf.ListenHTTP2MaxStreams),
+		},
+	}
+	if conf.ListenTLS() {
+		tlsConfig, err := newListenTLSConfig(conf)
+		if err != nil {
+			fmt.Printf("bad configuration: %s\n", err.Error())
+			return
+		}
+		serverConf.TLS = tlsConfig
+	}
 	// server.LaunchBlockingServer(proxyH)
-	server.LaunchBlockingServer(conf.ListenAddr(), rateLimitH)
+	err = server.LaunchBlockingServerConf(conf.ListenAddr(), rateLimitH, serverConf)
+	if err != nil {
+		// TODO: change this for a log
+		fmt.Printf("error serving: %s\n", err.Error())
+		os.Exit(1)
+	}
 	//testRedisSlidingCounterWindow(conn)
 }
 
+// newUpstreamPool creates a pool for the upstreams, with the
+// configured retries, circuit breakers, health checks (using the
+// transport of the proxy) and passive ejection
+func newUpstreamPool(conf *config.DynLimitsConfig, upstreams []*proxy.Upstream,
+	balancing proxy.BalancingStrategy, transport http.RoundTripper) *proxy.UpstreamPool {
+	upstreamPool := proxy.NewUpstreamPool(upstreams, balancing)
+	upstreamPool.SetHashHeader(conf.UpstreamsHashHeader)
+	upstreamPool.SetPassiveEjection(proxy.PassiveEjection{
+		MaxFails: conf.EjectionMaxFails,
+		EjectFor: time.Duration(conf.EjectionDurationMs) * time.Millisecond,
+	})
+	upstreamPool.SetRetryPolicy(proxy.RetryPolicy{
+		MaxRetries:      conf.RetriesMax,
+		BudgetRatio:     conf.RetryBudgetRatio,
+		BudgetMinPerSec: conf.RetryBudgetMinPerSec,
+	})
+	upstreamPool.SetCircuitBreaker(proxy.CircuitBreaker{
+		FailureRatio:     conf.BreakerFailureRatio,
+		MinRequests:      conf.BreakerMinRequests,
+		Window:           time.Duration(conf.BreakerWindowMs) * time.Millisecond,
+		OpenFor:          time.Duration(conf.BreakerOpenMs) * time.Millisecond,
+		HalfOpenRequests: conf.BreakerHalfOpenRequests,
+	})
+	if len(conf.HealthCheckPath) > 0 {
+		upstreamPool.StartHealthChecks(proxy.HealthCheck{
+			Path:               conf.HealthCheckPath,
+			Interval:           time.Duration(conf.HealthCheckIntervalMs) * time.Millisecond,
+			Timeout:            time.Duration(conf.HealthCheckTimeoutMs) * time.Millisecond,
+			UnhealthyThreshold: conf.HealthCheckFall,
+			HealthyThreshold:   conf.HealthCheckRise,
+			Transport:          transport,
+		})
+	}
+	return upstreamPool
+}
+
+// splitList returns the non empty values of a comma separated list
+func splitList(list string) []string {
+	var values []string
+	for _, v := range strings.Split(list, ",") {
+		if v = strings.TrimSpace(v); len(v) > 0 {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// newListenTLSConfig creates the TLS configuration of the server,
+// that reloads the certificate when it changes
+func newListenTLSConfig(conf *config.DynLimitsConfig) (*tls.Config, error) {
+	minVersion, err := server.ParseTLSVersion(conf.ListenTLSMinVersion)
+	if err != nil {
+		return nil, err
+	}
+	cipherSuites, err := server.ParseCipherSuites(conf.ListenTLSCipherSuites)
+	if err != nil {
+		return nil, err
+	}
+	clientAuth, err := server.ParseClientAuth(conf.ListenTLSClientAuth)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, _, err := server.NewTLSConfig(server.TLSConf{
+		CertFile:       conf.ListenTLSCertFile,
+		KeyFile:        conf.ListenTLSKeyFile,
+		MinVersion:     minVersion,
+		CipherSuites:   cipherSuites,
+		ClientCAFile:   conf.ListenTLSClientCAFile,
+		ClientAuth:     clientAuth,
+		ReloadInterval: time.Duration(conf.ListenTLSReloadSecs) * time.Second,
+	})
+	return tlsConfig, err
+}
+
 func testRedisSlidingCounterWindow(conn redis.Conn) {
 
 	keyPrefix := "kk"
@@ -108,12 +392,12 @@ func testRedisSlidingCounterWindow(conn redis.Conn) {
 	if err != nil {
 		fmt.Printf("cannot set rate limit\n")
 	}
-	err = ratelimit.AddToRedisSlidingCountersWindow(conn, keyPrefix, 1999)
+	err = ratelimit.AddToRedisSlidingCountersWindow(conn, keyPrefix, 1999, 1)
 	if err != nil {
 		fmt.Printf("cannot add to ratelimit %s\n", err.Error())
 		return
 	}
-	err = ratelimit.AddToRedisSlidingCountersWindow(conn, keyPrefix, 1998)
+	err = ratelimit.AddToRedisSlidingCountersWindow(conn, keyPrefix, 1998, 1)
 	if err != nil {
 		fmt.Printf("cannot add to ratelimit %s\n", err.Error())
 		return
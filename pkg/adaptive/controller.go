@@ -0,0 +1,246 @@
+package adaptive
+
+import (
+	"encoding/json"
+	"expvar"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dhontecillas/dynlimits/pkg/metrics"
+)
+
+// Conf contains the params to configure a Controller
+//
+//   - Interval: how often the upstream health is evaluated
+//   - MaxErrorRate: the ratio of failed requests (errors or 5xx)
+//     above which the upstream is considered degraded
+//   - MaxLatency: the average latency above which the upstream
+//     is considered degraded
+//   - MinRequests: the min number of requests in an interval to
+//     evaluate the upstream health
+//   - DecreaseRatio: the multiplicative decrease of the scaling
+//     factor when the upstream is degraded
+//   - IncreaseStep: the additive increase of the scaling factor
+//     when the upstream is healthy
+//   - MinFactor: the min scaling factor for any priority
+//   - MaxPriority: the highest priority, the last one to be
+//     scaled down
+type Conf struct {
+	Interval      time.Duration
+	MaxErrorRate  float64
+	MaxLatency    time.Duration
+	MinRequests   int64
+	DecreaseRatio float64
+	IncreaseStep  float64
+	MinFactor     float64
+	MaxPriority   int
+}
+
+// NewConf creates a new Conf with default values
+func NewConf() *Conf {
+	return &Conf{
+		Interval:      time.Second,
+		MaxErrorRate:  0.1,
+		MaxLatency:    time.Second,
+		MinRequests:   10,
+		DecreaseRatio: 0.7,
+		IncreaseStep:  0.05,
+		MinFactor:     0.1,
+		MaxPriority:   2,
+	}
+}
+
+// Status contains the last evaluation of the upstream health
+// and the resulting scaling factors for each priority
+type Status struct {
+	Factor       float64         `json:"factor"`
+	Degraded     bool            `json:"degraded"`
+	Requests     int64           `json:"requests"`
+	ErrorRate    float64         `json:"errorrate"`
+	AvgLatencyMs float64         `json:"avglatencyms"`
+	Priorities   map[int]float64 `json:"priorities"`
+}
+
+// Controller watches the upstream latency and error rates, and
+// computes a scaling factor for the limits with an AIMD (additive
+// increase, multiplicative decrease) algorithm.
+//
+// The scaling is distributed between priorities, so the limits
+// of the lower priorities are scaled down first, and restored
+// last.
+type Controller struct {
+	conf Conf
+
+	statsAccess sync.Mutex
+	requests    int64
+	errors      int64
+	latencySum  time.Duration
+
+	statusAccess sync.RWMutex
+	factor       float64
+	status       Status
+
+	stop chan bool
+}
+
+// NewController creates a new Controller. It does not evaluate
+// the upstream health until Start is called.
+func NewController(conf *Conf) *Controller {
+	if conf == nil {
+		conf = NewConf()
+	}
+	c := &Controller{
+		conf:   *conf,
+		factor: 1.0,
+		stop:   make(chan bool),
+	}
+	c.setStatus(Status{Factor: 1.0})
+	return c
+}
+
+// Start launches a goroutine that evaluates the upstream
+// health at every interval
+func (c *Controller) Start() {
+	go func() {
+		ticker := time.NewTicker(c.conf.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.stop:
+				return
+			case <-ticker.C:
+				c.update()
+			}
+		}
+	}()
+}
+
+// Stop stops the evaluation of the upstream health
+func (c *Controller) Stop() {
+	close(c.stop)
+}
+
+// ObserveUpstream records the result of a proxied request
+func (c *Controller) ObserveUpstream(latency time.Duration, statusCode int, err error) {
+	c.statsAccess.Lock()
+	c.requests++
+	if err != nil || statusCode >= 500 {
+		c.errors++
+	}
+	c.latencySum += latency
+	c.statsAccess.Unlock()
+}
+
+// Factor returns the scaling factor to apply to the limits
+// of the given priority
+func (c *Controller) Factor(priority int) float64 {
+	c.statusAccess.RLock()
+	f := c.factor
+	c.statusAccess.RUnlock()
+	return c.priorityFactor(f, priority)
+}
+
+// Status returns the last evaluation of the upstream health
+func (c *Controller) Status() Status {
+	c.statusAccess.RLock()
+	defer c.statusAccess.RUnlock()
+	s := c.status
+	s.Priorities = make(map[int]float64, len(c.status.Priorities))
+	for p, f := range c.status.Priorities {
+		s.Priorities[p] = f
+	}
+	return s
+}
+
+// ServeHTTP writes the current Status in JSON format
+func (c *Controller) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	data, err := json.Marshal(c.Status())
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write(data)
+}
+
+// update evaluates the upstream health with the requests observed
+// since the last update, and adjusts the scaling factor
+func (c *Controller) update() {
+	c.statsAccess.Lock()
+	requests, errors, latencySum := c.requests, c.errors, c.latencySum
+	c.requests, c.errors, c.latencySum = 0, 0, 0
+	c.statsAccess.Unlock()
+
+	c.statusAccess.RLock()
+	f := c.factor
+	c.statusAccess.RUnlock()
+
+	s := Status{
+		Requests: requests,
+	}
+	if requests > 0 {
+		s.ErrorRate = float64(errors) / float64(requests)
+		avgLatency := latencySum / time.Duration(requests)
+		s.AvgLatencyMs = float64(avgLatency) / float64(time.Millisecond)
+		s.Degraded = requests >= c.conf.MinRequests &&
+			(s.ErrorRate > c.conf.MaxErrorRate || avgLatency > c.conf.MaxLatency)
+	}
+
+	minF := c.minGlobalFactor()
+	if s.Degraded {
+		f = math.Max(minF, f*c.conf.DecreaseRatio)
+	} else {
+		f = math.Min(1.0, f+c.conf.IncreaseStep)
+	}
+	s.Factor = f
+
+	c.statusAccess.Lock()
+	c.factor = f
+	c.statusAccess.Unlock()
+	c.setStatus(s)
+}
+
+// setStatus stores the status with the per priority factors,
+// and publishes them as metrics
+func (c *Controller) setStatus(s Status) {
+	s.Priorities = make(map[int]float64, c.conf.MaxPriority+1)
+	for p := 0; p <= c.conf.MaxPriority; p++ {
+		pf := c.priorityFactor(s.Factor, p)
+		s.Priorities[p] = pf
+		ev := new(expvar.Float)
+		ev.Set(pf)
+		metrics.AdaptiveFactor.Set(strconv.Itoa(p), ev)
+	}
+	c.statusAccess.Lock()
+	c.status = s
+	c.statusAccess.Unlock()
+}
+
+// minGlobalFactor is the global factor at which all the
+// priorities have been scaled down to the min factor
+func (c *Controller) minGlobalFactor() float64 {
+	levels := float64(c.conf.MaxPriority + 1)
+	return 1.0 - (levels-1.0+(1.0-c.conf.MinFactor))/levels
+}
+
+// priorityFactor distributes the scaling of the global factor
+// between the priorities: the reduction (1 - factor) is applied
+// to the lowest priority until it reaches the min factor, then
+// to the next one, and so on.
+func (c *Controller) priorityFactor(f float64, priority int) float64 {
+	if priority < 0 {
+		priority = 0
+	}
+	if priority > c.conf.MaxPriority {
+		priority = c.conf.MaxPriority
+	}
+	levels := float64(c.conf.MaxPriority + 1)
+	shed := (1.0-f)*levels - float64(priority)
+	if shed <= 0 {
+		return 1.0
+	}
+	return math.Max(c.conf.MinFactor, 1.0-shed)
+}
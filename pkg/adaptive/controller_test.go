@@ -0,0 +1,79 @@
+package adaptive
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func observe(c *Controller, requests int, errors int, latency time.Duration) {
+	for i := 0; i < requests; i++ {
+		var err error
+		if i < errors {
+			err = fmt.Errorf("upstream error")
+		}
+		c.ObserveUpstream(latency, 200, err)
+	}
+}
+
+func Test_ControllerScalesLowerPrioritiesFirst(t *testing.T) {
+	conf := NewConf()
+	conf.MaxPriority = 1
+	conf.DecreaseRatio = 0.5
+	conf.IncreaseStep = 0.25
+	c := NewController(conf)
+
+	// healthy upstream does not scale the limits
+	observe(c, 20, 0, time.Millisecond)
+	c.update()
+	if c.Factor(0) != 1.0 || c.Factor(1) != 1.0 {
+		t.Errorf("want no scaling, got %f, %f", c.Factor(0), c.Factor(1))
+		return
+	}
+
+	// degraded by errors: the global factor is 0.5, all the
+	// reduction goes to the lowest priority
+	observe(c, 20, 10, time.Millisecond)
+	c.update()
+	if c.Factor(0) != conf.MinFactor || c.Factor(1) != 1.0 {
+		t.Errorf("want %f and 1.0, got %f, %f", conf.MinFactor,
+			c.Factor(0), c.Factor(1))
+		return
+	}
+	if !c.Status().Degraded {
+		t.Errorf("want degraded status")
+		return
+	}
+
+	// degraded by latency: now the higher priority is scaled too
+	observe(c, 20, 0, 2*time.Second)
+	c.update()
+	if c.Factor(0) != conf.MinFactor || c.Factor(1) >= 1.0 {
+		t.Errorf("want both scaled, got %f, %f", c.Factor(0), c.Factor(1))
+		return
+	}
+
+	// with few requests we do not evaluate the health, and
+	// it starts to recover, higher priorities first
+	observe(c, 2, 2, 2*time.Second)
+	c.update()
+	if c.Status().Degraded {
+		t.Errorf("want not degraded status with few requests")
+		return
+	}
+	if c.Factor(1) != 1.0 || c.Factor(0) >= 1.0 {
+		t.Errorf("want higher priority restored, got %f, %f",
+			c.Factor(0), c.Factor(1))
+		return
+	}
+	for i := 0; i < 4; i++ {
+		c.update()
+	}
+	if c.Factor(0) != 1.0 || c.Factor(1) != 1.0 {
+		t.Errorf("want all restored, got %f, %f", c.Factor(0), c.Factor(1))
+		return
+	}
+	if c.Status().Priorities[0] != 1.0 {
+		t.Errorf("want status priorities restored, got %#v", c.Status())
+	}
+}
@@ -9,15 +9,40 @@ the redis cache
 */
 
 import (
+	"fmt"
+	"strings"
+	"sync"
 	"time"
 )
 
 // TODO: Create Default Limits, to apply just in case some API key
 // misses its endpoints
 
+// APILimits contains the options to apply to an api key
+// and endpoint:
+//
+//   - Shadow: the limits are evaluated but not enforced
+//   - Cost: how much each request consumes from the limits
+//   - Concurrency: max number of requests in flight (0 for no limit)
+//   - MaxDelay: how long a request over the limit can be held
+//     waiting for room in the window (0 to reject it)
+//   - GlobalRateLimit: the endpoint limit for all the api keys
+//     together (0 for no limit)
+//   - GlobalShedAtPercent: the percentage of the global limit that
+//     can be used by this api key, depending on its priority
+//   - Priority: the api key priority
+//   - LimitKey: the request values that are part of the limits key
 type APILimits struct {
 	RateLimitsKeyPrefix string
 	BlockedUntil        time.Time
+	Shadow              bool
+	Cost                RequestCost
+	Concurrency         int64
+	MaxDelay            time.Duration
+	GlobalRateLimit     int64
+	GlobalShedAtPercent int64
+	Priority            int
+	LimitKey            *LimitKeyDef
 }
 
 type APIKeys interface {
@@ -62,3 +87,141 @@ func (dak *DefaultAPIKeys) toPrefix(apiKey string, method string, pathDef string
 
 func (dak *DefaultAPIKeys) SetLimit(apiKey string, method string, pathDef string) {
 }
+
+// IndexedAPIKeys is a local catalog of the per api key and
+// endpoint options, built from an APIIndexedLimits catalog.
+//
+// The endpoint is identified by its method and its path as
+// it is defined in the catalog (the OpenAPI path), prefixed
+// with its route conditions if it has any (see the Endpoint
+// of pathmatcher.PathMatched).
+type IndexedAPIKeys struct {
+	access     sync.RWMutex
+	endpoints  map[string]APILimits
+	keys       map[string]APILimits
+	limits     map[string]APILimits
+	unknownKey APILimits
+}
+
+// NewIndexedAPIKeys creates an empty IndexedAPIKeys
+func NewIndexedAPIKeys() *IndexedAPIKeys {
+	return &IndexedAPIKeys{
+		endpoints: make(map[string]APILimits),
+		keys:      make(map[string]APILimits),
+		limits:    make(map[string]APILimits),
+		unknownKey: APILimits{
+			GlobalShedAtPercent: 100,
+		},
+	}
+}
+
+// Update replaces the contents of the local catalog with
+// the ones in the APIIndexedLimits. Malformed entries are
+// skipped.
+func (iak *IndexedAPIKeys) Update(ail *APIIndexedLimits) {
+	endpoints := make(map[string]APILimits, len(ail.Endpoints))
+	endpointKeys := make([]string, len(ail.Endpoints))
+	for idx, ep := range ail.Endpoints {
+		epKey := ail.endpointKey(&ail.Endpoints[idx])
+		if len(epKey) == 0 {
+			continue
+		}
+		endpointKeys[idx] = epKey
+		endpoints[epKey] = APILimits{
+			Shadow:          ep.Shadow,
+			Cost:            ep.RequestCost,
+			MaxDelay:        time.Duration(ep.MaxDelayMs) * time.Millisecond,
+			GlobalRateLimit: ep.GlobalRateLimit,
+			LimitKey:        ep.LimitKey,
+		}
+	}
+
+	shedAt := make(map[int]int64, len(ail.Priorities))
+	for _, p := range ail.Priorities {
+		if p.ShedAtPercent > 0 && p.ShedAtPercent <= 100 {
+			shedAt[p.Priority] = p.ShedAtPercent
+		}
+	}
+	priorityShedAt := func(priority int) int64 {
+		if pct, ok := shedAt[priority]; ok {
+			return pct
+		}
+		return 100
+	}
+
+	keys := make(map[string]APILimits, len(ail.APILimits))
+	limits := make(map[string]APILimits)
+	for _, akil := range ail.APILimits {
+		keyLimits := APILimits{
+			Shadow:              akil.Shadow,
+			MaxDelay:            time.Duration(akil.MaxDelayMs) * time.Millisecond,
+			GlobalShedAtPercent: priorityShedAt(akil.Priority),
+			Priority:            akil.Priority,
+		}
+		keys[akil.APIKey] = keyLimits
+		for _, lim := range akil.Limits {
+			if lim.EndpointIdx < 0 || lim.EndpointIdx >= len(endpointKeys) ||
+				len(endpointKeys[lim.EndpointIdx]) == 0 {
+				continue
+			}
+			epKey := endpointKeys[lim.EndpointIdx]
+			limKey := fmt.Sprintf("%s_%s", akil.APIKey, epKey)
+			l := combineLimits(limKey, keyLimits, endpoints[epKey])
+			l.Concurrency = lim.Concurrency
+			limits[limKey] = l
+		}
+	}
+
+	iak.access.Lock()
+	iak.endpoints = endpoints
+	iak.keys = keys
+	iak.limits = limits
+	iak.unknownKey = APILimits{
+		GlobalShedAtPercent: priorityShedAt(0),
+	}
+	iak.access.Unlock()
+}
+
+// GetLimits returns the options for an api key and endpoint. If
+// the api key has no limits defined for the endpoint, the endpoint
+// and api key level options are combined.
+func (iak *IndexedAPIKeys) GetLimits(apiKey string, method string, endpoint string) APILimits {
+	epKey := fmt.Sprintf("%s_%s", strings.ToUpper(method), endpoint)
+	limKey := fmt.Sprintf("%s_%s", apiKey, epKey)
+
+	iak.access.RLock()
+	defer iak.access.RUnlock()
+	if l, ok := iak.limits[limKey]; ok {
+		return l
+	}
+	keyLimits, ok := iak.keys[apiKey]
+	if !ok {
+		keyLimits = iak.unknownKey
+	}
+	return combineLimits(limKey, keyLimits, iak.endpoints[epKey])
+}
+
+// combineLimits merges the api key level and the endpoint level
+// options
+func combineLimits(limKey string, keyLimits APILimits,
+	endpointLimits APILimits) APILimits {
+	l := APILimits{
+		RateLimitsKeyPrefix: limKey,
+		Shadow:              keyLimits.Shadow || endpointLimits.Shadow,
+		Cost:                endpointLimits.Cost,
+		MaxDelay:            endpointLimits.MaxDelay,
+		GlobalRateLimit:     endpointLimits.GlobalRateLimit,
+		GlobalShedAtPercent: keyLimits.GlobalShedAtPercent,
+		Priority:            keyLimits.Priority,
+		LimitKey:            endpointLimits.LimitKey,
+	}
+	// the api key max delay overrides the endpoint one
+	if keyLimits.MaxDelay > 0 {
+		l.MaxDelay = keyLimits.MaxDelay
+	}
+	return l
+}
+
+// BlockUntil is not implemented yet for the IndexedAPIKeys
+func (iak *IndexedAPIKeys) BlockUntil(apiKey string, until time.Time) {
+}
@@ -3,31 +3,130 @@ package catalog
 import (
 	"fmt"
 	"time"
+
+	"github.com/dhontecillas/dynlimits/pkg/pathmatcher"
 )
 
+// RequestCost defines how much each request to an endpoint
+// consumes from its limits:
+//
+//   - Cost: the fixed cost of a request (1 if not set)
+//   - Header: the name of a request header that contains the
+//     cost of the request (like one set by an upstream gateway).
+//     It is only read from the trusted proxies, and can raise the
+//     cost, but not lower it.
+//   - BodyUnit: if greater than zero, the cost is the request
+//     body size divided by BodyUnit bytes (rounded up). It requires
+//     a Cost, that is charged for the bodies of unknown length.
+//
+// When the cost cannot be derived from the header or the body,
+// the fixed cost is used.
+type RequestCost struct {
+	Cost     int64  `json:"cost,omitempty"`
+	Header   string `json:"costheader,omitempty"`
+	BodyUnit int64  `json:"costbodyunit,omitempty"`
+}
+
+// LimitKeyDef lists the request values that become part of
+// the limits key of an endpoint, so each combination of values
+// has its own counters (like "10 writes per minute per recipient
+// per API key"):
+//
+//   - PathParams: names of path parameters (as in `{recipient_id}`)
+//   - QueryParams: names of query string parameters
+//   - Headers: names of request headers
+//
+// All the combinations share the limit defined for the endpoint.
+type LimitKeyDef struct {
+	PathParams  []string `json:"path,omitempty"`
+	QueryParams []string `json:"query,omitempty"`
+	Headers     []string `json:"headers,omitempty"`
+}
+
 // EndpointIndexedDef contains the index
 // to the path definition, and an index
-// to the http verb to define an endpoint
+// to the http verb to define an endpoint.
+//
+// When Shadow is set, the limits for the endpoint are
+// evaluated but never enforced.
+//
+// When MaxDelayMs is set, requests over the limit are held
+// until there is room for them, if that happens in less
+// than MaxDelayMs milliseconds, instead of being rejected.
+//
+// GlobalRateLimit is the limit of requests per minute to the
+// endpoint for all the API keys together (0 means no limit).
+//
+// When LimitKey is set, the requests are counted separately for
+// each combination of the values it selects.
+//
+// When Host or Headers are set, the endpoint only matches the
+// requests for that host (that can be a wildcard subdomain like
+// `*.example.com`) and with those header values.
+//
+// When several endpoints match a request, the one with the
+// highest Precedence is selected.
+//
+// Upstream is the name of the upstream service the requests to the
+// endpoint are sent to (empty for the default upstream).
 type EndpointIndexedDef struct {
-	PathIdx   int `json:"p"`
-	MethodIdx int `json:"m"`
+	PathIdx         int               `json:"p"`
+	MethodIdx       int               `json:"m"`
+	Host            string            `json:"host,omitempty"`
+	Headers         map[string]string `json:"headers,omitempty"`
+	Precedence      int               `json:"prec,omitempty"`
+	Shadow          bool              `json:"shadow,omitempty"`
+	MaxDelayMs      int64             `json:"maxdelayms,omitempty"`
+	GlobalRateLimit int64             `json:"grl,omitempty"`
+	LimitKey        *LimitKeyDef      `json:"limitkey,omitempty"`
+	Upstream        string            `json:"upstream,omitempty"`
+	RequestCost
 }
 
 // EndpointIndexedLimits contains an index
 // to the list of endpoints definitions and
 // the limit to apply to this endpoint.
+//
+// Concurrency is the max number of requests that can
+// be in flight at the same time (0 means no limit).
 type EndpointIndexedLimits struct {
 	EndpointIdx int   `json:"ep"`
 	RateLimit   int64 `json:"rl"`
+	Concurrency int64 `json:"cc,omitempty"`
 }
 
 // APIKeyIndexedLimits has the limits to be
 // applied to a given API Key. See
 // `EndpointsIndexedLimits` to see how to
 // reference tha endpoints.
+//
+// When Shadow is set, the limits for the API key are
+// evaluated but never enforced.
+//
+// MaxDelayMs overrides the endpoints MaxDelayMs for this
+// API key (to slow down batch clients instead of rejecting
+// their requests).
+//
+// Priority selects how early the API key requests are shed
+// when an endpoint global limit is being reached. See
+// `PriorityIndexedDef`.
 type APIKeyIndexedLimits struct {
-	APIKey string                  `json:"key"`
-	Limits []EndpointIndexedLimits `json:"limits"`
+	APIKey     string                  `json:"key"`
+	Limits     []EndpointIndexedLimits `json:"limits"`
+	Shadow     bool                    `json:"shadow,omitempty"`
+	MaxDelayMs int64                   `json:"maxdelayms,omitempty"`
+	Priority   int                     `json:"priority,omitempty"`
+}
+
+// PriorityIndexedDef defines the percentage of an endpoint global
+// limit that can be used before the requests from API keys with the
+// given priority start to be shed. This way, requests from lower
+// plans can be shed before the global limit is reached.
+//
+// Priorities without a definition can use all the global limit.
+type PriorityIndexedDef struct {
+	Priority      int   `json:"p"`
+	ShedAtPercent int64 `json:"shedat"`
 }
 
 // APICatalogVersion contains the version information
@@ -48,11 +147,12 @@ type APICatalogVersion struct {
 // APIIndexedLimits contains all the information required
 // to perform per endpoint and api key rate limits
 type APIIndexedLimits struct {
-	Version   APICatalogVersion     `json:"version"`
-	Methods   []string              `json:"methods"`
-	Paths     []string              `json:"paths"`
-	Endpoints []EndpointIndexedDef  `json:"endpoints"`
-	APILimits []APIKeyIndexedLimits `json:"apilimits"`
+	Version    APICatalogVersion     `json:"version"`
+	Methods    []string              `json:"methods"`
+	Paths      []string              `json:"paths"`
+	Endpoints  []EndpointIndexedDef  `json:"endpoints"`
+	APILimits  []APIKeyIndexedLimits `json:"apilimits"`
+	Priorities []PriorityIndexedDef  `json:"priorities,omitempty"`
 }
 
 // Validate checks that all indices point to valid positions
@@ -70,16 +170,107 @@ func (ail *APIIndexedLimits) Validate() []error {
 				fmt.Errorf("Bad MethodIdx in Endpoint %d (%#v)",
 					idx, ep))
 		}
+		if ep.GlobalRateLimit < 0 {
+			errs = append(errs,
+				fmt.Errorf("Bad GlobalRateLimit in Endpoint %d (%#v)",
+					idx, ep))
+		}
+		if ep.MaxDelayMs < 0 {
+			errs = append(errs,
+				fmt.Errorf("Bad MaxDelayMs in Endpoint %d (%#v)",
+					idx, ep))
+		}
+		if ep.Cost < 0 || ep.BodyUnit < 0 {
+			errs = append(errs,
+				fmt.Errorf("Bad RequestCost in Endpoint %d (%#v)",
+					idx, ep))
+		}
+		if ep.BodyUnit > 0 && ep.Cost == 0 {
+			errs = append(errs,
+				fmt.Errorf("Missing Cost for the bodies of unknown length in Endpoint %d (%#v)",
+					idx, ep))
+		}
+		if ep.PathIdx >= 0 && ep.PathIdx < len(ail.Paths) {
+			if err := pathmatcher.ValidatePath(ail.Paths[ep.PathIdx]); err != nil {
+				errs = append(errs,
+					fmt.Errorf("Bad path in Endpoint %d (%#v): %s",
+						idx, ep, err.Error()))
+			}
+		}
+		if err := ep.RouteConditions().Validate(); err != nil {
+			errs = append(errs,
+				fmt.Errorf("Bad route conditions in Endpoint %d (%#v): %s",
+					idx, ep, err.Error()))
+		}
+		if ep.LimitKey != nil && ep.PathIdx >= 0 && ep.PathIdx < len(ail.Paths) {
+			names := pathmatcher.PathParamNames(ail.Paths[ep.PathIdx])
+			for _, name := range ep.LimitKey.PathParams {
+				if !containsString(names, name) {
+					errs = append(errs,
+						fmt.Errorf("Bad LimitKey path param %q in Endpoint %d (%#v)",
+							name, idx, ep))
+				}
+			}
+		}
+	}
+
+	routes := make([]pathmatcher.Route, 0, len(ail.Endpoints))
+	for idx := range ail.Endpoints {
+		if route, ok := ail.endpointRoute(&ail.Endpoints[idx]); ok &&
+			pathmatcher.ValidatePath(route.Path) == nil {
+			routes = append(routes, route)
+		}
+	}
+	errs = append(errs, pathmatcher.FindConflicts(routes)...)
+
+	for idx, p := range ail.Priorities {
+		if p.ShedAtPercent <= 0 || p.ShedAtPercent > 100 {
+			errs = append(errs,
+				fmt.Errorf("Bad ShedAtPercent in Priority %d (%#v)",
+					idx, p))
+		}
 	}
 
 	for apiLimIdx, akil := range ail.APILimits {
+		if akil.MaxDelayMs < 0 {
+			errs = append(errs,
+				fmt.Errorf("Bad MaxDelayMs in APILim %d", apiLimIdx))
+		}
 		for limIdx, lim := range akil.Limits {
 			if lim.EndpointIdx < 0 || lim.EndpointIdx >= len(ail.Endpoints) {
 				errs = append(errs,
 					fmt.Errorf("Bad EndpointIdx in APILim %d, limIdx: %d (%#v)",
 						apiLimIdx, limIdx, lim))
 			}
+			if lim.Concurrency < 0 {
+				errs = append(errs,
+					fmt.Errorf("Bad Concurrency in APILim %d, limIdx: %d (%#v)",
+						apiLimIdx, limIdx, lim))
+			}
+		}
+	}
+	return errs
+}
+
+// ValidateUpstreams checks that the upstream service of each
+// endpoint exists, using the hasService function of the proxy.
+func (ail *APIIndexedLimits) ValidateUpstreams(hasService func(string) bool) []error {
+	errs := []error{}
+	for idx, ep := range ail.Endpoints {
+		if len(ep.Upstream) > 0 && !hasService(ep.Upstream) {
+			errs = append(errs,
+				fmt.Errorf("Unknown upstream service %q in Endpoint %d",
+					ep.Upstream, idx))
 		}
 	}
 	return errs
 }
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
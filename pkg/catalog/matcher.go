@@ -5,18 +5,56 @@ import (
 )
 
 // UpdateSharedMatcher updates the valid paths where rate limits can
-// be applied to
-func UpdateSharedMatcher(ail *APIIndexedLimits, pm *pathmatcher.SharedPathMatcher) {
+// be applied to. If the routes of the catalog can not be built, the
+// matcher keeps its previous routes, and a pathmatcher.BuildError
+// with the failed routes is returned.
+func UpdateSharedMatcher(ail *APIIndexedLimits, pm *pathmatcher.SharedPathMatcher) error {
 	cs := pm.StartChangeSet()
+	defer cs.Abort()
 
 	cs.RemoveAll()
-	for _, ep := range ail.Endpoints {
-		mIdx := ep.MethodIdx
-		pIdx := ep.PathIdx
-		if mIdx < 0 || mIdx >= len(ail.Methods) || pIdx < 0 || pIdx > len(ail.Paths) {
+	for idx := range ail.Endpoints {
+		route, ok := ail.endpointRoute(&ail.Endpoints[idx])
+		if !ok {
 			continue
 		}
-		cs.AddRoute(ail.Methods[mIdx], ail.Paths[pIdx])
+		cs.AddRouteDef(route)
 	}
-	cs.Commit()
+	return cs.Commit()
+}
+
+// RouteConditions returns the host and header conditions that
+// the requests must meet to match the endpoint
+func (ep *EndpointIndexedDef) RouteConditions() pathmatcher.RouteConditions {
+	return pathmatcher.RouteConditions{
+		Host:    ep.Host,
+		Headers: ep.Headers,
+	}
+}
+
+// endpointRoute returns the route definition of an endpoint, and
+// false if the endpoint indices are not valid.
+func (ail *APIIndexedLimits) endpointRoute(ep *EndpointIndexedDef) (pathmatcher.Route, bool) {
+	if ep.MethodIdx < 0 || ep.MethodIdx >= len(ail.Methods) ||
+		ep.PathIdx < 0 || ep.PathIdx >= len(ail.Paths) {
+		return pathmatcher.Route{}, false
+	}
+	return pathmatcher.Route{
+		Method:     ail.Methods[ep.MethodIdx],
+		Path:       ail.Paths[ep.PathIdx],
+		Conditions: ep.RouteConditions(),
+		Precedence: ep.Precedence,
+		Upstream:   ep.Upstream,
+	}, true
+}
+
+// endpointKey returns the key that identifies an endpoint in the
+// limits keys, that is the same as the RedisKey of the route it
+// matches, or an empty string if the endpoint indices are not valid.
+func (ail *APIIndexedLimits) endpointKey(ep *EndpointIndexedDef) string {
+	route, ok := ail.endpointRoute(ep)
+	if !ok {
+		return ""
+	}
+	return pathmatcher.NewRoutePathMatched(route).RedisKey
 }
@@ -3,7 +3,6 @@ package catalog
 import (
 	"fmt"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/dhontecillas/dynlimits/pkg/ratelimit"
@@ -73,15 +72,12 @@ func RedisUpdateLimits(conn redis.Conn, ail *APIIndexedLimits) {
 				// TODO: log malformed data
 				continue
 			}
-			eidx := ail.Endpoints[lim.EndpointIdx]
-			if eidx.MethodIdx < 0 || eidx.MethodIdx >= len(ail.Methods) ||
-				eidx.PathIdx < 0 || eidx.PathIdx >= len(ail.Paths) {
+			epKey := ail.endpointKey(&ail.Endpoints[lim.EndpointIdx])
+			if len(epKey) == 0 {
 				// TODO: log malformed data
 				continue
 			}
-			mn := strings.ToUpper(ail.Methods[eidx.MethodIdx])
-			key := fmt.Sprintf("%s_%s_%s", apiKey, mn,
-				ail.Paths[eidx.PathIdx])
+			key := fmt.Sprintf("%s_%s", apiKey, epKey)
 			fmt.Printf("set limit for %s to %d\n", key, lim.RateLimit)
 			// TODO: we can optimize this by checking if the ratelimit
 			// has changed.
@@ -41,6 +41,9 @@ type CatalogURLs struct {
 //	- redisCheckSeconds: we check in redis if some other proxy
 //		has already updated to a new version the data in Redis
 //  - redisPool: a pool of connections for redis
+//  - apiKeys: the local catalog of api key options
+//  - hasService: checks that the upstream services of the
+//		endpoints exist (nil to not check them)
 //
 //  - RequestOnDemandUpdate: a channel to be used by the client
 //		code to force an update
@@ -53,6 +56,8 @@ type CatalogUpdater struct {
 	serverCheckSeconds int64
 	redisPool          *redis.Pool
 	matcher            *pathmatcher.SharedPathMatcher
+	apiKeys            *IndexedAPIKeys
+	hasService         func(string) bool
 
 	RequestOnDemandUpdate chan bool
 	RequestShutdown       chan bool
@@ -162,7 +167,25 @@ func (cu *CatalogUpdater) checkUpdateFromServer() {
 	for _, e := range errs {
 		fmt.Printf("--> err: %s\n", e.Error())
 	}
-	UpdateSharedMatcher(indexedCatalog, cu.matcher)
+	if cu.hasService != nil {
+		if errs := indexedCatalog.ValidateUpstreams(cu.hasService); len(errs) > 0 {
+			// an endpoint sent to a missing upstream would be
+			// routed nowhere, so the whole catalog is refused
+			fmt.Printf("Err checkUpdateFromServer, refusing catalog %s: %s\n",
+				indexedCatalog.Version.SemVer, errs[0].Error())
+			return
+		}
+	}
+	if err := UpdateSharedMatcher(indexedCatalog, cu.matcher); err != nil {
+		// the catalog is not applied, so the matcher, the local
+		// limits and redis stay consistent with the previous one
+		fmt.Printf("Err checkUpdateFromServer, refusing catalog %s: %s\n",
+			indexedCatalog.Version.SemVer, err.Error())
+		return
+	}
+	if cu.apiKeys != nil {
+		cu.apiKeys.Update(indexedCatalog)
+	}
 
 	rc := cu.redisPool.Get()
 	defer rc.Close()
@@ -210,6 +233,7 @@ func (cu *CatalogUpdater) updatesPoller() {
 // LaunchUpdatesPoller returns a CatalogUpdater
 func LaunchUpdatesPoller(redisPool *redis.Pool, updateBaseURL string,
 	catalogApiKey string, matcher *pathmatcher.SharedPathMatcher,
+	apiKeys *IndexedAPIKeys, hasService func(string) bool,
 	redisCheckSeconds int64, serverCheckSeconds int64) (*CatalogUpdater, error) {
 
 	if serverCheckSeconds < redisCheckSeconds && serverCheckSeconds > 0 {
@@ -228,6 +252,8 @@ func LaunchUpdatesPoller(redisPool *redis.Pool, updateBaseURL string,
 		serverCheckSeconds:    serverCheckSeconds,
 		redisPool:             redisPool,
 		matcher:               matcher,
+		apiKeys:               apiKeys,
+		hasService:            hasService,
 		RequestOnDemandUpdate: make(chan bool),
 		RequestShutdown:       make(chan bool),
 	}
@@ -14,12 +14,103 @@ const (
 	KeyDynLimitsForwardToPort   string = "dynlimits.forwardto.port"
 	KeyDynLimitsForwardToScheme string = "dynlimits.forwardto.scheme"
 
+	KeyDynLimitsForwardToFlushIntervalMs string = "dynlimits.forwardto.flushintervalms"
+	KeyDynLimitsForwardToPreserveHost    string = "dynlimits.forwardto.preservehost"
+	KeyDynLimitsForwardToXForwardedFor   string = "dynlimits.forwardto.xforwardedfor"
+	KeyDynLimitsForwardToXForwardedProto string = "dynlimits.forwardto.xforwardedproto"
+	KeyDynLimitsForwardToXForwardedHost  string = "dynlimits.forwardto.xforwardedhost"
+	KeyDynLimitsForwardToForwarded       string = "dynlimits.forwardto.forwarded"
+	KeyDynLimitsForwardToTrustedProxies  string = "dynlimits.forwardto.trustedproxies"
+
+	KeyDynLimitsUpstreamsList         string = "dynlimits.upstreams.list"
+	KeyDynLimitsUpstreamsBalancing    string = "dynlimits.upstreams.balancing"
+	KeyDynLimitsUpstreamsHashHeader   string = "dynlimits.upstreams.hashheader"
+	KeyDynLimitsUpstreamsServices     string = "dynlimits.upstreams.services"
+	KeyDynLimitsUpstreamsRoutes       string = "dynlimits.upstreams.routes"
+	KeyDynLimitsHealthCheckPath       string = "dynlimits.upstreams.healthcheck.path"
+	KeyDynLimitsHealthCheckIntervalMs string = "dynlimits.upstreams.healthcheck.intervalms"
+	KeyDynLimitsHealthCheckTimeoutMs  string = "dynlimits.upstreams.healthcheck.timeoutms"
+	KeyDynLimitsHealthCheckFall       string = "dynlimits.upstreams.healthcheck.fall"
+	KeyDynLimitsHealthCheckRise       string = "dynlimits.upstreams.healthcheck.rise"
+	KeyDynLimitsEjectionMaxFails      string = "dynlimits.upstreams.ejection.maxfails"
+	KeyDynLimitsEjectionDurationMs    string = "dynlimits.upstreams.ejection.durationms"
+
+	KeyDynLimitsDialTimeoutMs           string = "dynlimits.upstreams.timeouts.dialms"
+	KeyDynLimitsResponseHeaderTimeoutMs string = "dynlimits.upstreams.timeouts.responseheaderms"
+	KeyDynLimitsIdleConnTimeoutMs       string = "dynlimits.upstreams.timeouts.idleconnms"
+	KeyDynLimitsRetriesMax              string = "dynlimits.upstreams.retries.max"
+	KeyDynLimitsRetryBudgetRatio        string = "dynlimits.upstreams.retries.budgetratio"
+	KeyDynLimitsRetryBudgetMinPerSec    string = "dynlimits.upstreams.retries.budgetminpersec"
+	KeyDynLimitsBreakerFailureRatio     string = "dynlimits.upstreams.breaker.failureratio"
+	KeyDynLimitsBreakerMinRequests      string = "dynlimits.upstreams.breaker.minrequests"
+	KeyDynLimitsBreakerWindowMs         string = "dynlimits.upstreams.breaker.windowms"
+	KeyDynLimitsBreakerOpenMs           string = "dynlimits.upstreams.breaker.openms"
+	KeyDynLimitsBreakerHalfOpenRequests string = "dynlimits.upstreams.breaker.halfopenrequests"
+
+	KeyDynLimitsListenTLSCertFile     string = "dynlimits.listen.tls.certfile"
+	KeyDynLimitsListenTLSKeyFile      string = "dynlimits.listen.tls.keyfile"
+	KeyDynLimitsListenTLSMinVersion   string = "dynlimits.listen.tls.minversion"
+	KeyDynLimitsListenTLSCipherSuites string = "dynlimits.listen.tls.ciphersuites"
+	KeyDynLimitsListenTLSClientCAFile string = "dynlimits.listen.tls.clientcafile"
+	KeyDynLimitsListenTLSClientAuth   string = "dynlimits.listen.tls.clientauth"
+	KeyDynLimitsListenTLSReloadSecs   string = "dynlimits.listen.tls.reloadsecs"
+
+	KeyDynLimitsListenHTTP2Enabled    string = "dynlimits.listen.http2.enabled"
+	KeyDynLimitsListenHTTP2H2C        string = "dynlimits.listen.http2.h2c"
+	KeyDynLimitsListenHTTP2MaxStreams string = "dynlimits.listen.http2.maxstreams"
+
+	KeyDynLimitsUpstreamTLSCAFile     string = "dynlimits.upstreams.tls.cafile"
+	KeyDynLimitsUpstreamTLSCertFile   string = "dynlimits.upstreams.tls.certfile"
+	KeyDynLimitsUpstreamTLSKeyFile    string = "dynlimits.upstreams.tls.keyfile"
+	KeyDynLimitsUpstreamTLSServerName string = "dynlimits.upstreams.tls.servername"
+	KeyDynLimitsUpstreamTLSInsecure   string = "dynlimits.upstreams.tls.insecureskipverify"
+
+	KeyDynLimitsMirrorUpstream     string = "dynlimits.mirror.upstream"
+	KeyDynLimitsMirrorPercent      string = "dynlimits.mirror.percent"
+	KeyDynLimitsMirrorEndpoints    string = "dynlimits.mirror.endpoints"
+	KeyDynLimitsMirrorAPIKeys      string = "dynlimits.mirror.apikeys"
+	KeyDynLimitsMirrorCompare      string = "dynlimits.mirror.compare"
+	KeyDynLimitsMirrorMaxBodyBytes string = "dynlimits.mirror.maxbodybytes"
+	KeyDynLimitsMirrorTimeoutMs    string = "dynlimits.mirror.timeoutms"
+	KeyDynLimitsMirrorMaxInFlight  string = "dynlimits.mirror.maxinflight"
+
 	KeyDynLimitsRedisAddress          string = "dynlimits.redis.address"
 	KeyDynLimitsCatalogFile           string = "dynlimits.catalog.file"
 	KeyDynLimitsCatalogServerURL      string = "dynlimits.catalog.server.url"
 	KeyDynLimitsCatalogServerAPIKey   string = "dynlimits.catalog.server.apikey"
 	KeyDynLimitsCatalogServerPollSecs string = "dynlimits.catalog.server.pollsecs"
 	KeyDynLimitsCatalogRedisPollSecs  string = "dynlimits.catalog.redis.pollsecs"
+
+	KeyDynLimitsUnknownPathsPolicy    string = "dynlimits.unknownpaths.policy"
+	KeyDynLimitsUnknownPathsReqPerMin string = "dynlimits.unknownpaths.reqpermin"
+	KeyDynLimitsShadow                string = "dynlimits.shadow"
+	KeyDynLimitsRefundStatus          string = "dynlimits.refundstatus"
+
+	KeyDynLimitsConcurrencyBackend   string = "dynlimits.concurrency.backend"
+	KeyDynLimitsConcurrencyLeaseSecs string = "dynlimits.concurrency.leasesecs"
+
+	KeyDynLimitsDelayMaxQueued       string = "dynlimits.delay.maxqueued"
+	KeyDynLimitsDelayMaxQueuedPerKey string = "dynlimits.delay.maxqueuedperkey"
+
+	KeyDynLimitsWebSocketMsgPerMin string = "dynlimits.websocket.msgpermin"
+
+	KeyDynLimitsAdminAddress string = "dynlimits.admin.address"
+
+	KeyDynLimitsPathsDecoding        string = "dynlimits.paths.decoding"
+	KeyDynLimitsPathsCollapseSlashes string = "dynlimits.paths.collapseslashes"
+	KeyDynLimitsPathsDotSegments     string = "dynlimits.paths.dotsegments"
+	KeyDynLimitsPathsTrailingSlash   string = "dynlimits.paths.trailingslash"
+	KeyDynLimitsPathsCaseInsensitive string = "dynlimits.paths.caseinsensitive"
+
+	KeyDynLimitsAdaptiveEnabled      string = "dynlimits.adaptive.enabled"
+	KeyDynLimitsAdaptiveIntervalMs   string = "dynlimits.adaptive.intervalms"
+	KeyDynLimitsAdaptiveMaxErrorRate string = "dynlimits.adaptive.maxerrorrate"
+	KeyDynLimitsAdaptiveMaxLatencyMs string = "dynlimits.adaptive.maxlatencyms"
+	KeyDynLimitsAdaptiveMinRequests  string = "dynlimits.adaptive.minrequests"
+	KeyDynLimitsAdaptiveDecrease     string = "dynlimits.adaptive.decrease"
+	KeyDynLimitsAdaptiveIncrease     string = "dynlimits.adaptive.increase"
+	KeyDynLimitsAdaptiveMinFactor    string = "dynlimits.adaptive.minfactor"
+	KeyDynLimitsAdaptiveMaxPriority  string = "dynlimits.adaptive.maxpriority"
 )
 
 // DynLimitsConfig contains the configuration
@@ -31,6 +122,66 @@ type DynLimitsConfig struct {
 	ForwardToPort   string
 	ForwardToScheme string
 
+	ForwardToFlushIntervalMs int64
+	ForwardToPreserveHost    bool
+	ForwardToXForwardedFor   bool
+	ForwardToXForwardedProto bool
+	ForwardToXForwardedHost  bool
+	ForwardToForwarded       bool
+	ForwardToTrustedProxies  string
+
+	UpstreamsList         string
+	UpstreamsBalancing    string
+	UpstreamsHashHeader   string
+	UpstreamsServices     string
+	UpstreamsRoutes       string
+	HealthCheckPath       string
+	HealthCheckIntervalMs int64
+	HealthCheckTimeoutMs  int64
+	HealthCheckFall       int
+	HealthCheckRise       int
+	EjectionMaxFails      int
+	EjectionDurationMs    int64
+
+	DialTimeoutMs           int64
+	ResponseHeaderTimeoutMs int64
+	IdleConnTimeoutMs       int64
+	RetriesMax              int
+	RetryBudgetRatio        float64
+	RetryBudgetMinPerSec    int
+	BreakerFailureRatio     float64
+	BreakerMinRequests      int
+	BreakerWindowMs         int64
+	BreakerOpenMs           int64
+	BreakerHalfOpenRequests int
+
+	ListenTLSCertFile     string
+	ListenTLSKeyFile      string
+	ListenTLSMinVersion   string
+	ListenTLSCipherSuites string
+	ListenTLSClientCAFile string
+	ListenTLSClientAuth   string
+	ListenTLSReloadSecs   int64
+
+	ListenHTTP2Enabled    bool
+	ListenHTTP2H2C        bool
+	ListenHTTP2MaxStreams int
+
+	UpstreamTLSCAFile     string
+	UpstreamTLSCertFile   string
+	UpstreamTLSKeyFile    string
+	UpstreamTLSServerName string
+	UpstreamTLSInsecure   bool
+
+	MirrorUpstream     string
+	MirrorPercent      float64
+	MirrorEndpoints    string
+	MirrorAPIKeys      string
+	MirrorCompare      bool
+	MirrorMaxBodyBytes int64
+	MirrorTimeoutMs    int64
+	MirrorMaxInFlight  int64
+
 	RedisAddress string
 
 	CatalogFile           string
@@ -38,6 +189,37 @@ type DynLimitsConfig struct {
 	CatalogServerAPIKey   string
 	CatalogServerPollSecs int64
 	CatalogRedisPollSecs  int64
+
+	UnknownPathsPolicy    string
+	UnknownPathsReqPerMin int64
+	Shadow                bool
+	RefundStatus          string
+
+	ConcurrencyBackend   string
+	ConcurrencyLeaseSecs int64
+
+	DelayMaxQueued       int
+	DelayMaxQueuedPerKey int
+
+	WebSocketMsgPerMin int64
+
+	AdminAddress string
+
+	PathsDecoding        string
+	PathsCollapseSlashes bool
+	PathsDotSegments     bool
+	PathsTrailingSlash   string
+	PathsCaseInsensitive bool
+
+	AdaptiveEnabled      bool
+	AdaptiveIntervalMs   int64
+	AdaptiveMaxErrorRate float64
+	AdaptiveMaxLatencyMs int64
+	AdaptiveMinRequests  int64
+	AdaptiveDecrease     float64
+	AdaptiveIncrease     float64
+	AdaptiveMinFactor    float64
+	AdaptiveMaxPriority  int
 }
 
 func (dlc *DynLimitsConfig) ForwardBaseURL() string {
@@ -49,6 +231,21 @@ func (dlc *DynLimitsConfig) ForwardBaseURL() string {
 		dlc.ForwardToHost, dlc.ForwardToPort)
 }
 
+// ListenTLS returns true if the server must terminate TLS, that
+// is when it has a certificate
+func (dlc *DynLimitsConfig) ListenTLS() bool {
+	return len(dlc.ListenTLSCertFile) > 0
+}
+
+// Upstreams returns the comma separated list of upstream base
+// urls, that defaults to the single ForwardBaseURL
+func (dlc *DynLimitsConfig) Upstreams() string {
+	if len(dlc.UpstreamsList) == 0 {
+		return dlc.ForwardBaseURL()
+	}
+	return dlc.UpstreamsList
+}
+
 func (dlc *DynLimitsConfig) ForwardAddr() string {
 	return fmt.Sprintf("%s:%s", dlc.ForwardToHost, dlc.ForwardToPort)
 }
@@ -65,6 +262,64 @@ func LoadConf() *DynLimitsConfig {
 	v.SetDefault(KeyDynLimitsForwardToHost, "127.0.0.1")
 	v.SetDefault(KeyDynLimitsForwardToPort, "8000")
 	v.SetDefault(KeyDynLimitsForwardToScheme, "http")
+	v.SetDefault(KeyDynLimitsForwardToFlushIntervalMs, 0)
+	v.SetDefault(KeyDynLimitsForwardToPreserveHost, false)
+	v.SetDefault(KeyDynLimitsForwardToXForwardedFor, true)
+	v.SetDefault(KeyDynLimitsForwardToXForwardedProto, true)
+	v.SetDefault(KeyDynLimitsForwardToXForwardedHost, true)
+	v.SetDefault(KeyDynLimitsForwardToForwarded, false)
+	v.SetDefault(KeyDynLimitsForwardToTrustedProxies, "")
+
+	v.SetDefault(KeyDynLimitsUpstreamsList, "")
+	v.SetDefault(KeyDynLimitsUpstreamsBalancing, "roundrobin")
+	v.SetDefault(KeyDynLimitsUpstreamsHashHeader, "X-Api-Key")
+	v.SetDefault(KeyDynLimitsUpstreamsServices, "")
+	v.SetDefault(KeyDynLimitsUpstreamsRoutes, "")
+	v.SetDefault(KeyDynLimitsHealthCheckPath, "")
+	v.SetDefault(KeyDynLimitsHealthCheckIntervalMs, 5000)
+	v.SetDefault(KeyDynLimitsHealthCheckTimeoutMs, 1000)
+	v.SetDefault(KeyDynLimitsHealthCheckFall, 3)
+	v.SetDefault(KeyDynLimitsHealthCheckRise, 2)
+	v.SetDefault(KeyDynLimitsEjectionMaxFails, 0)
+	v.SetDefault(KeyDynLimitsEjectionDurationMs, 30000)
+	v.SetDefault(KeyDynLimitsDialTimeoutMs, 5000)
+	v.SetDefault(KeyDynLimitsResponseHeaderTimeoutMs, 30000)
+	v.SetDefault(KeyDynLimitsIdleConnTimeoutMs, 90000)
+	v.SetDefault(KeyDynLimitsRetriesMax, 1)
+	v.SetDefault(KeyDynLimitsRetryBudgetRatio, 0.2)
+	v.SetDefault(KeyDynLimitsRetryBudgetMinPerSec, 3)
+	v.SetDefault(KeyDynLimitsBreakerFailureRatio, 0)
+	v.SetDefault(KeyDynLimitsBreakerMinRequests, 20)
+	v.SetDefault(KeyDynLimitsBreakerWindowMs, 10000)
+	v.SetDefault(KeyDynLimitsBreakerOpenMs, 30000)
+	v.SetDefault(KeyDynLimitsBreakerHalfOpenRequests, 1)
+
+	v.SetDefault(KeyDynLimitsListenTLSCertFile, "")
+	v.SetDefault(KeyDynLimitsListenTLSKeyFile, "")
+	v.SetDefault(KeyDynLimitsListenTLSMinVersion, "1.2")
+	v.SetDefault(KeyDynLimitsListenTLSCipherSuites, "")
+	v.SetDefault(KeyDynLimitsListenTLSClientCAFile, "")
+	v.SetDefault(KeyDynLimitsListenTLSClientAuth, "none")
+	v.SetDefault(KeyDynLimitsListenTLSReloadSecs, 10)
+
+	v.SetDefault(KeyDynLimitsListenHTTP2Enabled, true)
+	v.SetDefault(KeyDynLimitsListenHTTP2H2C, false)
+	v.SetDefault(KeyDynLimitsListenHTTP2MaxStreams, 250)
+
+	v.SetDefault(KeyDynLimitsUpstreamTLSCAFile, "")
+	v.SetDefault(KeyDynLimitsUpstreamTLSCertFile, "")
+	v.SetDefault(KeyDynLimitsUpstreamTLSKeyFile, "")
+	v.SetDefault(KeyDynLimitsUpstreamTLSServerName, "")
+	v.SetDefault(KeyDynLimitsUpstreamTLSInsecure, false)
+
+	v.SetDefault(KeyDynLimitsMirrorUpstream, "")
+	v.SetDefault(KeyDynLimitsMirrorPercent, 0)
+	v.SetDefault(KeyDynLimitsMirrorEndpoints, "")
+	v.SetDefault(KeyDynLimitsMirrorAPIKeys, "")
+	v.SetDefault(KeyDynLimitsMirrorCompare, false)
+	v.SetDefault(KeyDynLimitsMirrorMaxBodyBytes, 1048576)
+	v.SetDefault(KeyDynLimitsMirrorTimeoutMs, 5000)
+	v.SetDefault(KeyDynLimitsMirrorMaxInFlight, 100)
 
 	v.SetDefault(KeyDynLimitsRedisAddress, "localhost:6379")
 	v.SetDefault(KeyDynLimitsCatalogFile, "./catalog.json")
@@ -74,21 +329,125 @@ func LoadConf() *DynLimitsConfig {
 	v.SetDefault(KeyDynLimitsCatalogServerPollSecs, 10)
 	v.SetDefault(KeyDynLimitsCatalogRedisPollSecs, 3)
 
+	v.SetDefault(KeyDynLimitsUnknownPathsPolicy, "reject")
+	v.SetDefault(KeyDynLimitsUnknownPathsReqPerMin, 60)
+	v.SetDefault(KeyDynLimitsShadow, false)
+
+	v.SetDefault(KeyDynLimitsConcurrencyBackend, "redis")
+	v.SetDefault(KeyDynLimitsConcurrencyLeaseSecs, 30)
+
+	v.SetDefault(KeyDynLimitsDelayMaxQueued, 1000)
+	v.SetDefault(KeyDynLimitsDelayMaxQueuedPerKey, 10)
+	v.SetDefault(KeyDynLimitsWebSocketMsgPerMin, 0)
+
+	v.SetDefault(KeyDynLimitsPathsDecoding, "unreserved")
+	v.SetDefault(KeyDynLimitsPathsCollapseSlashes, true)
+	v.SetDefault(KeyDynLimitsPathsDotSegments, true)
+	v.SetDefault(KeyDynLimitsPathsTrailingSlash, "keep")
+	v.SetDefault(KeyDynLimitsPathsCaseInsensitive, false)
+
+	v.SetDefault(KeyDynLimitsAdaptiveEnabled, false)
+	v.SetDefault(KeyDynLimitsAdaptiveIntervalMs, 1000)
+	v.SetDefault(KeyDynLimitsAdaptiveMaxErrorRate, 0.1)
+	v.SetDefault(KeyDynLimitsAdaptiveMaxLatencyMs, 1000)
+	v.SetDefault(KeyDynLimitsAdaptiveMinRequests, 10)
+	v.SetDefault(KeyDynLimitsAdaptiveDecrease, 0.7)
+	v.SetDefault(KeyDynLimitsAdaptiveIncrease, 0.05)
+	v.SetDefault(KeyDynLimitsAdaptiveMinFactor, 0.1)
+	v.SetDefault(KeyDynLimitsAdaptiveMaxPriority, 2)
+
 	v.AutomaticEnv()
 	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
 
 	conf := DynLimitsConfig{
-		ListenHost:            v.GetString(KeyDynLimitsListenHost),
-		ListenPort:            v.GetString(KeyDynLimitsListenPort),
-		ForwardToHost:         v.GetString(KeyDynLimitsForwardToHost),
-		ForwardToPort:         v.GetString(KeyDynLimitsForwardToPort),
-		ForwardToScheme:       v.GetString(KeyDynLimitsForwardToScheme),
-		RedisAddress:          v.GetString(KeyDynLimitsRedisAddress),
-		CatalogFile:           v.GetString(KeyDynLimitsCatalogFile),
-		CatalogServerURL:      v.GetString(KeyDynLimitsCatalogServerURL),
-		CatalogServerAPIKey:   v.GetString(KeyDynLimitsCatalogServerAPIKey),
-		CatalogServerPollSecs: int64(v.GetInt(KeyDynLimitsCatalogServerPollSecs)),
-		CatalogRedisPollSecs:  int64(v.GetInt(KeyDynLimitsCatalogRedisPollSecs)),
+		ListenHost:               v.GetString(KeyDynLimitsListenHost),
+		ListenPort:               v.GetString(KeyDynLimitsListenPort),
+		ForwardToHost:            v.GetString(KeyDynLimitsForwardToHost),
+		ForwardToPort:            v.GetString(KeyDynLimitsForwardToPort),
+		ForwardToScheme:          v.GetString(KeyDynLimitsForwardToScheme),
+		ForwardToFlushIntervalMs: int64(v.GetInt(KeyDynLimitsForwardToFlushIntervalMs)),
+		ForwardToPreserveHost:    v.GetBool(KeyDynLimitsForwardToPreserveHost),
+		ForwardToXForwardedFor:   v.GetBool(KeyDynLimitsForwardToXForwardedFor),
+		ForwardToXForwardedProto: v.GetBool(KeyDynLimitsForwardToXForwardedProto),
+		ForwardToXForwardedHost:  v.GetBool(KeyDynLimitsForwardToXForwardedHost),
+		ForwardToForwarded:       v.GetBool(KeyDynLimitsForwardToForwarded),
+		ForwardToTrustedProxies:  v.GetString(KeyDynLimitsForwardToTrustedProxies),
+		UpstreamsList:            v.GetString(KeyDynLimitsUpstreamsList),
+		UpstreamsBalancing:       v.GetString(KeyDynLimitsUpstreamsBalancing),
+		UpstreamsHashHeader:      v.GetString(KeyDynLimitsUpstreamsHashHeader),
+		UpstreamsServices:        v.GetString(KeyDynLimitsUpstreamsServices),
+		UpstreamsRoutes:          v.GetString(KeyDynLimitsUpstreamsRoutes),
+		HealthCheckPath:          v.GetString(KeyDynLimitsHealthCheckPath),
+		HealthCheckIntervalMs:    int64(v.GetInt(KeyDynLimitsHealthCheckIntervalMs)),
+		HealthCheckTimeoutMs:     int64(v.GetInt(KeyDynLimitsHealthCheckTimeoutMs)),
+		HealthCheckFall:          v.GetInt(KeyDynLimitsHealthCheckFall),
+		HealthCheckRise:          v.GetInt(KeyDynLimitsHealthCheckRise),
+		EjectionMaxFails:         v.GetInt(KeyDynLimitsEjectionMaxFails),
+		EjectionDurationMs:       int64(v.GetInt(KeyDynLimitsEjectionDurationMs)),
+		DialTimeoutMs:            int64(v.GetInt(KeyDynLimitsDialTimeoutMs)),
+		ResponseHeaderTimeoutMs:  int64(v.GetInt(KeyDynLimitsResponseHeaderTimeoutMs)),
+		IdleConnTimeoutMs:        int64(v.GetInt(KeyDynLimitsIdleConnTimeoutMs)),
+		RetriesMax:               v.GetInt(KeyDynLimitsRetriesMax),
+		RetryBudgetRatio:         v.GetFloat64(KeyDynLimitsRetryBudgetRatio),
+		RetryBudgetMinPerSec:     v.GetInt(KeyDynLimitsRetryBudgetMinPerSec),
+		BreakerFailureRatio:      v.GetFloat64(KeyDynLimitsBreakerFailureRatio),
+		BreakerMinRequests:       v.GetInt(KeyDynLimitsBreakerMinRequests),
+		BreakerWindowMs:          int64(v.GetInt(KeyDynLimitsBreakerWindowMs)),
+		BreakerOpenMs:            int64(v.GetInt(KeyDynLimitsBreakerOpenMs)),
+		BreakerHalfOpenRequests:  v.GetInt(KeyDynLimitsBreakerHalfOpenRequests),
+		ListenTLSCertFile:        v.GetString(KeyDynLimitsListenTLSCertFile),
+		ListenTLSKeyFile:         v.GetString(KeyDynLimitsListenTLSKeyFile),
+		ListenTLSMinVersion:      v.GetString(KeyDynLimitsListenTLSMinVersion),
+		ListenTLSCipherSuites:    v.GetString(KeyDynLimitsListenTLSCipherSuites),
+		ListenTLSClientCAFile:    v.GetString(KeyDynLimitsListenTLSClientCAFile),
+		ListenTLSClientAuth:      v.GetString(KeyDynLimitsListenTLSClientAuth),
+		ListenTLSReloadSecs:      int64(v.GetInt(KeyDynLimitsListenTLSReloadSecs)),
+		ListenHTTP2Enabled:       v.GetBool(KeyDynLimitsListenHTTP2Enabled),
+		ListenHTTP2H2C:           v.GetBool(KeyDynLimitsListenHTTP2H2C),
+		ListenHTTP2MaxStreams:    v.GetInt(KeyDynLimitsListenHTTP2MaxStreams),
+		UpstreamTLSCAFile:        v.GetString(KeyDynLimitsUpstreamTLSCAFile),
+		UpstreamTLSCertFile:      v.GetString(KeyDynLimitsUpstreamTLSCertFile),
+		UpstreamTLSKeyFile:       v.GetString(KeyDynLimitsUpstreamTLSKeyFile),
+		UpstreamTLSServerName:    v.GetString(KeyDynLimitsUpstreamTLSServerName),
+		UpstreamTLSInsecure:      v.GetBool(KeyDynLimitsUpstreamTLSInsecure),
+		MirrorUpstream:           v.GetString(KeyDynLimitsMirrorUpstream),
+		MirrorPercent:            v.GetFloat64(KeyDynLimitsMirrorPercent),
+		MirrorEndpoints:          v.GetString(KeyDynLimitsMirrorEndpoints),
+		MirrorAPIKeys:            v.GetString(KeyDynLimitsMirrorAPIKeys),
+		MirrorCompare:            v.GetBool(KeyDynLimitsMirrorCompare),
+		MirrorMaxBodyBytes:       int64(v.GetInt(KeyDynLimitsMirrorMaxBodyBytes)),
+		MirrorTimeoutMs:          int64(v.GetInt(KeyDynLimitsMirrorTimeoutMs)),
+		MirrorMaxInFlight:        int64(v.GetInt(KeyDynLimitsMirrorMaxInFlight)),
+		RedisAddress:             v.GetString(KeyDynLimitsRedisAddress),
+		CatalogFile:              v.GetString(KeyDynLimitsCatalogFile),
+		CatalogServerURL:         v.GetString(KeyDynLimitsCatalogServerURL),
+		CatalogServerAPIKey:      v.GetString(KeyDynLimitsCatalogServerAPIKey),
+		CatalogServerPollSecs:    int64(v.GetInt(KeyDynLimitsCatalogServerPollSecs)),
+		CatalogRedisPollSecs:     int64(v.GetInt(KeyDynLimitsCatalogRedisPollSecs)),
+		UnknownPathsPolicy:       v.GetString(KeyDynLimitsUnknownPathsPolicy),
+		UnknownPathsReqPerMin:    int64(v.GetInt(KeyDynLimitsUnknownPathsReqPerMin)),
+		Shadow:                   v.GetBool(KeyDynLimitsShadow),
+		RefundStatus:             v.GetString(KeyDynLimitsRefundStatus),
+		ConcurrencyBackend:       v.GetString(KeyDynLimitsConcurrencyBackend),
+		ConcurrencyLeaseSecs:     int64(v.GetInt(KeyDynLimitsConcurrencyLeaseSecs)),
+		DelayMaxQueued:           v.GetInt(KeyDynLimitsDelayMaxQueued),
+		DelayMaxQueuedPerKey:     v.GetInt(KeyDynLimitsDelayMaxQueuedPerKey),
+		WebSocketMsgPerMin:       int64(v.GetInt(KeyDynLimitsWebSocketMsgPerMin)),
+		AdminAddress:             v.GetString(KeyDynLimitsAdminAddress),
+		PathsDecoding:            v.GetString(KeyDynLimitsPathsDecoding),
+		PathsCollapseSlashes:     v.GetBool(KeyDynLimitsPathsCollapseSlashes),
+		PathsDotSegments:         v.GetBool(KeyDynLimitsPathsDotSegments),
+		PathsTrailingSlash:       v.GetString(KeyDynLimitsPathsTrailingSlash),
+		PathsCaseInsensitive:     v.GetBool(KeyDynLimitsPathsCaseInsensitive),
+		AdaptiveEnabled:          v.GetBool(KeyDynLimitsAdaptiveEnabled),
+		AdaptiveIntervalMs:       int64(v.GetInt(KeyDynLimitsAdaptiveIntervalMs)),
+		AdaptiveMaxErrorRate:     v.GetFloat64(KeyDynLimitsAdaptiveMaxErrorRate),
+		AdaptiveMaxLatencyMs:     int64(v.GetInt(KeyDynLimitsAdaptiveMaxLatencyMs)),
+		AdaptiveMinRequests:      int64(v.GetInt(KeyDynLimitsAdaptiveMinRequests)),
+		AdaptiveDecrease:         v.GetFloat64(KeyDynLimitsAdaptiveDecrease),
+		AdaptiveIncrease:         v.GetFloat64(KeyDynLimitsAdaptiveIncrease),
+		AdaptiveMinFactor:        v.GetFloat64(KeyDynLimitsAdaptiveMinFactor),
+		AdaptiveMaxPriority:      v.GetInt(KeyDynLimitsAdaptiveMaxPriority),
 	}
 	return &conf
 }
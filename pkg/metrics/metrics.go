@@ -0,0 +1,34 @@
+package metrics
+
+import (
+	"expvar"
+	"net/http"
+)
+
+// ShadowLimited counts, per endpoint, the requests that would
+// have been rejected if the limits were enforced
+var ShadowLimited = expvar.NewMap("dynlimits_shadow_limited")
+
+// Handler returns an http.Handler that serves all the
+// metrics in JSON format
+func Handler() http.Handler {
+	return expvar.Handler()
+}
+
+// AdaptiveFactor contains, per priority, the factor applied to
+// the limits when the upstream is degraded
+var AdaptiveFactor = expvar.NewMap("dynlimits_adaptive_factor")
+
+// UpstreamHealthy contains, per upstream, 1 if it passes the active
+// health checks, or 0 if it does not
+var UpstreamHealthy = expvar.NewMap("dynlimits_upstream_healthy")
+
+// UnknownUpstreamService counts, per upstream service, the requests
+// that could not be forwarded because the service is not configured
+var UnknownUpstreamService = expvar.NewMap("dynlimits_unknown_upstream_service")
+
+// MirroredRequests counts the requests replayed to the shadow
+// upstream (`sent`), the ones that could not be replayed (`dropped`
+// and `failed`), and the results of comparing the shadow responses
+// with the primary ones (`match` and `mismatch`)
+var MirroredRequests = expvar.NewMap("dynlimits_mirrored_requests")
@@ -0,0 +1,37 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/dhontecillas/dynlimits/pkg/catalog"
+	"github.com/dhontecillas/dynlimits/pkg/proxy"
+)
+
+// requestCost returns how much a request consumes from its
+// limits, according to the endpoint RequestCost definition.
+//
+// The cost header is only read from the requests received from
+// the trusted proxies, and it can raise the cost, but not lower
+// it, so clients can not make their requests cheaper. The bodies
+// of unknown length are charged the fixed cost.
+func requestCost(req *http.Request, rc catalog.RequestCost,
+	trustedProxies []*net.IPNet) int64 {
+	cost := int64(1)
+	if rc.Cost > 0 {
+		cost = rc.Cost
+	}
+	if rc.BodyUnit > 0 && req.ContentLength > 0 {
+		cost = (req.ContentLength + rc.BodyUnit - 1) / rc.BodyUnit
+	}
+	if len(rc.Header) > 0 && proxy.FromTrustedProxy(req, trustedProxies) {
+		if hv := req.Header.Get(rc.Header); len(hv) > 0 {
+			hc, err := strconv.ParseInt(hv, 10, 64)
+			if err == nil && hc > cost {
+				cost = hc
+			}
+		}
+	}
+	return cost
+}
@@ -0,0 +1,66 @@
+package middleware
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dhontecillas/dynlimits/pkg/catalog"
+	"github.com/dhontecillas/dynlimits/pkg/proxy"
+)
+
+func Test_requestCost(t *testing.T) {
+	cases := []struct {
+		name   string
+		rc     catalog.RequestCost
+		header string
+		body   string
+		want   int64
+	}{
+		{"default", catalog.RequestCost{}, "", "", 1},
+		{"fixed", catalog.RequestCost{Cost: 5}, "", "", 5},
+		{"header", catalog.RequestCost{Cost: 5, Header: "X-Cost"}, "12", "", 12},
+		{"lower header", catalog.RequestCost{Cost: 5, Header: "X-Cost"}, "2", "", 5},
+		{"bad header", catalog.RequestCost{Cost: 5, Header: "X-Cost"}, "foo", "", 5},
+		{"negative header", catalog.RequestCost{Header: "X-Cost"}, "-3", "", 1},
+		{"body", catalog.RequestCost{Cost: 2, BodyUnit: 10}, "", "0123456789a", 2},
+		{"body exact", catalog.RequestCost{BodyUnit: 10}, "", "0123456789", 1},
+		{"empty body", catalog.RequestCost{Cost: 3, BodyUnit: 10}, "", "", 3},
+		{"header over body", catalog.RequestCost{Cost: 1, Header: "X-Cost", BodyUnit: 10},
+			"4", "0123456789a", 4},
+	}
+
+	// the requests come from httptest's 192.0.2.1
+	trusted, _ := proxy.ParseTrustedProxies("192.0.2.0/24")
+	for _, c := range cases {
+		req := httptest.NewRequest("POST", "/items", strings.NewReader(c.body))
+		if len(c.header) > 0 {
+			req.Header.Set("X-Cost", c.header)
+		}
+		if got := requestCost(req, c.rc, trusted); got != c.want {
+			t.Errorf("%s: want cost %d, got %d", c.name, c.want, got)
+		}
+	}
+}
+
+func Test_requestCostUntrustedHeader(t *testing.T) {
+	rc := catalog.RequestCost{Cost: 5, Header: "X-Cost"}
+	trusted, _ := proxy.ParseTrustedProxies("10.0.0.0/8")
+	req := httptest.NewRequest("POST", "/items", nil)
+	req.Header.Set("X-Cost", "100")
+	if got := requestCost(req, rc, trusted); got != 5 {
+		t.Errorf("want the cost header ignored from a client, got %d", got)
+	}
+	if got := requestCost(req, rc, nil); got != 5 {
+		t.Errorf("want the cost header ignored without trusted proxies, got %d", got)
+	}
+}
+
+func Test_requestCostUnknownBodyLength(t *testing.T) {
+	rc := catalog.RequestCost{Cost: 50, BodyUnit: 10}
+	req := httptest.NewRequest("POST", "/items", strings.NewReader("0123456789a"))
+	req.ContentLength = -1
+	if got := requestCost(req, rc, nil); got != 50 {
+		t.Errorf("want the fixed cost for an unknown body length, got %d", got)
+	}
+}
@@ -0,0 +1,107 @@
+package middleware
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/dhontecillas/dynlimits/pkg/ratelimit"
+)
+
+// delayQueue keeps the count of the requests that are being
+// held waiting for room in their window, to bound them per
+// limits key and for the whole proxy.
+type delayQueue struct {
+	access    sync.Mutex
+	maxPerKey int
+	maxTotal  int
+	perKey    map[string]int
+	total     int
+}
+
+func newDelayQueue(maxPerKey int, maxTotal int) *delayQueue {
+	return &delayQueue{
+		maxPerKey: maxPerKey,
+		maxTotal:  maxTotal,
+		perKey:    make(map[string]int),
+	}
+}
+
+// enter returns false if there is no room in the queue
+// for another request with the given key
+func (dq *delayQueue) enter(key string) bool {
+	dq.access.Lock()
+	defer dq.access.Unlock()
+	if dq.total >= dq.maxTotal || dq.perKey[key] >= dq.maxPerKey {
+		return false
+	}
+	dq.perKey[key]++
+	dq.total++
+	return true
+}
+
+func (dq *delayQueue) leave(key string) {
+	dq.access.Lock()
+	defer dq.access.Unlock()
+	dq.perKey[key]--
+	if dq.perKey[key] <= 0 {
+		delete(dq.perKey, key)
+	}
+	dq.total--
+}
+
+// waitForCapacity holds the request until there is room in the windows
+// for it, as long as it happens before the request max delay, and
+// there is room in the delay queue. It returns the last fetched windows
+// and their timestamp, that can still be full if the request could not
+// be held long enough.
+//
+// An error is returned if the request is cancelled while waiting, or
+// the window cannot be fetched.
+func (rlm *RateLimitMiddleware) waitForCapacity(req *http.Request, lr *limitedRequest,
+	wnds []*ratelimit.SlidingCountersWindow, now int64) ([]*ratelimit.SlidingCountersWindow,
+	int64, error) {
+
+	if !rlm.delays.enter(lr.key) {
+		return wnds, now, nil
+	}
+	defer rlm.delays.leave(lr.key)
+
+	deadline := time.Now().Add(lr.maxDelay)
+	for len(lr.exceededReason(wnds)) > 0 {
+		secs := 0
+		for _, wnd := range wnds {
+			wndSecs := wnd.SecondsUntilCapacity(lr.cost)
+			if wndSecs < 0 {
+				return wnds, now, nil
+			}
+			if wndSecs > secs {
+				secs = wndSecs
+			}
+		}
+		wakeUp := time.Unix(now+int64(secs), 0)
+		if wakeUp.After(deadline) {
+			return wnds, now, nil
+		}
+
+		timer := time.NewTimer(time.Until(wakeUp))
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, now, req.Context().Err()
+		case <-timer.C:
+		}
+
+		// someone else could have taken the room, so we need
+		// to check the window again
+		now = time.Now().Unix()
+		var err error
+		conn := rlm.redisPool.Get()
+		wnds, err = rlm.getWindows(conn, lr, now)
+		conn.Close()
+		if err != nil {
+			return nil, now, err
+		}
+	}
+	return wnds, now, nil
+}
@@ -0,0 +1,65 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// gRPC status codes used to reject the gRPC requests (see
+// https://github.com/grpc/grpc/blob/master/doc/statuscodes.md)
+const (
+	grpcStatusResourceExhausted int = 8
+	grpcStatusUnimplemented     int = 12
+	grpcStatusUnauthenticated   int = 16
+	grpcStatusUnknown           int = 2
+)
+
+// IsGRPCRequest returns true for the gRPC requests, whose endpoint
+// is their `/package.Service/Method` path. The gRPC-Web requests
+// are not included, as they do not use HTTP trailers.
+func IsGRPCRequest(req *http.Request) bool {
+	ct := req.Header.Get("Content-Type")
+	if !strings.HasPrefix(ct, "application/grpc") {
+		return false
+	}
+	rest := ct[len("application/grpc"):]
+	return len(rest) == 0 || rest[0] == '+' || rest[0] == ';'
+}
+
+// writeRejection answers a request that is not forwarded with the
+// status. The gRPC clients can not parse those responses, so the gRPC
+// requests are answered with a 200 and the gRPC status (like
+// RESOURCE_EXHAUSTED for the limited ones) in the trailers.
+func writeRejection(rw http.ResponseWriter, req *http.Request, status int) {
+	if !IsGRPCRequest(req) {
+		rw.WriteHeader(status)
+		return
+	}
+	code, msg := grpcRejectionStatus(status, rw.Header().Get(LimitReasonHeader))
+	header := rw.Header()
+	header.Set("Content-Type", "application/grpc")
+	header.Set("Trailer", "Grpc-Status, Grpc-Message")
+	rw.WriteHeader(http.StatusOK)
+	header.Set("Grpc-Status", strconv.Itoa(code))
+	// the messages only have printable ascii chars, so they do not
+	// need to be percent encoded
+	header.Set("Grpc-Message", msg)
+}
+
+// grpcRejectionStatus returns the gRPC status code and message for
+// a rejection status
+func grpcRejectionStatus(status int, reason string) (int, string) {
+	switch status {
+	case http.StatusTooManyRequests:
+		if len(reason) == 0 {
+			reason = LimitReasonRate
+		}
+		return grpcStatusResourceExhausted, "limit exceeded: " + reason
+	case http.StatusNotFound:
+		return grpcStatusUnimplemented, "unknown method"
+	case http.StatusBadRequest:
+		return grpcStatusUnauthenticated, "missing api key"
+	}
+	return grpcStatusUnknown, http.StatusText(status)
+}
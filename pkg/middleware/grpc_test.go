@@ -0,0 +1,99 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dhontecillas/dynlimits/pkg/pathmatcher"
+	"github.com/dhontecillas/dynlimits/pkg/ratelimit"
+)
+
+const testGRPCMethod string = "/helloworld.Greeter/SayHello"
+
+func doTestGRPCRequest(h http.Handler, apiKey, path string) *http.Response {
+	req := httptest.NewRequest("POST", path, strings.NewReader("\x00\x00\x00\x00\x00"))
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+	if len(apiKey) > 0 {
+		req.Header.Set("X-Api-Key", apiKey)
+	}
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+	return rw.Result()
+}
+
+func Test_RateLimitMiddlewareGRPC(t *testing.T) {
+	fr := newFakeRedis()
+	rlm, next := newTestMiddleware(fr, 1)
+	pm := pathmatcher.NewPathMatcher()
+	pm.AddRoute("POST", testGRPCMethod)
+	pm.Build()
+	rlm.matcher = pm
+	conn := fr.pool().Get()
+	ratelimit.SetRedisRateLimit(conn, testAPIKey+"_POST_"+testGRPCMethod, 1)
+	conn.Close()
+
+	res := doTestGRPCRequest(rlm, testAPIKey, testGRPCMethod)
+	if res.StatusCode != http.StatusOK || len(res.Trailer.Get("Grpc-Status")) > 0 {
+		t.Errorf("want forwarded request, got %d %v", res.StatusCode, res.Trailer)
+	}
+
+	cases := []struct {
+		name       string
+		apiKey     string
+		path       string
+		wantStatus string
+	}{
+		{"limited", testAPIKey, testGRPCMethod, "8"},
+		{"unknown method", testAPIKey, "/helloworld.Greeter/SayBye", "12"},
+		{"missing api key", "", testGRPCMethod, "16"},
+	}
+	for _, c := range cases {
+		res := doTestGRPCRequest(rlm, c.apiKey, c.path)
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("%s: want status 200, got %d", c.name, res.StatusCode)
+		}
+		if ct := res.Header.Get("Content-Type"); ct != "application/grpc" {
+			t.Errorf("%s: want gRPC content type, got %q", c.name, ct)
+		}
+		if len(res.Header.Get("Grpc-Status")) > 0 {
+			t.Errorf("%s: want gRPC status in trailers, not in headers", c.name)
+		}
+		if got := res.Trailer.Get("Grpc-Status"); got != c.wantStatus {
+			t.Errorf("%s: want gRPC status %s, got %q", c.name, c.wantStatus, got)
+		}
+		if len(res.Trailer.Get("Grpc-Message")) == 0 {
+			t.Errorf("%s: want gRPC message", c.name)
+		}
+	}
+	if next.calls != 1 {
+		t.Errorf("want 1 request forwarded, got %d", next.calls)
+	}
+
+	// the requests that are not gRPC keep the HTTP status
+	rw := doTestRequest(rlm, "POST", testGRPCMethod)
+	if rw.Code != http.StatusTooManyRequests {
+		t.Errorf("want status 429, got %d", rw.Code)
+	}
+}
+
+func Test_IsGRPCRequest(t *testing.T) {
+	cases := map[string]bool{
+		"application/grpc":                true,
+		"application/grpc+proto":          true,
+		"application/grpc;charset=utf-8":  true,
+		"application/grpc-web":            false,
+		"application/grpc-web-text+proto": false,
+		"application/json":                false,
+		"":                                false,
+	}
+	for ct, want := range cases {
+		req := httptest.NewRequest("POST", testGRPCMethod, nil)
+		req.Header.Set("Content-Type", ct)
+		if got := IsGRPCRequest(req); got != want {
+			t.Errorf("%q: want %t, got %t", ct, want, got)
+		}
+	}
+}
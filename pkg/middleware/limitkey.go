@@ -0,0 +1,43 @@
+package middleware
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/dhontecillas/dynlimits/pkg/catalog"
+	"github.com/dhontecillas/dynlimits/pkg/pathmatcher"
+)
+
+// limitKeySuffix returns the part to append to the limits key of
+// a request with the values selected by the endpoint LimitKeyDef.
+//
+// Each value is escaped and prefixed with its source and name, so
+// values can not be crafted to collide with other combinations.
+// Missing values are kept as empty strings.
+func limitKeySuffix(req *http.Request, params pathmatcher.Params,
+	lk *catalog.LimitKeyDef) string {
+	var sb strings.Builder
+	for _, name := range lk.PathParams {
+		writeLimitKeyValue(&sb, "p", name, params.Get(name))
+	}
+	if len(lk.QueryParams) > 0 {
+		q := req.URL.Query()
+		for _, name := range lk.QueryParams {
+			writeLimitKeyValue(&sb, "q", name, q.Get(name))
+		}
+	}
+	for _, name := range lk.Headers {
+		writeLimitKeyValue(&sb, "h", name, req.Header.Get(name))
+	}
+	return sb.String()
+}
+
+func writeLimitKeyValue(sb *strings.Builder, source, name, value string) {
+	sb.WriteString("|")
+	sb.WriteString(source)
+	sb.WriteString(":")
+	sb.WriteString(name)
+	sb.WriteString("=")
+	sb.WriteString(url.QueryEscape(value))
+}
@@ -0,0 +1,41 @@
+package middleware
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dhontecillas/dynlimits/pkg/catalog"
+	"github.com/dhontecillas/dynlimits/pkg/pathmatcher"
+)
+
+func Test_limitKeySuffix(t *testing.T) {
+	params := pathmatcher.Params{{Name: "id", Value: "42"}}
+	cases := []struct {
+		name string
+		lk   catalog.LimitKeyDef
+		want string
+	}{
+		{"empty", catalog.LimitKeyDef{}, ""},
+		{"path", catalog.LimitKeyDef{PathParams: []string{"id"}}, "|p:id=42"},
+		{"missing path", catalog.LimitKeyDef{PathParams: []string{"foo"}}, "|p:foo="},
+		{"query", catalog.LimitKeyDef{QueryParams: []string{"to"}}, "|q:to=a%7Cb"},
+		{"header", catalog.LimitKeyDef{Headers: []string{"X-Tenant"}}, "|h:X-Tenant=acme"},
+		{
+			"all",
+			catalog.LimitKeyDef{
+				PathParams:  []string{"id"},
+				QueryParams: []string{"to"},
+				Headers:     []string{"X-Tenant"},
+			},
+			"|p:id=42|q:to=a%7Cb|h:X-Tenant=acme",
+		},
+	}
+
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", "/items/42?to=a|b", nil)
+		req.Header.Set("X-Tenant", "acme")
+		if got := limitKeySuffix(req, params, &c.lk); got != c.want {
+			t.Errorf("%s: want suffix %q, got %q", c.name, c.want, got)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package middleware
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+
+	"github.com/dhontecillas/dynlimits/pkg/metrics"
+	"github.com/dhontecillas/dynlimits/pkg/ratelimit"
+)
+
+// UpgradedMessagesRedisKey is the endpoint part of the limits key
+// used to count, for each api key, the messages sent in upgraded
+// (WebSocket) connections
+const UpgradedMessagesRedisKey string = "MESSAGES"
+
+// messageLimiter checks the messages sent by the client of an
+// upgraded connection against a sliding window per api key, shared
+// by all its connections.
+type messageLimiter struct {
+	redisPool *redis.Pool
+	apiKey    string
+	key       string
+	msgPerMin int64
+	shadow    bool
+}
+
+func newMessageLimiter(redisPool *redis.Pool, lr *limitedRequest,
+	msgPerMin int64) *messageLimiter {
+	return &messageLimiter{
+		redisPool: redisPool,
+		apiKey:    lr.apiKey,
+		key:       fmt.Sprintf("%s_%s", lr.apiKey, UpgradedMessagesRedisKey),
+		msgPerMin: msgPerMin,
+		shadow:    lr.shadow,
+	}
+}
+
+// AllowMessage counts the message if there is room for it in
+// the window. As with the requests, if the window can not be
+// fetched, the message is allowed.
+func (ml *messageLimiter) AllowMessage() bool {
+	conn := ml.redisPool.Get()
+	if conn == nil {
+		return true
+	}
+	defer conn.Close()
+	now := time.Now().Unix()
+	wnd, err := ratelimit.GetRedisSlidingCountersWindowWithLimit(conn,
+		ml.key, now, ml.msgPerMin)
+	if err != nil {
+		return true
+	}
+	if wnd.Sum+1 > wnd.ReqPerMin {
+		if !ml.shadow {
+			return false
+		}
+		// TODO: change this for a log
+		fmt.Printf("shadow limited (messages): api key %s\n", ml.apiKey)
+		metrics.ShadowLimited.Add(UpgradedMessagesRedisKey, 1)
+		return true
+	}
+	if err := ratelimit.AddToRedisSlidingCountersWindow(conn, ml.key,
+		now, 1); err != nil {
+		// TODO: change this for a log
+		fmt.Printf("cannot count message: api key %s: %s\n",
+			ml.apiKey, err.Error())
+	}
+	return true
+}
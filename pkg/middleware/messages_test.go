@@ -0,0 +1,31 @@
+package middleware
+
+import (
+	"testing"
+)
+
+func Test_MessageLimiter(t *testing.T) {
+	fr := newFakeRedis()
+	lr := &limitedRequest{apiKey: "key"}
+	ml := newMessageLimiter(fr.pool(), lr, 3)
+	for idx := 0; idx < 3; idx++ {
+		if !ml.AllowMessage() {
+			t.Fatalf("message %d should be allowed", idx)
+		}
+	}
+	if ml.AllowMessage() {
+		t.Errorf("message over the limit should not be allowed")
+	}
+
+	// the window is shared by all the connections of the api key
+	other := newMessageLimiter(fr.pool(), lr, 3)
+	if other.AllowMessage() {
+		t.Errorf("message over the limit should not be allowed")
+	}
+
+	lr.shadow = true
+	shadow := newMessageLimiter(fr.pool(), lr, 3)
+	if !shadow.AllowMessage() {
+		t.Errorf("message in shadow mode should be allowed")
+	}
+}
@@ -2,30 +2,189 @@ package middleware
 
 import (
 	"fmt"
+	"net"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gomodule/redigo/redis"
 
 	"github.com/dhontecillas/dynlimits/pkg/catalog"
+	"github.com/dhontecillas/dynlimits/pkg/metrics"
 	"github.com/dhontecillas/dynlimits/pkg/pathmatcher"
+	"github.com/dhontecillas/dynlimits/pkg/proxy"
 	"github.com/dhontecillas/dynlimits/pkg/ratelimit"
 )
 
+// UnknownPathsPolicy selects what to do with requests
+// to paths that are not found in the catalog
+type UnknownPathsPolicy int
+
+const (
+	// UnknownPathsReject answers unknown paths with a 404
+	UnknownPathsReject UnknownPathsPolicy = iota
+	// UnknownPathsAllow lets unknown paths pass without limits
+	UnknownPathsAllow
+	// UnknownPathsLimit applies a single catch-all limit per api key
+	// to all the unknown paths
+	UnknownPathsLimit
+)
+
+// UnknownPathsRedisKey is the endpoint part of the limits key used
+// to count the requests to unknown paths for each api key
+const UnknownPathsRedisKey string = "UNKNOWN"
+
+// ShadowLimitedHeader is set, both in the forwarded request and in
+// the response, when a request would have been rejected but the
+// limits are in shadow mode
+const ShadowLimitedHeader string = "X-Dynlimits-Shadow-Limited"
+
+// LimitReasonHeader is set in the response when a request is
+// limited, with the kind of limit that has been reached
+const LimitReasonHeader string = "X-Dynlimits-Limit-Reason"
+
+const (
+	// LimitReasonRate is used when the requests per minute
+	// limit has been reached
+	LimitReasonRate string = "ratelimit"
+	// LimitReasonConcurrency is used when the limit of requests
+	// in flight has been reached
+	LimitReasonConcurrency string = "concurrency"
+	// LimitReasonGlobal is used when the endpoint limit for all
+	// the api keys has been reached
+	LimitReasonGlobal string = "global"
+)
+
+// GlobalLimitsKeyPrefix is used instead of the api key to build
+// the limits key for the endpoints global limits
+const GlobalLimitsKeyPrefix string = "dynlimits-global"
+
+// ParseUnknownPathsPolicy converts a policy name (`reject`, `allow`
+// or `limit`) to its UnknownPathsPolicy value
+func ParseUnknownPathsPolicy(name string) (UnknownPathsPolicy, error) {
+	switch strings.ToLower(name) {
+	case "", "reject":
+		return UnknownPathsReject, nil
+	case "allow":
+		return UnknownPathsAllow, nil
+	case "limit":
+		return UnknownPathsLimit, nil
+	}
+	return UnknownPathsReject, fmt.Errorf("unknown paths policy %q not valid", name)
+}
+
+// LimitScaler provides a factor to scale the limits of the
+// api keys with a given priority
+type LimitScaler interface {
+	Factor(priority int) float64
+}
+
 // RateLimitMiddleware contains the data required
 // to implement per endpoint rate limiting using
 // a catalog of valid api keys.
 //
 // For unknow endpoints we can choose if we let them
-// pass or if we deny the access
+// pass, if we deny the access, or if we apply a
+// catch-all limit (see `SetUnknownPathsPolicy`)
+//
+// In shadow mode the limits are evaluated and counted, but
+// the requests that exceed them are forwarded anyway.
+//
+// When there are refund status rules, the request is counted
+// before forwarding it, and refunded once the response status
+// is known if it matches any of those rules.
+//
+// The gRPC requests are limited by their `/package.Service/Method`
+// path, and rejected with a gRPC status (see IsGRPCRequest).
 type RateLimitMiddleware struct {
-	next              http.Handler
-	apiKeyHeader      string
-	apiKeyCatalog     catalog.APIKeys
-	redisPool         *redis.Pool
-	matcher           pathmatcher.Matcher
-	allowUnknownPaths bool
+	next                  http.Handler
+	apiKeyHeader          string
+	apiKeyCatalog         catalog.APIKeys
+	redisPool             *redis.Pool
+	matcher               pathmatcher.Matcher
+	unknownPathsPolicy    UnknownPathsPolicy
+	unknownPathsReqPerMin int64
+	shadow                bool
+	refundStatus          *StatusRules
+	concurrency           ratelimit.ConcurrencyLimiter
+	delays                *delayQueue
+	scaler                LimitScaler
+	normalizer            *pathmatcher.Normalizer
+	upgradedMsgPerMin     int64
+	trustedProxies        []*net.IPNet
+}
+
+// limitedRequest holds the information required to check
+// the limits for a request
+//
+//   - endpoint: the endpoint part of the limits key
+//   - key: the limits key (api key + endpoint, and the values
+//     selected by the endpoint limit key definition)
+//   - limitKey: when set, the key to read the limit from redis,
+//     instead of the limits key
+//   - reqPerMin: when greater than zero, is used instead of
+//     the limit stored in redis for the key
+//   - shadow: the limits must not be enforced
+//   - cost: how much the request consumes from the limits
+//   - concurrency: max number of requests in flight (0 for no limit)
+//   - maxDelay: how long the request can be held waiting for room
+//     in the window (0 to reject it right away)
+//   - priority: the api key priority
+//   - globalKey: the limits key for the endpoint global limit
+//   - globalReqPerMin: the part of the global limit that can be
+//     used by the request, depending on its priority (0 for no limit)
+type limitedRequest struct {
+	apiKey      string
+	endpoint    string
+	key         string
+	limitKey    string
+	reqPerMin   int64
+	shadow      bool
+	cost        int64
+	concurrency int64
+	maxDelay    time.Duration
+	priority    int
+
+	globalKey       string
+	globalReqPerMin int64
+}
+
+// windowQueries returns the windows to check for the request. The
+// first one is always the api key and endpoint window.
+func (lr *limitedRequest) windowQueries() []ratelimit.WindowQuery {
+	queries := []ratelimit.WindowQuery{
+		{Key: lr.key, LimitKey: lr.limitKey, ReqPerMin: lr.reqPerMin},
+	}
+	if lr.globalReqPerMin > 0 {
+		queries = append(queries, ratelimit.WindowQuery{
+			Key: lr.globalKey, ReqPerMin: lr.globalReqPerMin})
+	}
+	return queries
+}
+
+// windowKeys returns the keys of the windows where the
+// request must be counted
+func (lr *limitedRequest) windowKeys() []string {
+	if lr.globalReqPerMin > 0 {
+		return []string{lr.key, lr.globalKey}
+	}
+	return []string{lr.key}
+}
+
+// exceededReason returns the reason for the request to be limited
+// by any of the windows, or an empty string if there is room for
+// it in all of them.
+func (lr *limitedRequest) exceededReason(wnds []*ratelimit.SlidingCountersWindow) string {
+	for idx, wnd := range wnds {
+		if wnd.Sum+lr.cost > wnd.ReqPerMin {
+			if idx == 0 {
+				return LimitReasonRate
+			}
+			return LimitReasonGlobal
+		}
+	}
+	return ""
 }
 
 // NewRateLimitMiddleware creates a new RateLimitMiddleware
@@ -34,41 +193,195 @@ func NewRateLimitMiddleware(next http.Handler, apiKeyHeader string,
 	matcher pathmatcher.Matcher) *RateLimitMiddleware {
 
 	return &RateLimitMiddleware{
-		next:              next,
-		apiKeyHeader:      apiKeyHeader,
-		apiKeyCatalog:     apiKeyCatalog,
-		redisPool:         redisPool,
-		matcher:           matcher,
-		allowUnknownPaths: false,
+		next:               next,
+		apiKeyHeader:       apiKeyHeader,
+		apiKeyCatalog:      apiKeyCatalog,
+		redisPool:          redisPool,
+		matcher:            matcher,
+		unknownPathsPolicy: UnknownPathsReject,
+		delays:             newDelayQueue(10, 1000),
 	}
 }
 
+// SetUnknownPathsPolicy selects what to do with the requests to
+// paths not found in the catalog. The reqPerMin value is only
+// used with the UnknownPathsLimit policy, and must be positive
+// (the catch-all limit has no value in redis to fall back to).
+// On error, the current policy is kept.
+func (rlm *RateLimitMiddleware) SetUnknownPathsPolicy(policy UnknownPathsPolicy,
+	reqPerMin int64) error {
+	if policy == UnknownPathsLimit && reqPerMin <= 0 {
+		return fmt.Errorf("unknown paths limit must be positive, got %d",
+			reqPerMin)
+	}
+	rlm.unknownPathsPolicy = policy
+	rlm.unknownPathsReqPerMin = reqPerMin
+	return nil
+}
+
+// SetTrustedProxies sets the networks of the proxies in front of
+// this one (see proxy.ParseTrustedProxies). The request cost headers
+// are only read from the requests received from them.
+func (rlm *RateLimitMiddleware) SetTrustedProxies(trustedProxies []*net.IPNet) {
+	rlm.trustedProxies = trustedProxies
+}
+
+// SetShadowMode enables or disables the shadow mode for all
+// the requests. When disabled, the shadow mode can still be enabled
+// per endpoint or per api key in the catalog.
+func (rlm *RateLimitMiddleware) SetShadowMode(shadow bool) {
+	rlm.shadow = shadow
+}
+
+// SetRefundStatusRules sets the response status codes for which
+// a request must not count against the limits. Nil or empty rules
+// disable the refunds.
+func (rlm *RateLimitMiddleware) SetRefundStatusRules(rules *StatusRules) {
+	if rules != nil && rules.Empty() {
+		rules = nil
+	}
+	rlm.refundStatus = rules
+}
+
+// SetConcurrencyLimiter sets the limiter used for the endpoints
+// with a limit of requests in flight. If not set, those limits
+// are not applied.
+func (rlm *RateLimitMiddleware) SetConcurrencyLimiter(cl ratelimit.ConcurrencyLimiter) {
+	rlm.concurrency = cl
+}
+
+// SetDelayQueueLimits sets how many requests over the limits can be
+// held at the same time waiting for room in their window, for each
+// api key and endpoint, and for the whole middleware.
+func (rlm *RateLimitMiddleware) SetDelayQueueLimits(maxPerKey int, maxTotal int) {
+	rlm.delays = newDelayQueue(maxPerKey, maxTotal)
+}
+
+// SetLimitScaler sets a scaler to dynamically adjust the api key
+// limits depending on their priority.
+func (rlm *RateLimitMiddleware) SetLimitScaler(scaler LimitScaler) {
+	rlm.scaler = scaler
+}
+
+// SetPathNormalizer sets the normalizer applied to the request
+// paths before matching them. The request forwarded to the next
+// handler has the normalized path in its URL (see
+// pathmatcher.Normalizer), and both paths available with
+// pathmatcher.GetRequestPaths.
+func (rlm *RateLimitMiddleware) SetPathNormalizer(normalizer *pathmatcher.Normalizer) {
+	rlm.normalizer = normalizer
+}
+
+// SetUpgradedMessagesLimit sets the max number of messages per minute
+// that each api key can send in its upgraded (WebSocket) connections.
+// The connections themselves are limited as any other request when
+// they are established. Zero disables the messages limit.
+func (rlm *RateLimitMiddleware) SetUpgradedMessagesLimit(msgPerMin int64) {
+	rlm.upgradedMsgPerMin = msgPerMin
+}
+
 // ServeHTTP
 // https://tools.ietf.org/id/draft-polli-ratelimit-headers-00.html
 func (rlm *RateLimitMiddleware) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	apiKey, ok := req.Header[rlm.apiKeyHeader]
 	if !ok || len(apiKey) == 0 || len(apiKey[0]) == 0 {
 		// no key, no request :)
-		rw.WriteHeader(http.StatusBadRequest)
+		writeRejection(rw, req, http.StatusBadRequest)
 		return
 	}
 	ak := apiKey[0]
-	now := time.Now().Unix()
 
 	// TODO: check locally the existence of the API key
 
-	pm := rlm.matcher.LookupRoute(req.Method, req.URL.Path)
+	if rlm.normalizer != nil {
+		req = rlm.normalizer.Normalize(req)
+	}
+	pm, params := rlm.matcher.LookupRequest(req)
 	if pm == nil {
-		if rlm.allowUnknownPaths {
+		switch rlm.unknownPathsPolicy {
+		case UnknownPathsAllow:
 			rlm.next.ServeHTTP(rw, req)
+		case UnknownPathsLimit:
+			limits := rlm.apiKeyCatalog.GetLimits(ak, req.Method,
+				UnknownPathsRedisKey)
+			rlm.serveLimited(rw, req, &limitedRequest{
+				apiKey:    ak,
+				endpoint:  UnknownPathsRedisKey,
+				key:       fmt.Sprintf("%s_%s", ak, UnknownPathsRedisKey),
+				reqPerMin: rlm.unknownPathsReqPerMin,
+				shadow:    rlm.shadow || limits.Shadow,
+				cost:      requestCost(req, limits.Cost, rlm.trustedProxies),
+				priority:  limits.Priority,
+			})
+		default:
+			writeRejection(rw, req, http.StatusNotFound)
+		}
+		return
+	}
+
+	// the proxy routes the request with the route it matched
+	req = pathmatcher.WithRouteMatch(req, pm, params)
+	limits := rlm.apiKeyCatalog.GetLimits(ak, pm.Method, pm.Endpoint)
+	lr := &limitedRequest{
+		apiKey:      ak,
+		endpoint:    pm.RedisKey,
+		key:         fmt.Sprintf("%s_%s", ak, pm.RedisKey),
+		shadow:      rlm.shadow || limits.Shadow,
+		cost:        requestCost(req, limits.Cost, rlm.trustedProxies),
+		concurrency: limits.Concurrency,
+		maxDelay:    limits.MaxDelay,
+		priority:    limits.Priority,
+	}
+	if limits.LimitKey != nil {
+		// all the values combinations share the endpoint limit
+		lr.limitKey = lr.key
+		lr.key += limitKeySuffix(req, params, limits.LimitKey)
+	}
+	if limits.GlobalRateLimit > 0 {
+		shedAt := limits.GlobalShedAtPercent
+		if shedAt <= 0 || shedAt > 100 {
+			shedAt = 100
+		}
+		lr.globalKey = fmt.Sprintf("%s_%s", GlobalLimitsKeyPrefix, pm.RedisKey)
+		lr.globalReqPerMin = limits.GlobalRateLimit * shedAt / 100
+		if lr.globalReqPerMin <= 0 {
+			lr.globalReqPerMin = 1
+		}
+	}
+	rlm.serveLimited(rw, req, lr)
+}
+
+// serveLimited checks the requests in flight and the sliding window
+// for the limits key, and forwards the request to the next handler
+// if there is room for it (or if the limits are in shadow mode).
+func (rlm *RateLimitMiddleware) serveLimited(rw http.ResponseWriter,
+	req *http.Request, lr *limitedRequest) {
+	now := time.Now().Unix()
+
+	if rlm.upgradedMsgPerMin > 0 && proxy.IsUpgradeRequest(req) {
+		req = proxy.WithMessageLimiter(req,
+			newMessageLimiter(rlm.redisPool, lr, rlm.upgradedMsgPerMin))
+	}
+
+	if lr.concurrency > 0 && rlm.concurrency != nil {
+		release, acquired, err := rlm.concurrency.Acquire(lr.key, lr.concurrency)
+		if err != nil {
+			// as with the errors fetching the window, we let the
+			// request pass
+			// TODO: change this for a log
+			fmt.Printf("cannot acquire concurrency slot: %s\n", err.Error())
+		} else if acquired {
+			// the slot is released once the response is completed
+			defer release()
+		} else if lr.shadow {
+			rlm.markShadowLimited(rw, req, lr, LimitReasonConcurrency)
 		} else {
-			rw.WriteHeader(http.StatusNotFound)
+			rw.Header().Set(LimitReasonHeader, LimitReasonConcurrency)
+			writeRejection(rw, req, http.StatusTooManyRequests)
 			return
 		}
 	}
 
-	key := fmt.Sprintf("%s_%s", ak, pm.RedisKey)
-
 	conn := rlm.redisPool.Get()
 	if conn == nil {
 		// TODO: review what to do here, and if we want to put a flag
@@ -82,9 +395,20 @@ func (rlm *RateLimitMiddleware) ServeHTTP(rw http.ResponseWriter, req *http.Requ
 	// we want to close the connection as soon as possible, so we do not
 	// rely on defer. It is here only for safety, if more code is added,
 	// try to close the connection as soon as possible
-	defer conn.Close()
+	defer func() { conn.Close() }()
 	//
-	wnd, err := ratelimit.GetRedisSlidingCountersWindow(conn, key, now)
+	wnds, err := rlm.getWindows(conn, lr, now)
+	if err == nil && len(lr.exceededReason(wnds)) > 0 && !lr.shadow &&
+		lr.maxDelay > 0 {
+		// we do not keep the connection while waiting
+		conn.Close()
+		wnds, now, err = rlm.waitForCapacity(req, lr, wnds, now)
+		if req.Context().Err() != nil {
+			// the client is gone
+			return
+		}
+		conn = rlm.redisPool.Get()
+	}
 	if err != nil {
 		// TODO: review what to do here, and if we want to put a flag
 		// to select behaviour
@@ -94,19 +418,87 @@ func (rlm *RateLimitMiddleware) ServeHTTP(rw http.ResponseWriter, req *http.Requ
 		return
 	}
 
+	wnd := wnds[0]
 	header := rw.Header()
 	header.Add("RateLimit-Limit", strconv.FormatInt(wnd.ReqPerMin, 10))
 	header.Add("RateLimit-Reset", strconv.Itoa(wnd.NumEmptySlotsAtStart()))
-	if wnd.Sum >= wnd.ReqPerMin {
+	if reason := lr.exceededReason(wnds); len(reason) > 0 {
 		// TODO: here we can save and optimize later to not have to
 		// go to redis on the next request
 		conn.Close()
 		header.Add("RateLimit-Remaining", "0")
-		rw.WriteHeader(http.StatusTooManyRequests)
+		if lr.shadow {
+			// the request is not counted, as it would not have
+			// been counted if the limits were enforced
+			rlm.markShadowLimited(rw, req, lr, reason)
+			rlm.next.ServeHTTP(rw, req)
+			return
+		}
+		header.Set(LimitReasonHeader, reason)
+		writeRejection(rw, req, http.StatusTooManyRequests)
 		return
 	}
-	header.Add("RateLimit-Remaining", strconv.FormatInt(wnd.ReqPerMin-wnd.Sum-1, 10))
-	err = ratelimit.AddToRedisSlidingCountersWindow(conn, key, now)
+	header.Add("RateLimit-Remaining", strconv.FormatInt(wnd.ReqPerMin-wnd.Sum-lr.cost, 10))
+	err = ratelimit.AddToRedisSlidingCountersWindows(conn, lr.windowKeys(),
+		now, lr.cost)
 	conn.Close()
-	rlm.next.ServeHTTP(rw, req)
+	if err != nil || rlm.refundStatus == nil {
+		rlm.next.ServeHTTP(rw, req)
+		return
+	}
+
+	srw := proxy.NewStatusResponseWriter(rw)
+	rlm.next.ServeHTTP(srw, req)
+	if rlm.refundStatus.Match(srw.Status()) {
+		rlm.refund(lr, now)
+	}
+}
+
+// getWindows fetches the sliding windows to check for the request
+func (rlm *RateLimitMiddleware) getWindows(conn redis.Conn, lr *limitedRequest,
+	now int64) ([]*ratelimit.SlidingCountersWindow, error) {
+	wnds, err := ratelimit.GetRedisSlidingCountersWindows(conn, now,
+		lr.windowQueries()...)
+	if err != nil || rlm.scaler == nil {
+		return wnds, err
+	}
+	// only the api key limit is scaled
+	if f := rlm.scaler.Factor(lr.priority); f < 1.0 {
+		scaled := int64(float64(wnds[0].ReqPerMin) * f)
+		if scaled < 1 {
+			scaled = 1
+		}
+		wnds[0].ReqPerMin = scaled
+	}
+	return wnds, nil
+}
+
+// refund gives back the cost of a request that was counted
+// in the window at the timestampSec second.
+func (rlm *RateLimitMiddleware) refund(lr *limitedRequest, timestampSec int64) {
+	conn := rlm.redisPool.Get()
+	if conn == nil {
+		return
+	}
+	defer conn.Close()
+	err := ratelimit.AddToRedisSlidingCountersWindows(conn, lr.windowKeys(),
+		timestampSec, -lr.cost)
+	if err != nil {
+		// TODO: change this for a log
+		fmt.Printf("cannot refund request: api key %s, endpoint %s: %s\n",
+			lr.apiKey, lr.endpoint, err.Error())
+	}
+}
+
+// markShadowLimited tags a request that would have been
+// rejected, and records that it happened.
+func (rlm *RateLimitMiddleware) markShadowLimited(rw http.ResponseWriter,
+	req *http.Request, lr *limitedRequest, reason string) {
+	// TODO: change this for a log
+	fmt.Printf("shadow limited (%s): api key %s, endpoint %s\n",
+		reason, lr.apiKey, lr.endpoint)
+	metrics.ShadowLimited.Add(lr.endpoint, 1)
+
+	req.Header.Set(ShadowLimitedHeader, "true")
+	rw.Header().Set(ShadowLimitedHeader, "true")
 }
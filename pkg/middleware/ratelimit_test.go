@@ -0,0 +1,782 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dhontecillas/dynlimits/pkg/catalog"
+	"github.com/dhontecillas/dynlimits/pkg/pathmatcher"
+	"github.com/dhontecillas/dynlimits/pkg/proxy"
+	"github.com/dhontecillas/dynlimits/pkg/ratelimit"
+)
+
+const testAPIKey string = "TESTKEY"
+
+// countingHandler counts the requests that reach the proxied handler
+type countingHandler struct {
+	calls int
+}
+
+func (ch *countingHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	ch.calls++
+	rw.WriteHeader(http.StatusOK)
+}
+
+// newTestMiddleware creates a middleware with a single known
+// endpoint (`GET /items/{id}`) limited to reqPerMin for the
+// testAPIKey
+func newTestMiddleware(fr *fakeRedis, reqPerMin int64) (*RateLimitMiddleware,
+	*countingHandler) {
+
+	pm := pathmatcher.NewPathMatcher()
+	pm.AddRoute("GET", "/items/{id}")
+	pm.Build()
+
+	conn := fr.pool().Get()
+	defer conn.Close()
+	ratelimit.SetRedisRateLimit(conn, testAPIKey+"_GET_/items/{id}", reqPerMin)
+
+	next := &countingHandler{}
+	rlm := NewRateLimitMiddleware(next, "X-Api-Key",
+		catalog.NewDefaultAPIKeys(), fr.pool(), pm)
+	return rlm, next
+}
+
+func doTestRequest(h http.Handler, method, path string) *httptest.ResponseRecorder {
+	return doTestRequestWithKey(h, testAPIKey, method, path)
+}
+
+func doTestRequestWithKey(h http.Handler, apiKey, method,
+	path string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	req.Header.Set("X-Api-Key", apiKey)
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+	return rw
+}
+
+func Test_RateLimitMiddlewareKnownPath(t *testing.T) {
+	rlm, next := newTestMiddleware(newFakeRedis(), 2)
+
+	for i := 0; i < 2; i++ {
+		rw := doTestRequest(rlm, "GET", "/items/1")
+		if rw.Code != http.StatusOK {
+			t.Errorf("req %d: want status 200, got %d", i, rw.Code)
+			return
+		}
+	}
+	rw := doTestRequest(rlm, "GET", "/items/2")
+	if rw.Code != http.StatusTooManyRequests {
+		t.Errorf("want status 429, got %d", rw.Code)
+		return
+	}
+	if next.calls != 2 {
+		t.Errorf("want 2 calls to next, got %d", next.calls)
+	}
+}
+
+func Test_RateLimitMiddlewareMissingAPIKey(t *testing.T) {
+	rlm, next := newTestMiddleware(newFakeRedis(), 2)
+
+	req := httptest.NewRequest("GET", "/items/1", nil)
+	rw := httptest.NewRecorder()
+	rlm.ServeHTTP(rw, req)
+	if rw.Code != http.StatusBadRequest {
+		t.Errorf("want status 400, got %d", rw.Code)
+	}
+	if next.calls != 0 {
+		t.Errorf("want 0 calls to next, got %d", next.calls)
+	}
+}
+
+func Test_RateLimitMiddlewareUnknownPathsReject(t *testing.T) {
+	rlm, next := newTestMiddleware(newFakeRedis(), 2)
+
+	rw := doTestRequest(rlm, "GET", "/unknown")
+	if rw.Code != http.StatusNotFound {
+		t.Errorf("want status 404, got %d", rw.Code)
+	}
+	if next.calls != 0 {
+		t.Errorf("want 0 calls to next, got %d", next.calls)
+	}
+}
+
+func Test_RateLimitMiddlewareUnknownPathsAllow(t *testing.T) {
+	rlm, next := newTestMiddleware(newFakeRedis(), 2)
+	rlm.SetUnknownPathsPolicy(UnknownPathsAllow, 0)
+
+	for i := 0; i < 5; i++ {
+		rw := doTestRequest(rlm, "POST", "/unknown")
+		if rw.Code != http.StatusOK {
+			t.Errorf("req %d: want status 200, got %d", i, rw.Code)
+			return
+		}
+		if len(rw.Header().Get("RateLimit-Limit")) != 0 {
+			t.Errorf("unexpected RateLimit-Limit header for unknown path")
+			return
+		}
+	}
+	if next.calls != 5 {
+		t.Errorf("want 5 calls to next, got %d", next.calls)
+	}
+
+	// known paths are still limited
+	for i := 0; i < 3; i++ {
+		doTestRequest(rlm, "GET", "/items/1")
+	}
+	if next.calls != 7 {
+		t.Errorf("want 7 calls to next, got %d", next.calls)
+	}
+}
+
+func Test_RateLimitMiddlewareUnknownPathsLimit(t *testing.T) {
+	rlm, next := newTestMiddleware(newFakeRedis(), 10)
+	rlm.SetUnknownPathsPolicy(UnknownPathsLimit, 3)
+
+	// all unknown paths share the same catch-all limit
+	paths := []string{"/unknown", "/other", "/items", "/unknown"}
+	for i, p := range paths[:3] {
+		rw := doTestRequest(rlm, "GET", p)
+		if rw.Code != http.StatusOK {
+			t.Errorf("req %d: want status 200, got %d", i, rw.Code)
+			return
+		}
+		if rw.Header().Get("RateLimit-Limit") != "3" {
+			t.Errorf("want RateLimit-Limit 3, got %s",
+				rw.Header().Get("RateLimit-Limit"))
+			return
+		}
+	}
+	rw := doTestRequest(rlm, "DELETE", paths[3])
+	if rw.Code != http.StatusTooManyRequests {
+		t.Errorf("want status 429, got %d", rw.Code)
+		return
+	}
+	if next.calls != 3 {
+		t.Errorf("want 3 calls to next, got %d", next.calls)
+		return
+	}
+
+	// the catch-all limit does not consume the known path limits
+	rw = doTestRequest(rlm, "GET", "/items/1")
+	if rw.Code != http.StatusOK {
+		t.Errorf("want status 200, got %d", rw.Code)
+	}
+}
+
+func Test_RateLimitMiddlewareUnknownPathsLimitNotPositive(t *testing.T) {
+	rlm, next := newTestMiddleware(newFakeRedis(), 10)
+	for _, reqPerMin := range []int64{0, -1} {
+		if err := rlm.SetUnknownPathsPolicy(UnknownPathsLimit, reqPerMin); err == nil {
+			t.Errorf("want error for unknown paths limit %d", reqPerMin)
+		}
+	}
+
+	// the previous policy is kept, instead of letting the unknown
+	// paths pass without limits
+	rw := doTestRequest(rlm, "GET", "/unknown")
+	if rw.Code != http.StatusNotFound {
+		t.Errorf("want status 404, got %d", rw.Code)
+	}
+	if next.calls != 0 {
+		t.Errorf("want 0 calls to next, got %d", next.calls)
+	}
+}
+
+func Test_ParseUnknownPathsPolicy(t *testing.T) {
+	valid := map[string]UnknownPathsPolicy{
+		"":       UnknownPathsReject,
+		"reject": UnknownPathsReject,
+		"ALLOW":  UnknownPathsAllow,
+		"limit":  UnknownPathsLimit,
+	}
+	for name, want := range valid {
+		got, err := ParseUnknownPathsPolicy(name)
+		if err != nil || got != want {
+			t.Errorf("%q: want %d, got %d (%v)", name, want, got, err)
+		}
+	}
+	if _, err := ParseUnknownPathsPolicy("foo"); err == nil {
+		t.Errorf("want error for invalid policy")
+	}
+}
+
+// shadowCheckHandler records if the forwarded requests were
+// tagged as shadow limited
+type shadowCheckHandler struct {
+	tagged int
+}
+
+func (sh *shadowCheckHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Header.Get(ShadowLimitedHeader) == "true" {
+		sh.tagged++
+	}
+	rw.WriteHeader(http.StatusOK)
+}
+
+func Test_RateLimitMiddlewareShadowGlobal(t *testing.T) {
+	rlm, _ := newTestMiddleware(newFakeRedis(), 2)
+	next := &shadowCheckHandler{}
+	rlm.next = next
+	rlm.SetShadowMode(true)
+
+	for i := 0; i < 4; i++ {
+		rw := doTestRequest(rlm, "GET", "/items/1")
+		if rw.Code != http.StatusOK {
+			t.Errorf("req %d: want status 200, got %d", i, rw.Code)
+			return
+		}
+		wantTag := ""
+		if i >= 2 {
+			wantTag = "true"
+		}
+		if rw.Header().Get(ShadowLimitedHeader) != wantTag {
+			t.Errorf("req %d: want shadow header %q, got %q", i, wantTag,
+				rw.Header().Get(ShadowLimitedHeader))
+			return
+		}
+	}
+	if next.tagged != 2 {
+		t.Errorf("want 2 tagged requests, got %d", next.tagged)
+	}
+}
+
+func Test_RateLimitMiddlewareShadowFromCatalog(t *testing.T) {
+	rlm, _ := newTestMiddleware(newFakeRedis(), 1)
+	next := &shadowCheckHandler{}
+	rlm.next = next
+
+	apiKeys := catalog.NewIndexedAPIKeys()
+	apiKeys.Update(&catalog.APIIndexedLimits{
+		Methods: []string{"GET"},
+		Paths:   []string{"/items/{id}"},
+		Endpoints: []catalog.EndpointIndexedDef{
+			{PathIdx: 0, MethodIdx: 0},
+		},
+		APILimits: []catalog.APIKeyIndexedLimits{
+			{
+				APIKey: testAPIKey,
+				Limits: []catalog.EndpointIndexedLimits{
+					{EndpointIdx: 0, RateLimit: 1},
+				},
+				Shadow: true,
+			},
+		},
+	})
+	rlm.apiKeyCatalog = apiKeys
+
+	for i := 0; i < 3; i++ {
+		rw := doTestRequest(rlm, "GET", "/items/1")
+		if rw.Code != http.StatusOK {
+			t.Errorf("req %d: want status 200, got %d", i, rw.Code)
+			return
+		}
+	}
+	if next.tagged != 2 {
+		t.Errorf("want 2 tagged requests, got %d", next.tagged)
+		return
+	}
+
+	// with the shadow flag only in the endpoint
+	apiKeys.Update(&catalog.APIIndexedLimits{
+		Methods: []string{"GET"},
+		Paths:   []string{"/items/{id}"},
+		Endpoints: []catalog.EndpointIndexedDef{
+			{PathIdx: 0, MethodIdx: 0, Shadow: true},
+		},
+	})
+	rw := doTestRequest(rlm, "GET", "/items/1")
+	if rw.Code != http.StatusOK || next.tagged != 3 {
+		t.Errorf("want shadow limited request, got %d (%d tagged)",
+			rw.Code, next.tagged)
+		return
+	}
+
+	// and without it, requests are rejected again
+	apiKeys.Update(&catalog.APIIndexedLimits{})
+	rw = doTestRequest(rlm, "GET", "/items/1")
+	if rw.Code != http.StatusTooManyRequests {
+		t.Errorf("want status 429, got %d", rw.Code)
+	}
+}
+
+func Test_RateLimitMiddlewareRequestCost(t *testing.T) {
+	rlm, next := newTestMiddleware(newFakeRedis(), 10)
+
+	apiKeys := catalog.NewIndexedAPIKeys()
+	apiKeys.Update(&catalog.APIIndexedLimits{
+		Methods: []string{"GET"},
+		Paths:   []string{"/items/{id}"},
+		Endpoints: []catalog.EndpointIndexedDef{
+			{PathIdx: 0, MethodIdx: 0,
+				RequestCost: catalog.RequestCost{Cost: 4, Header: "X-Cost"}},
+		},
+	})
+	rlm.apiKeyCatalog = apiKeys
+	// the cost header is only read from the trusted proxies
+	trusted, _ := proxy.ParseTrustedProxies("192.0.2.0/24")
+	rlm.SetTrustedProxies(trusted)
+
+	rw := doTestRequest(rlm, "GET", "/items/1")
+	if rw.Code != http.StatusOK || rw.Header().Get("RateLimit-Remaining") != "6" {
+		t.Errorf("want status 200 with 6 remaining, got %d with %s", rw.Code,
+			rw.Header().Get("RateLimit-Remaining"))
+		return
+	}
+
+	// 4 + 7 exceeds the limit of 10
+	req := httptest.NewRequest("GET", "/items/1", nil)
+	req.Header.Set("X-Api-Key", testAPIKey)
+	req.Header.Set("X-Cost", "7")
+	rw = httptest.NewRecorder()
+	rlm.ServeHTTP(rw, req)
+	if rw.Code != http.StatusTooManyRequests {
+		t.Errorf("want status 429, got %d", rw.Code)
+		return
+	}
+
+	// but 4 + 6 fits exactly
+	req.Header.Set("X-Cost", "6")
+	rw = httptest.NewRecorder()
+	rlm.ServeHTTP(rw, req)
+	if rw.Code != http.StatusOK || rw.Header().Get("RateLimit-Remaining") != "0" {
+		t.Errorf("want status 200 with 0 remaining, got %d with %s", rw.Code,
+			rw.Header().Get("RateLimit-Remaining"))
+		return
+	}
+	if next.calls != 2 {
+		t.Errorf("want 2 calls to next, got %d", next.calls)
+	}
+}
+
+func Test_RateLimitMiddlewareRequestCostUntrusted(t *testing.T) {
+	rlm, _ := newTestMiddleware(newFakeRedis(), 10)
+
+	apiKeys := catalog.NewIndexedAPIKeys()
+	apiKeys.Update(&catalog.APIIndexedLimits{
+		Methods: []string{"GET"},
+		Paths:   []string{"/items/{id}"},
+		Endpoints: []catalog.EndpointIndexedDef{
+			{PathIdx: 0, MethodIdx: 0,
+				RequestCost: catalog.RequestCost{Cost: 4, Header: "X-Cost"}},
+		},
+	})
+	rlm.apiKeyCatalog = apiKeys
+
+	// a client can not lower (nor set) the cost of its requests
+	req := httptest.NewRequest("GET", "/items/1", nil)
+	req.Header.Set("X-Api-Key", testAPIKey)
+	req.Header.Set("X-Cost", "1")
+	rw := httptest.NewRecorder()
+	rlm.ServeHTTP(rw, req)
+	if rw.Code != http.StatusOK || rw.Header().Get("RateLimit-Remaining") != "6" {
+		t.Errorf("want status 200 with 6 remaining, got %d with %s", rw.Code,
+			rw.Header().Get("RateLimit-Remaining"))
+	}
+}
+
+// statusHandler answers with a configurable status code
+type statusHandler struct {
+	status int
+}
+
+func (sh *statusHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	rw.WriteHeader(sh.status)
+}
+
+func Test_RateLimitMiddlewareRefundStatus(t *testing.T) {
+	rlm, _ := newTestMiddleware(newFakeRedis(), 2)
+	next := &statusHandler{status: http.StatusInternalServerError}
+	rlm.next = next
+	rules, _ := ParseStatusRules("5xx")
+	rlm.SetRefundStatusRules(rules)
+
+	// failed requests do not count against the limit
+	for i := 0; i < 5; i++ {
+		rw := doTestRequest(rlm, "GET", "/items/1")
+		if rw.Code != http.StatusInternalServerError {
+			t.Errorf("req %d: want status 500, got %d", i, rw.Code)
+			return
+		}
+	}
+
+	next.status = http.StatusOK
+	for i := 0; i < 2; i++ {
+		rw := doTestRequest(rlm, "GET", "/items/1")
+		if rw.Code != http.StatusOK {
+			t.Errorf("req %d: want status 200, got %d", i, rw.Code)
+			return
+		}
+	}
+	// but we still reject up-front when the window is full
+	rw := doTestRequest(rlm, "GET", "/items/1")
+	if rw.Code != http.StatusTooManyRequests {
+		t.Errorf("want status 429, got %d", rw.Code)
+	}
+}
+
+// blockingHandler keeps the requests in flight until
+// the unblock channel is closed
+type blockingHandler struct {
+	started chan bool
+	unblock chan bool
+}
+
+func (bh *blockingHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	bh.started <- true
+	<-bh.unblock
+	rw.WriteHeader(http.StatusOK)
+}
+
+func Test_RateLimitMiddlewareConcurrency(t *testing.T) {
+	fr := newFakeRedis()
+	rlm, _ := newTestMiddleware(fr, 100)
+	next := &blockingHandler{
+		started: make(chan bool, 2),
+		unblock: make(chan bool),
+	}
+	rlm.next = next
+	rlm.SetConcurrencyLimiter(ratelimit.NewRedisConcurrencyLimiter(fr.pool(),
+		time.Minute))
+
+	apiKeys := catalog.NewIndexedAPIKeys()
+	apiKeys.Update(&catalog.APIIndexedLimits{
+		Methods: []string{"GET"},
+		Paths:   []string{"/items/{id}"},
+		Endpoints: []catalog.EndpointIndexedDef{
+			{PathIdx: 0, MethodIdx: 0},
+		},
+		APILimits: []catalog.APIKeyIndexedLimits{
+			{
+				APIKey: testAPIKey,
+				Limits: []catalog.EndpointIndexedLimits{
+					{EndpointIdx: 0, RateLimit: 100, Concurrency: 2},
+				},
+			},
+		},
+	})
+	rlm.apiKeyCatalog = apiKeys
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			doTestRequest(rlm, "GET", "/items/1")
+		}()
+		<-next.started
+	}
+
+	rw := doTestRequest(rlm, "GET", "/items/1")
+	if rw.Code != http.StatusTooManyRequests {
+		t.Errorf("want status 429, got %d", rw.Code)
+		return
+	}
+	if rw.Header().Get(LimitReasonHeader) != LimitReasonConcurrency {
+		t.Errorf("want reason %s, got %s", LimitReasonConcurrency,
+			rw.Header().Get(LimitReasonHeader))
+		return
+	}
+
+	close(next.unblock)
+	wg.Wait()
+
+	// once completed, the slots are free again
+	go func() { <-next.started }()
+	rw = doTestRequest(rlm, "GET", "/items/1")
+	if rw.Code != http.StatusOK {
+		t.Errorf("want status 200, got %d", rw.Code)
+	}
+}
+
+// newTestAPIKeys creates a catalog with the `GET /items/{id}` endpoint
+// and its limits for the testAPIKey
+func newTestAPIKeys(ep catalog.EndpointIndexedDef,
+	lim catalog.EndpointIndexedLimits) *catalog.IndexedAPIKeys {
+	apiKeys := catalog.NewIndexedAPIKeys()
+	apiKeys.Update(&catalog.APIIndexedLimits{
+		Methods:   []string{"GET"},
+		Paths:     []string{"/items/{id}"},
+		Endpoints: []catalog.EndpointIndexedDef{ep},
+		APILimits: []catalog.APIKeyIndexedLimits{
+			{
+				APIKey: testAPIKey,
+				Limits: []catalog.EndpointIndexedLimits{lim},
+			},
+		},
+	})
+	return apiKeys
+}
+
+// fillTestWindow adds cost to the window of the known endpoint for
+// the testAPIKey, at secsAgo seconds in the past
+func fillTestWindow(fr *fakeRedis, secsAgo int64, cost int64) {
+	conn := fr.pool().Get()
+	defer conn.Close()
+	ratelimit.AddToRedisSlidingCountersWindow(conn, testAPIKey+"_GET_/items/{id}",
+		time.Now().Unix()-secsAgo, cost)
+}
+
+func Test_RateLimitMiddlewareDelay(t *testing.T) {
+	fr := newFakeRedis()
+	rlm, next := newTestMiddleware(fr, 1)
+	rlm.apiKeyCatalog = newTestAPIKeys(
+		catalog.EndpointIndexedDef{PathIdx: 0, MethodIdx: 0, MaxDelayMs: 2000},
+		catalog.EndpointIndexedLimits{EndpointIdx: 0, RateLimit: 1})
+
+	// the window has room again in less than a second
+	fillTestWindow(fr, 59, 1)
+	rw := doTestRequest(rlm, "GET", "/items/1")
+	if rw.Code != http.StatusOK {
+		t.Errorf("want status 200, got %d", rw.Code)
+		return
+	}
+	if next.calls != 1 {
+		t.Errorf("want 1 call to next, got %d", next.calls)
+		return
+	}
+
+	// the window will not have room before the max delay
+	rw = doTestRequest(rlm, "GET", "/items/1")
+	if rw.Code != http.StatusTooManyRequests {
+		t.Errorf("want status 429, got %d", rw.Code)
+	}
+}
+
+func Test_RateLimitMiddlewareDelayCancelled(t *testing.T) {
+	fr := newFakeRedis()
+	rlm, next := newTestMiddleware(fr, 1)
+	rlm.apiKeyCatalog = newTestAPIKeys(
+		catalog.EndpointIndexedDef{PathIdx: 0, MethodIdx: 0, MaxDelayMs: 20000},
+		catalog.EndpointIndexedLimits{EndpointIdx: 0, RateLimit: 1})
+	fillTestWindow(fr, 50, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req := httptest.NewRequest("GET", "/items/1", nil).WithContext(ctx)
+	req.Header.Set("X-Api-Key", testAPIKey)
+	start := time.Now()
+	rlm.ServeHTTP(httptest.NewRecorder(), req)
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("request not cancelled while waiting")
+		return
+	}
+	if next.calls != 0 {
+		t.Errorf("want 0 calls to next, got %d", next.calls)
+	}
+}
+
+func Test_RateLimitMiddlewareDelayQueueFull(t *testing.T) {
+	fr := newFakeRedis()
+	rlm, next := newTestMiddleware(fr, 1)
+	rlm.apiKeyCatalog = newTestAPIKeys(
+		catalog.EndpointIndexedDef{PathIdx: 0, MethodIdx: 0, MaxDelayMs: 20000},
+		catalog.EndpointIndexedLimits{EndpointIdx: 0, RateLimit: 1})
+	rlm.SetDelayQueueLimits(0, 0)
+	fillTestWindow(fr, 50, 1)
+
+	rw := doTestRequest(rlm, "GET", "/items/1")
+	if rw.Code != http.StatusTooManyRequests {
+		t.Errorf("want status 429, got %d", rw.Code)
+	}
+	if next.calls != 0 {
+		t.Errorf("want 0 calls to next, got %d", next.calls)
+	}
+}
+
+func Test_RateLimitMiddlewareGlobalLimitPriorities(t *testing.T) {
+	fr := newFakeRedis()
+	rlm, _ := newTestMiddleware(fr, 10)
+	conn := fr.pool().Get()
+	ratelimit.SetRedisRateLimit(conn, "LOWKEY_GET_/items/{id}", 10)
+	ratelimit.SetRedisRateLimit(conn, "HIGHKEY_GET_/items/{id}", 10)
+	conn.Close()
+
+	apiKeys := catalog.NewIndexedAPIKeys()
+	apiKeys.Update(&catalog.APIIndexedLimits{
+		Methods: []string{"GET"},
+		Paths:   []string{"/items/{id}"},
+		Endpoints: []catalog.EndpointIndexedDef{
+			{PathIdx: 0, MethodIdx: 0, GlobalRateLimit: 4},
+		},
+		APILimits: []catalog.APIKeyIndexedLimits{
+			{
+				APIKey: "LOWKEY",
+				Limits: []catalog.EndpointIndexedLimits{
+					{EndpointIdx: 0, RateLimit: 10},
+				},
+			},
+			{
+				APIKey: "HIGHKEY",
+				Limits: []catalog.EndpointIndexedLimits{
+					{EndpointIdx: 0, RateLimit: 10},
+				},
+				Priority: 1,
+			},
+		},
+		Priorities: []catalog.PriorityIndexedDef{
+			{Priority: 0, ShedAtPercent: 50},
+		},
+	})
+	rlm.apiKeyCatalog = apiKeys
+
+	// low priority requests are shed at 50% of the global limit
+	for i := 0; i < 3; i++ {
+		rw := doTestRequestWithKey(rlm, "LOWKEY", "GET", "/items/1")
+		if i < 2 && rw.Code != http.StatusOK {
+			t.Errorf("low req %d: want status 200, got %d", i, rw.Code)
+			return
+		}
+		if i == 2 && (rw.Code != http.StatusTooManyRequests ||
+			rw.Header().Get(LimitReasonHeader) != LimitReasonGlobal) {
+			t.Errorf("low req %d: want global 429, got %d (%s)", i, rw.Code,
+				rw.Header().Get(LimitReasonHeader))
+			return
+		}
+	}
+
+	// while high priority ones can use all of it
+	for i := 0; i < 3; i++ {
+		rw := doTestRequestWithKey(rlm, "HIGHKEY", "GET", "/items/1")
+		if i < 2 && rw.Code != http.StatusOK {
+			t.Errorf("high req %d: want status 200, got %d", i, rw.Code)
+			return
+		}
+		if i == 2 && (rw.Code != http.StatusTooManyRequests ||
+			rw.Header().Get(LimitReasonHeader) != LimitReasonGlobal) {
+			t.Errorf("high req %d: want global 429, got %d (%s)", i, rw.Code,
+				rw.Header().Get(LimitReasonHeader))
+			return
+		}
+	}
+}
+
+// halfLowPriorityScaler halves the limits of the priority 0
+type halfLowPriorityScaler struct{}
+
+func (hs *halfLowPriorityScaler) Factor(priority int) float64 {
+	if priority == 0 {
+		return 0.5
+	}
+	return 1.0
+}
+
+func Test_RateLimitMiddlewareLimitScaler(t *testing.T) {
+	rlm, _ := newTestMiddleware(newFakeRedis(), 10)
+	rlm.SetLimitScaler(&halfLowPriorityScaler{})
+
+	rw := doTestRequest(rlm, "GET", "/items/1")
+	if rw.Header().Get("RateLimit-Limit") != "5" {
+		t.Errorf("want scaled limit 5, got %s", rw.Header().Get("RateLimit-Limit"))
+		return
+	}
+
+	apiKeys := catalog.NewIndexedAPIKeys()
+	apiKeys.Update(&catalog.APIIndexedLimits{
+		APILimits: []catalog.APIKeyIndexedLimits{
+			{APIKey: testAPIKey, Priority: 1},
+		},
+	})
+	rlm.apiKeyCatalog = apiKeys
+	rw = doTestRequest(rlm, "GET", "/items/1")
+	if rw.Header().Get("RateLimit-Limit") != "10" {
+		t.Errorf("want limit 10, got %s", rw.Header().Get("RateLimit-Limit"))
+	}
+}
+
+func Test_RateLimitMiddlewareLimitKeyParams(t *testing.T) {
+	fr := newFakeRedis()
+	rlm, next := newTestMiddleware(fr, 2)
+	rlm.apiKeyCatalog = newTestAPIKeys(
+		catalog.EndpointIndexedDef{PathIdx: 0, MethodIdx: 0,
+			LimitKey: &catalog.LimitKeyDef{PathParams: []string{"id"}}},
+		catalog.EndpointIndexedLimits{EndpointIdx: 0, RateLimit: 2})
+
+	// each item has its own counters, sharing the endpoint limit
+	for _, path := range []string{"/items/1", "/items/1", "/items/2", "/items/2"} {
+		if rw := doTestRequest(rlm, "GET", path); rw.Code != http.StatusOK {
+			t.Errorf("%s: want status %d, got %d", path, http.StatusOK, rw.Code)
+		}
+	}
+	rw := doTestRequest(rlm, "GET", "/items/1")
+	if rw.Code != http.StatusTooManyRequests {
+		t.Errorf("want status %d, got %d", http.StatusTooManyRequests, rw.Code)
+	}
+	if rw.Header().Get("RateLimit-Limit") != "2" {
+		t.Errorf("want limit 2, got %s", rw.Header().Get("RateLimit-Limit"))
+	}
+	if next.calls != 4 {
+		t.Errorf("want 4 requests forwarded, got %d", next.calls)
+	}
+}
+
+func Test_RateLimitMiddlewarePathNormalizer(t *testing.T) {
+	fr := newFakeRedis()
+	rlm, next := newTestMiddleware(fr, 1)
+
+	if rw := doTestRequest(rlm, "GET", "/items//1"); rw.Code != http.StatusNotFound {
+		t.Errorf("want status %d, got %d", http.StatusNotFound, rw.Code)
+	}
+
+	rlm.SetPathNormalizer(pathmatcher.NewNormalizer())
+	if rw := doTestRequest(rlm, "GET", "/items//1"); rw.Code != http.StatusOK {
+		t.Errorf("want status %d, got %d", http.StatusOK, rw.Code)
+	}
+	// the same endpoint, so it is limited
+	rw := doTestRequest(rlm, "GET", "/other/../items/%32")
+	if rw.Code != http.StatusTooManyRequests {
+		t.Errorf("want status %d, got %d", http.StatusTooManyRequests, rw.Code)
+	}
+	if next.calls != 1 {
+		t.Errorf("want 1 request forwarded, got %d", next.calls)
+	}
+}
+
+func Test_RateLimitMiddlewarePathNormalizerForwardedPath(t *testing.T) {
+	rlm, _ := newTestMiddleware(newFakeRedis(), 10)
+	rlm.SetPathNormalizer(pathmatcher.NewNormalizer())
+	var forwarded string
+	rlm.next = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		forwarded = req.URL.RequestURI()
+		rw.WriteHeader(http.StatusOK)
+	})
+
+	// the next handler gets the path that was limited
+	rw := doTestRequest(rlm, "GET", "/other/..//items/%32?q=1")
+	if rw.Code != http.StatusOK {
+		t.Fatalf("want status 200, got %d", rw.Code)
+	}
+	if forwarded != "/items/2?q=1" {
+		t.Errorf("want forwarded /items/2?q=1, got %s", forwarded)
+	}
+}
+
+// routeMatchHandler records the route matched by the middleware
+type routeMatchHandler struct {
+	matched *pathmatcher.PathMatched
+	params  pathmatcher.Params
+}
+
+func (rh *routeMatchHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	rh.matched, rh.params = pathmatcher.GetRouteMatch(req)
+	rw.WriteHeader(http.StatusOK)
+}
+
+func Test_RateLimitMiddlewareRouteMatch(t *testing.T) {
+	rlm, _ := newTestMiddleware(newFakeRedis(), 10)
+	next := &routeMatchHandler{}
+	rlm.next = next
+
+	rw := doTestRequest(rlm, "GET", "/items/7")
+	if rw.Code != http.StatusOK {
+		t.Fatalf("want status 200, got %d", rw.Code)
+	}
+	if next.matched == nil || next.matched.OpenAPIPath != "/items/{id}" ||
+		next.params.Get("id") != "7" {
+		t.Errorf("unexpected route match %#v %#v", next.matched, next.params)
+	}
+}
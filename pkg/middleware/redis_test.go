@@ -0,0 +1,261 @@
+package middleware
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// fakeRedis is a minimal in memory implementation of the redis
+// commands used by the middleware, so we can test it without
+// a running redis server.
+type fakeRedis struct {
+	mu      sync.Mutex
+	strings map[string]string
+	hashes  map[string]map[string]int64
+	zsets   map[string]map[string]float64
+}
+
+func newFakeRedis() *fakeRedis {
+	return &fakeRedis{
+		strings: make(map[string]string),
+		hashes:  make(map[string]map[string]int64),
+		zsets:   make(map[string]map[string]float64),
+	}
+}
+
+// pool returns a redis pool whose connections all share
+// the fakeRedis data
+func (fr *fakeRedis) pool() *redis.Pool {
+	return &redis.Pool{
+		MaxIdle:     4,
+		IdleTimeout: time.Minute,
+		Dial: func() (redis.Conn, error) {
+			return &fakeRedisConn{fr: fr}, nil
+		},
+	}
+}
+
+func (fr *fakeRedis) exec(cmd string, args []interface{}) (interface{}, error) {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+
+	sargs := make([]string, len(args))
+	for idx, a := range args {
+		sargs[idx] = fmt.Sprint(a)
+	}
+
+	switch strings.ToUpper(cmd) {
+	case "":
+		return nil, nil
+	case "GET":
+		v, ok := fr.strings[sargs[0]]
+		if !ok {
+			return nil, nil
+		}
+		return []byte(v), nil
+	case "SET":
+		nx := false
+		for _, opt := range sargs[2:] {
+			if strings.ToUpper(opt) == "NX" {
+				nx = true
+			}
+		}
+		if _, ok := fr.strings[sargs[0]]; ok && nx {
+			return nil, nil
+		}
+		fr.strings[sargs[0]] = sargs[1]
+		return "OK", nil
+	case "DEL":
+		n := int64(0)
+		for _, k := range sargs {
+			if _, ok := fr.strings[k]; ok {
+				delete(fr.strings, k)
+				n++
+			}
+			if _, ok := fr.hashes[k]; ok {
+				delete(fr.hashes, k)
+				n++
+			}
+		}
+		return n, nil
+	case "EXPIRE", "PEXPIRE":
+		return int64(1), nil
+	case "HINCRBY":
+		inc, err := strconv.ParseInt(sargs[2], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		h, ok := fr.hashes[sargs[0]]
+		if !ok {
+			h = make(map[string]int64)
+			fr.hashes[sargs[0]] = h
+		}
+		h[sargs[1]] += inc
+		return h[sargs[1]], nil
+	case "HGETALL":
+		res := []interface{}{}
+		for k, v := range fr.hashes[sargs[0]] {
+			res = append(res, []byte(k),
+				[]byte(strconv.FormatInt(v, 10)))
+		}
+		return res, nil
+	case "ZADD":
+		xx := false
+		if strings.ToUpper(sargs[1]) == "XX" {
+			xx = true
+			sargs = append(sargs[:1], sargs[2:]...)
+		}
+		score, err := parseScore(sargs[1])
+		if err != nil {
+			return nil, err
+		}
+		z, ok := fr.zsets[sargs[0]]
+		if !ok {
+			z = make(map[string]float64)
+			fr.zsets[sargs[0]] = z
+		}
+		if _, exists := z[sargs[2]]; xx && !exists {
+			return int64(0), nil
+		}
+		z[sargs[2]] = score
+		return int64(1), nil
+	case "ZREM":
+		z := fr.zsets[sargs[0]]
+		if _, ok := z[sargs[1]]; !ok {
+			return int64(0), nil
+		}
+		delete(z, sargs[1])
+		return int64(1), nil
+	case "ZCARD":
+		return int64(len(fr.zsets[sargs[0]])), nil
+	case "ZREMRANGEBYSCORE":
+		min, err := parseScore(sargs[1])
+		if err != nil {
+			return nil, err
+		}
+		max, err := parseScore(sargs[2])
+		if err != nil {
+			return nil, err
+		}
+		n := int64(0)
+		for m, score := range fr.zsets[sargs[0]] {
+			if score >= min && score <= max {
+				delete(fr.zsets[sargs[0]], m)
+				n++
+			}
+		}
+		return n, nil
+	}
+	return nil, fmt.Errorf("fake redis: command %s not supported", cmd)
+}
+
+func parseScore(s string) (float64, error) {
+	switch s {
+	case "-inf":
+		return math.Inf(-1), nil
+	case "+inf", "inf":
+		return math.Inf(1), nil
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+type fakeRedisCmd struct {
+	name string
+	args []interface{}
+}
+
+// fakeRedisConn implements the redis.Conn interface, with
+// support for pipelining and MULTI / EXEC transactions
+type fakeRedisConn struct {
+	fr      *fakeRedis
+	pending []fakeRedisCmd
+	replies []interface{}
+	inMulti bool
+	queued  []fakeRedisCmd
+}
+
+func (c *fakeRedisConn) Close() error { return nil }
+
+func (c *fakeRedisConn) Err() error { return nil }
+
+func (c *fakeRedisConn) Send(cmd string, args ...interface{}) error {
+	c.pending = append(c.pending, fakeRedisCmd{name: cmd, args: args})
+	return nil
+}
+
+func (c *fakeRedisConn) Flush() error {
+	for _, cmd := range c.pending {
+		c.replies = append(c.replies, c.run(cmd))
+	}
+	c.pending = c.pending[:0]
+	return nil
+}
+
+func (c *fakeRedisConn) Receive() (interface{}, error) {
+	if len(c.replies) == 0 {
+		return nil, fmt.Errorf("fake redis: no pending replies")
+	}
+	r := c.replies[0]
+	c.replies = c.replies[1:]
+	if err, ok := r.(error); ok {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (c *fakeRedisConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if cmd != "" {
+		c.Send(cmd, args...)
+	}
+	c.Flush()
+	var last interface{}
+	for len(c.replies) > 0 {
+		last = c.replies[0]
+		c.replies = c.replies[1:]
+	}
+	if err, ok := last.(error); ok {
+		return nil, err
+	}
+	return last, nil
+}
+
+func (c *fakeRedisConn) run(cmd fakeRedisCmd) interface{} {
+	switch strings.ToUpper(cmd.name) {
+	case "MULTI":
+		c.inMulti = true
+		c.queued = c.queued[:0]
+		return "OK"
+	case "DISCARD":
+		c.inMulti = false
+		c.queued = c.queued[:0]
+		return "OK"
+	case "EXEC":
+		c.inMulti = false
+		res := make([]interface{}, 0, len(c.queued))
+		for _, q := range c.queued {
+			r, err := c.fr.exec(q.name, q.args)
+			if err != nil {
+				res = append(res, redis.Error(err.Error()))
+				continue
+			}
+			res = append(res, r)
+		}
+		c.queued = c.queued[:0]
+		return res
+	}
+	if c.inMulti {
+		c.queued = append(c.queued, cmd)
+		return "QUEUED"
+	}
+	r, err := c.fr.exec(cmd.name, cmd.args)
+	if err != nil {
+		return err
+	}
+	return r
+}
@@ -0,0 +1,65 @@
+package middleware
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// StatusRules is a set of response status codes, and status
+// code classes (like `5xx`), used to select the requests
+// that must not count against the limits.
+type StatusRules struct {
+	codes   map[int]bool
+	classes [6]bool
+}
+
+// ParseStatusRules creates a StatusRules from a comma separated
+// list of status codes and classes, like `5xx,404,408`.
+func ParseStatusRules(rules string) (*StatusRules, error) {
+	sr := &StatusRules{
+		codes: make(map[int]bool),
+	}
+	for _, r := range strings.Split(rules, ",") {
+		r = strings.ToLower(strings.TrimSpace(r))
+		if len(r) == 0 {
+			continue
+		}
+		if len(r) == 3 && strings.HasSuffix(r, "xx") {
+			class, err := strconv.Atoi(r[:1])
+			if err != nil || class < 1 || class > 5 {
+				return nil, fmt.Errorf("bad status class %q", r)
+			}
+			sr.classes[class] = true
+			continue
+		}
+		code, err := strconv.Atoi(r)
+		if err != nil || code < 100 || code > 599 {
+			return nil, fmt.Errorf("bad status code %q", r)
+		}
+		sr.codes[code] = true
+	}
+	return sr, nil
+}
+
+// Match checks if a status code is in the rules
+func (sr *StatusRules) Match(statusCode int) bool {
+	if sr.codes[statusCode] {
+		return true
+	}
+	class := statusCode / 100
+	return class > 0 && class < len(sr.classes) && sr.classes[class]
+}
+
+// Empty returns true when there are no rules
+func (sr *StatusRules) Empty() bool {
+	if len(sr.codes) > 0 {
+		return false
+	}
+	for _, c := range sr.classes {
+		if c {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,38 @@
+package middleware
+
+import (
+	"testing"
+)
+
+func Test_ParseStatusRules(t *testing.T) {
+	sr, err := ParseStatusRules("5xx, 404,408")
+	if err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+		return
+	}
+	matches := map[int]bool{
+		500: true,
+		503: true,
+		404: true,
+		408: true,
+		200: false,
+		400: false,
+		429: false,
+	}
+	for code, want := range matches {
+		if got := sr.Match(code); got != want {
+			t.Errorf("status %d: want %t, got %t", code, want, got)
+		}
+	}
+
+	sr, err = ParseStatusRules("")
+	if err != nil || !sr.Empty() {
+		t.Errorf("want empty rules, got %#v (%v)", sr, err)
+	}
+
+	for _, bad := range []string{"6xx", "foo", "42", "x5x"} {
+		if _, err := ParseStatusRules(bad); err == nil {
+			t.Errorf("%q: want error", bad)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package pathmatcher
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// RouteConditions restricts a route to the requests for a given
+// host and with some header values:
+//
+//   - Host: the host name of the request (without the port). It can
+//     be a wildcard subdomain like `*.example.com`, that matches any
+//     subdomain of example.com (but not example.com itself). An empty
+//     host matches any host.
+//   - Headers: header names and the exact value they must have (like
+//     `Accept-Version: 2`).
+//
+// For the same Precedence, routes with conditions take precedence
+// over the ones without them.
+type RouteConditions struct {
+	Host    string
+	Headers map[string]string
+}
+
+// headerCond is a header condition with its name in canonical form
+type headerCond struct {
+	name  string
+	value string
+}
+
+// Empty returns true if the conditions match any request
+func (rc RouteConditions) Empty() bool {
+	return len(rc.Host) == 0 && len(rc.Headers) == 0
+}
+
+// Validate checks that the host pattern is a valid one
+func (rc RouteConditions) Validate() error {
+	host := strings.TrimPrefix(rc.Host, "*.")
+	if strings.ContainsAny(host, "*/:") ||
+		(len(rc.Host) > 0 && len(host) == 0) {
+		return fmt.Errorf("bad host pattern %q", rc.Host)
+	}
+	for name := range rc.Headers {
+		if len(name) == 0 {
+			return fmt.Errorf("empty header name")
+		}
+	}
+	return nil
+}
+
+// key returns a string that identifies the conditions, that is
+// the same for equivalent conditions. It is empty if there are no
+// conditions, so routes without them keep their plain keys:
+//
+//	`@api.example.com[Accept-Version=2]`
+func (rc RouteConditions) key() string {
+	if rc.Empty() {
+		return ""
+	}
+	var sb strings.Builder
+	if len(rc.Host) > 0 {
+		sb.WriteString("@")
+		sb.WriteString(strings.ToLower(rc.Host))
+	}
+	for _, hc := range rc.headerConds() {
+		sb.WriteString("[")
+		sb.WriteString(hc.name)
+		sb.WriteString("=")
+		sb.WriteString(hc.value)
+		sb.WriteString("]")
+	}
+	return sb.String()
+}
+
+// headerConds returns the header conditions sorted by name
+func (rc RouteConditions) headerConds() []headerCond {
+	hcs := make([]headerCond, 0, len(rc.Headers))
+	for name, value := range rc.Headers {
+		hcs = append(hcs, headerCond{
+			name:  http.CanonicalHeaderKey(name),
+			value: value,
+		})
+	}
+	sort.Slice(hcs, func(i, j int) bool { return hcs[i].name < hcs[j].name })
+	return hcs
+}
+
+// matchHeaders checks that all the header conditions are met
+func matchHeaders(hcs []headerCond, header http.Header) bool {
+	for _, hc := range hcs {
+		vals := header[hc.name]
+		if len(vals) == 0 || vals[0] != hc.value {
+			return false
+		}
+	}
+	return true
+}
+
+// requestHost returns the lower case host of a request, without
+// the port
+func requestHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
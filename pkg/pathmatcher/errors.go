@@ -0,0 +1,36 @@
+package pathmatcher
+
+import (
+	"fmt"
+	"strings"
+)
+
+// RouteError tells why a route could not be added to the routers
+type RouteError struct {
+	Method string
+	Path   string
+	Err    error
+}
+
+func (re *RouteError) Error() string {
+	return fmt.Sprintf("%s %s: %s", re.Method, re.Path, re.Err.Error())
+}
+
+func (re *RouteError) Unwrap() error {
+	return re.Err
+}
+
+// BuildError is returned when some routes can not be built. When
+// it happens, the matcher keeps its previous routers.
+type BuildError struct {
+	Routes []*RouteError
+}
+
+func (be *BuildError) Error() string {
+	msgs := make([]string, 0, len(be.Routes))
+	for _, re := range be.Routes {
+		msgs = append(msgs, re.Error())
+	}
+	return fmt.Sprintf("cannot build %d routes: %s", len(be.Routes),
+		strings.Join(msgs, "; "))
+}
@@ -0,0 +1,294 @@
+package pathmatcher
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// TrailingSlashPolicy selects what to do with the trailing
+// slash of a path before matching it
+type TrailingSlashPolicy int
+
+const (
+	// TrailingSlashKeep leaves the path as it is
+	TrailingSlashKeep TrailingSlashPolicy = iota
+	// TrailingSlashStrip removes the trailing slash (except for `/`)
+	TrailingSlashStrip
+	// TrailingSlashAdd adds a trailing slash if there is none
+	TrailingSlashAdd
+)
+
+// ParseTrailingSlashPolicy converts a policy name (`keep`, `strip`
+// or `add`) to its TrailingSlashPolicy value
+func ParseTrailingSlashPolicy(name string) (TrailingSlashPolicy, error) {
+	switch strings.ToLower(name) {
+	case "", "keep":
+		return TrailingSlashKeep, nil
+	case "strip":
+		return TrailingSlashStrip, nil
+	case "add":
+		return TrailingSlashAdd, nil
+	}
+	return TrailingSlashKeep, fmt.Errorf("trailing slash policy %q not valid", name)
+}
+
+// PercentDecoding selects which percent-encoded chars of a
+// path are decoded before matching it
+type PercentDecoding int
+
+const (
+	// DecodeUnreserved only decodes the unreserved chars (letters,
+	// digits, `-`, `.`, `_` and `~`), that mean the same encoded or
+	// not, and keeps the others (like `%2F`) encoded, so they can not
+	// change the segments of the path.
+	DecodeUnreserved PercentDecoding = iota
+	// DecodeAll decodes all the chars (as in the URL.Path)
+	DecodeAll
+	// DecodeNone keeps the path as it was sent
+	DecodeNone
+)
+
+// ParsePercentDecoding converts a decoding name (`unreserved`, `all`
+// or `none`) to its PercentDecoding value
+func ParsePercentDecoding(name string) (PercentDecoding, error) {
+	switch strings.ToLower(name) {
+	case "", "unreserved":
+		return DecodeUnreserved, nil
+	case "all":
+		return DecodeAll, nil
+	case "none":
+		return DecodeNone, nil
+	}
+	return DecodeUnreserved, fmt.Errorf("percent decoding %q not valid", name)
+}
+
+// Normalizer transforms the request paths before matching them,
+// so different ways to write the same path (like `/api//items/`,
+// `/api/%69tems` or `/api/other/../items`) can not bypass or miss
+// their limits:
+//
+//   - Decoding: which percent-encoded chars are decoded
+//   - CollapseSlashes: replace duplicated slashes with a single one
+//   - RemoveDotSegments: resolve the `.` and `..` segments
+//   - TrailingSlash: what to do with the trailing slash
+//   - CaseInsensitive: convert the path to lower case (so the catalog
+//     paths must be written in lower case too)
+//
+// The steps are applied in that order. The request is forwarded with
+// the normalized path, so the upstream gets the same path that was
+// limited, but without the case conversion, as the upstream paths
+// (like ids) can be case sensitive.
+type Normalizer struct {
+	Decoding          PercentDecoding
+	CollapseSlashes   bool
+	RemoveDotSegments bool
+	TrailingSlash     TrailingSlashPolicy
+	CaseInsensitive   bool
+}
+
+// NewNormalizer creates a Normalizer with the default options:
+// decode the unreserved chars, collapse slashes and remove the
+// dot segments.
+func NewNormalizer() *Normalizer {
+	return &Normalizer{
+		Decoding:          DecodeUnreserved,
+		CollapseSlashes:   true,
+		RemoveDotSegments: true,
+		TrailingSlash:     TrailingSlashKeep,
+	}
+}
+
+// RequestPaths holds the path of a request as it was received
+// and the normalized one used to match it
+type RequestPaths struct {
+	Original   string
+	Normalized string
+}
+
+type requestPathsKey struct{}
+
+// Normalize returns a shallow copy of the request with its
+// RequestPaths in the context, that are used by the LookupRequest
+// of the matchers, and with the normalized path in its URL (without
+// the case conversion).
+func (n *Normalizer) Normalize(req *http.Request) *http.Request {
+	escapedPath := req.URL.EscapedPath()
+	forwarded := n.normalizePath(escapedPath, false)
+	rp := RequestPaths{
+		Original:   escapedPath,
+		Normalized: forwarded,
+	}
+	if n.CaseInsensitive {
+		rp.Normalized = strings.ToLower(forwarded)
+	}
+	nreq := req.WithContext(context.WithValue(req.Context(),
+		requestPathsKey{}, rp))
+	if forwarded != escapedPath {
+		u := *req.URL
+		if n.Decoding == DecodeAll {
+			// the path is already decoded
+			u.Path, u.RawPath = forwarded, ""
+		} else if p, err := url.PathUnescape(forwarded); err == nil {
+			u.Path, u.RawPath = p, forwarded
+		} else {
+			// malformed escapes: the path is kept as it was sent
+			return nreq
+		}
+		nreq.URL = &u
+	}
+	return nreq
+}
+
+// GetRequestPaths returns the original and normalized paths of a
+// request, and false if it has not been normalized
+func GetRequestPaths(req *http.Request) (RequestPaths, bool) {
+	rp, ok := req.Context().Value(requestPathsKey{}).(RequestPaths)
+	return rp, ok
+}
+
+// matchPath returns the path to use to match a request
+func matchPath(req *http.Request) string {
+	if rp, ok := GetRequestPaths(req); ok {
+		return rp.Normalized
+	}
+	return req.URL.Path
+}
+
+// NormalizePath normalizes an escaped path (as the one returned by
+// URL.EscapedPath)
+func (n *Normalizer) NormalizePath(escapedPath string) string {
+	return n.normalizePath(escapedPath, n.CaseInsensitive)
+}
+
+func (n *Normalizer) normalizePath(escapedPath string, lower bool) string {
+	p := escapedPath
+	switch n.Decoding {
+	case DecodeUnreserved:
+		p = decodePercent(p, false)
+	case DecodeAll:
+		p = decodePercent(p, true)
+	}
+	if n.CollapseSlashes {
+		p = collapseSlashes(p)
+	}
+	if n.RemoveDotSegments {
+		p = removeDotSegments(p)
+	}
+	switch n.TrailingSlash {
+	case TrailingSlashStrip:
+		if len(p) > 1 && strings.HasSuffix(p, "/") {
+			p = strings.TrimRight(p, "/")
+			if len(p) == 0 {
+				p = "/"
+			}
+		}
+	case TrailingSlashAdd:
+		if !strings.HasSuffix(p, "/") {
+			p += "/"
+		}
+	}
+	if lower {
+		p = strings.ToLower(p)
+	}
+	if len(p) == 0 || p[0] != '/' {
+		p = "/" + p
+	}
+	return p
+}
+
+func isUnreserved(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') ||
+		(c >= '0' && c <= '9') || c == '-' || c == '.' || c == '_' || c == '~'
+}
+
+func unhex(c byte) (byte, bool) {
+	switch {
+	case c >= '0' && c <= '9':
+		return c - '0', true
+	case c >= 'a' && c <= 'f':
+		return c - 'a' + 10, true
+	case c >= 'A' && c <= 'F':
+		return c - 'A' + 10, true
+	}
+	return 0, false
+}
+
+// decodePercent decodes the percent-encoded chars of a path (all
+// of them, or only the unreserved ones). The escapes that are kept
+// are written in upper case, so they are the same however they
+// were sent. Malformed escapes are kept as they are.
+func decodePercent(p string, all bool) string {
+	if strings.IndexByte(p, '%') < 0 {
+		return p
+	}
+	var sb strings.Builder
+	sb.Grow(len(p))
+	for idx := 0; idx < len(p); idx++ {
+		if p[idx] != '%' || idx+2 >= len(p) {
+			sb.WriteByte(p[idx])
+			continue
+		}
+		hi, okHi := unhex(p[idx+1])
+		lo, okLo := unhex(p[idx+2])
+		if !okHi || !okLo {
+			sb.WriteByte(p[idx])
+			continue
+		}
+		c := hi<<4 | lo
+		if all || isUnreserved(c) {
+			sb.WriteByte(c)
+		} else {
+			sb.WriteString(strings.ToUpper(p[idx : idx+3]))
+		}
+		idx += 2
+	}
+	return sb.String()
+}
+
+func collapseSlashes(p string) string {
+	if !strings.Contains(p, "//") {
+		return p
+	}
+	var sb strings.Builder
+	sb.Grow(len(p))
+	for idx := 0; idx < len(p); idx++ {
+		if p[idx] == '/' && idx > 0 && p[idx-1] == '/' {
+			continue
+		}
+		sb.WriteByte(p[idx])
+	}
+	return sb.String()
+}
+
+// removeDotSegments resolves the `.` and `..` segments of a path
+// (as in RFC 3986, section 5.2.4). A `..` can not go above the root.
+func removeDotSegments(p string) string {
+	if !strings.Contains(p, ".") {
+		return p
+	}
+	segments := strings.Split(p, "/")
+	out := make([]string, 0, len(segments))
+	for idx, seg := range segments {
+		last := idx == len(segments)-1
+		switch seg {
+		case ".":
+			if last {
+				out = append(out, "")
+			}
+		case "..":
+			// keep the initial empty segment (the root)
+			if len(out) > 1 {
+				out = out[:len(out)-1]
+			}
+			if last {
+				out = append(out, "")
+			}
+		default:
+			out = append(out, seg)
+		}
+	}
+	return strings.Join(out, "/")
+}
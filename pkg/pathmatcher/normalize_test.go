@@ -0,0 +1,98 @@
+package pathmatcher
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_NormalizerNormalizePath(t *testing.T) {
+	def := NewNormalizer()
+	cases := []struct {
+		name string
+		n    *Normalizer
+		path string
+		want string
+	}{
+		{"plain", def, "/api/items", "/api/items"},
+		{"slashes", def, "/api//items///1", "/api/items/1"},
+		{"dots", def, "/api/other/../items/./1", "/api/items/1"},
+		{"dots above root", def, "/../../items", "/items"},
+		{"dots at end", def, "/api/items/..", "/api/"},
+		{"encoded unreserved", def, "/api/%69tems/%2e%2E/x", "/api/x"},
+		{"encoded slash kept", def, "/api/a%2fb", "/api/a%2Fb"},
+		{"malformed escape", def, "/api/%zz%4", "/api/%zz%4"},
+		{"decode all", &Normalizer{Decoding: DecodeAll}, "/api/a%2Fb", "/api/a/b"},
+		{"decode none", &Normalizer{Decoding: DecodeNone}, "/api/%69tems", "/api/%69tems"},
+		{"keep trailing", def, "/api/items/", "/api/items/"},
+		{"strip trailing", &Normalizer{TrailingSlash: TrailingSlashStrip},
+			"/api/items/", "/api/items"},
+		{"strip root", &Normalizer{TrailingSlash: TrailingSlashStrip}, "/", "/"},
+		{"add trailing", &Normalizer{TrailingSlash: TrailingSlashAdd},
+			"/api/items", "/api/items/"},
+		{"case", &Normalizer{CaseInsensitive: true}, "/API/Items", "/api/items"},
+		{"empty", def, "", "/"},
+	}
+	for _, c := range cases {
+		if got := c.n.NormalizePath(c.path); got != c.want {
+			t.Errorf("%s: want %q, got %q", c.name, c.want, got)
+		}
+	}
+}
+
+func Test_NormalizerLookupRequest(t *testing.T) {
+	pm := NewPathMatcher()
+	pm.AddRoute("GET", "/api/items/{id}")
+	pm.Build()
+
+	req := httptest.NewRequest("GET", "/api//other/../%69tems/1", nil)
+	if p, _ := pm.LookupRequest(req); p != nil {
+		t.Errorf("want no match without normalization, got %#v", p)
+	}
+	nreq := NewNormalizer().Normalize(req)
+	p, ps := pm.LookupRequest(nreq)
+	if p == nil || ps.Get("id") != "1" {
+		t.Errorf("want a match with id 1, got %#v %#v", p, ps)
+	}
+	rp, ok := GetRequestPaths(nreq)
+	if !ok || rp.Original != "/api//other/../%69tems/1" ||
+		rp.Normalized != "/api/items/1" {
+		t.Errorf("unexpected request paths %#v", rp)
+	}
+	if nreq.URL.Path != "/api/items/1" || req.URL.Path != "/api//other/../items/1" {
+		t.Errorf("want the normalized path in a copy of the URL, got %q (original %q)",
+			nreq.URL.Path, req.URL.Path)
+	}
+}
+
+func Test_NormalizerForwardedPath(t *testing.T) {
+	cases := []struct {
+		n       *Normalizer
+		path    string
+		urlPath string
+		escaped string
+		matched string
+	}{
+		{NewNormalizer(), "/api//a%2Fb/./c?x=1", "/api/a/b/c", "/api/a%2Fb/c", "/api/a%2Fb/c"},
+		{&Normalizer{Decoding: DecodeAll, CollapseSlashes: true},
+			"/api//a%2Fb", "/api/a/b", "/api/a/b", "/api/a/b"},
+		// the case conversion is only used to match the request
+		{&Normalizer{CaseInsensitive: true, RemoveDotSegments: true},
+			"/API/x/../Items/AbC", "/API/Items/AbC", "/API/Items/AbC", "/api/items/abc"},
+		{NewNormalizer(), "/api/items", "/api/items", "/api/items", "/api/items"},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", c.path, nil)
+		nreq := c.n.Normalize(req)
+		rp, _ := GetRequestPaths(nreq)
+		if nreq.URL.Path != c.urlPath || nreq.URL.EscapedPath() != c.escaped ||
+			rp.Normalized != c.matched {
+			t.Errorf("%s: want %q %q %q, got %q %q %q", c.path, c.urlPath,
+				c.escaped, c.matched, nreq.URL.Path, nreq.URL.EscapedPath(),
+				rp.Normalized)
+		}
+		if nreq.URL.RawQuery != req.URL.RawQuery {
+			t.Errorf("%s: want query %q kept, got %q", c.path,
+				req.URL.RawQuery, nreq.URL.RawQuery)
+		}
+	}
+}
@@ -1,8 +1,10 @@
 package pathmatcher
 
 import (
+	"context"
 	"fmt"
-	"regexp"
+	"net/http"
+	"sort"
 	"strings"
 
 	"github.com/go-openapi/runtime/middleware/denco"
@@ -10,84 +12,433 @@ import (
 
 // PathMatcher holds the information of a matched
 // path in different formats
+//
+// The Endpoint is the OpenAPIPath prefixed with the route
+// conditions (if any), and identifies the route in the catalog
+// together with the Method (that is AnyMethod for the routes
+// that match any method).
+//
+// As the PathMatched returned by a lookup is the one of the
+// route that matched, Kind and Precedence tell which rule was
+// applied, and Upstream where the request must be sent.
 type PathMatched struct {
 	Method      string
 	OpenAPIPath string
 	RouterPath  string
+	Kind        RouteKind
+	Conditions  RouteConditions
+	Precedence  int
+	Upstream    string
+	Endpoint    string
 	RedisKey    string
+
+	shape    string
+	params   []paramDef
+	parseErr error
 }
 
 func NewPathMatched(method, openApiPath string) *PathMatched {
-	pathConverter := regexp.MustCompile(`{(.+?)}([^/]*)`)
-	mn := strings.ToUpper(method)
-	conv := pathConverter.ReplaceAllString(openApiPath, ":$1")
-	redisKeyPath := fmt.Sprintf("%s_%s", mn, openApiPath)
-	return &PathMatched{
+	return NewRoutePathMatched(Route{Method: method, Path: openApiPath})
+}
+
+// NewPathMatchedWithConditions creates a PathMatched for a route
+// that only matches the requests that meet the conditions
+func NewPathMatchedWithConditions(method, openApiPath string,
+	conds RouteConditions) *PathMatched {
+	return NewRoutePathMatched(Route{Method: method, Path: openApiPath,
+		Conditions: conds})
+}
+
+// NewRoutePathMatched creates a PathMatched for a route definition
+func NewRoutePathMatched(r Route) *PathMatched {
+	mn := routeMethod(r.Method)
+	endpoint := r.Conditions.key() + r.Path
+	redisKeyPath := fmt.Sprintf("%s_%s", mn, endpoint)
+	pm := &PathMatched{
 		Method:      mn,
-		OpenAPIPath: openApiPath,
-		RouterPath:  conv,
+		OpenAPIPath: r.Path,
+		RouterPath:  r.Path,
+		Conditions:  r.Conditions,
+		Precedence:  r.Precedence,
+		Upstream:    r.Upstream,
+		Endpoint:    endpoint,
 		RedisKey:    redisKeyPath,
 	}
+	pp, err := parsePath(r.Path)
+	if err != nil {
+		// the route can not be added to the routers
+		pm.parseErr = err
+		return pm
+	}
+	pm.RouterPath = pp.routerPath
+	pm.Kind = pp.kind
+	pm.shape = pp.shape
+	pm.params = pp.params
+	return pm
+}
+
+// guarded returns true if some of the params must be checked
+// after the router lookup
+func (pm *PathMatched) guarded() bool {
+	for idx := range pm.params {
+		if pm.params[idx].guarded() {
+			return true
+		}
+	}
+	return false
+}
+
+// matchParams checks the values found by the router against
+// the params definitions, and returns the params values
+func (pm *PathMatched) matchParams(dps denco.Params) (Params, bool) {
+	if len(pm.params) == 0 {
+		return nil, true
+	}
+	ps := make(Params, len(pm.params))
+	for idx := range pm.params {
+		pd := &pm.params[idx]
+		ps[idx].Name = pd.name
+		if idx >= len(dps) {
+			// the base path of a prefix route does not have
+			// the prefix param
+			if pm.Kind == RoutePrefix && idx == len(pm.params)-1 {
+				continue
+			}
+			return nil, false
+		}
+		v, ok := pd.match(dps[idx].Value)
+		if !ok {
+			return nil, false
+		}
+		ps[idx].Value = v
+	}
+	return ps, true
+}
+
+// Param is a path parameter value found when looking up
+// a route
+type Param struct {
+	Name  string
+	Value string
+}
+
+// Params is the list of path parameters found when looking
+// up a route
+type Params []Param
+
+// Get returns the value of a path parameter, or an empty
+// string if it is not found
+func (ps Params) Get(name string) string {
+	for _, p := range ps {
+		if p.Name == name {
+			return p.Value
+		}
+	}
+	return ""
 }
 
 // Matcher defines the interface to lookup a a path
+//
+// LookupRoute only finds the routes without conditions, while
+// LookupRequest also takes into account the host and headers
+// of the request.
 type Matcher interface {
-	LookupRoute(method, pathWithParams string) *PathMatched
+	LookupRoute(method, pathWithParams string) (*PathMatched, Params)
+	LookupRequest(req *http.Request) (*PathMatched, Params)
+}
+
+type routeMatchKey struct{}
+
+// routeMatch is the result of a lookup stored in a request context
+type routeMatch struct {
+	matched *PathMatched
+	params  Params
+}
+
+// WithRouteMatch returns a shallow copy of the request with the
+// result of its lookup in the context, so the next handlers can
+// use it without matching the request again.
+func WithRouteMatch(req *http.Request, matched *PathMatched,
+	params Params) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), routeMatchKey{},
+		routeMatch{matched: matched, params: params}))
+}
+
+// GetRouteMatch returns the route and params stored with
+// WithRouteMatch, or a nil route if there are none
+func GetRouteMatch(req *http.Request) (*PathMatched, Params) {
+	rm, _ := req.Context().Value(routeMatchKey{}).(routeMatch)
+	return rm.matched, rm.params
+}
+
+// routeScope holds the routes that share the same conditions
+// and precedence, by method
+type routeScope struct {
+	conds      RouteConditions
+	precedence int
+	routes     map[string][]*PathMatched
+}
+
+// scopeRouters holds the built routers of a routeScope
+type scopeRouters struct {
+	key        string
+	precedence int
+	headers    []headerCond
+	routers    map[string]*methodRouter
+}
+
+// routeTable holds the built routers, indexed by host (including
+// the `*.domain` wildcards) and by method, so a lookup only needs
+// to check a few routers.
+type routeTable struct {
+	hosts   map[string][]*scopeRouters
+	anyHost []*scopeRouters
 }
 
 type PathMatcher struct {
-	records map[string][]denco.Record
-	routers map[string]*denco.Router
+	scopes map[string]*routeScope
+	table  *routeTable
 }
 
 func NewPathMatcher() *PathMatcher {
 	return &PathMatcher{
-		records: make(map[string][]denco.Record),
-		routers: make(map[string]*denco.Router),
+		scopes: make(map[string]*routeScope),
+		table:  &routeTable{},
 	}
 }
 
 func (pm *PathMatcher) AddRoute(method, path string) {
-	pathMatched := NewPathMatched(method, path)
-	record := denco.NewRecord(pathMatched.RouterPath, pathMatched)
-	pm.records[pathMatched.Method] = append(
-		pm.records[pathMatched.Method], record)
+	pm.addRoute(NewPathMatched(method, path))
 }
 
-func (pm *PathMatcher) LookupRoute(method, pathWithParams string) *PathMatched {
-	method = strings.ToUpper(method)
-	r, ok := pm.routers[method]
+// AddRouteDef adds a route definition
+func (pm *PathMatcher) AddRouteDef(r Route) {
+	pm.addRoute(NewRoutePathMatched(r))
+}
+
+// AddRouteWithConditions adds a route that only matches the requests
+// that meet the conditions
+func (pm *PathMatcher) AddRouteWithConditions(method, path string,
+	conds RouteConditions) {
+	pm.addRoute(NewPathMatchedWithConditions(method, path, conds))
+}
+
+// scopeKey returns the key of the scope where a route belongs
+func scopeKey(pathMatched *PathMatched) string {
+	return fmt.Sprintf("%s#%d", pathMatched.Conditions.key(),
+		pathMatched.Precedence)
+}
+
+// addRoute adds the record for a route, if it does not exist
+func (pm *PathMatcher) addRoute(pathMatched *PathMatched) {
+	key := scopeKey(pathMatched)
+	scope, ok := pm.scopes[key]
 	if !ok {
-		// fmt.Printf("routers %#v\n", pm.routers)
-		return nil
-	}
-	// we ignore the params
-	res, _, found := r.Lookup(pathWithParams)
-	if !found {
-		/*
-			fmt.Printf("Lookup NOT found: %s -> %s, %#v, %t\n%#v\n",
-				pathWithParams, res, params, found, pm.routers[method])
-		*/
-		return nil
-	}
-	// fmt.Printf("Lookup Params:\n%#v\n", params)
-	p, ok := res.(*PathMatched)
+		scope = &routeScope{
+			conds:      pathMatched.Conditions,
+			precedence: pathMatched.Precedence,
+			routes:     make(map[string][]*PathMatched),
+		}
+		pm.scopes[key] = scope
+	}
+	byMethod := scope.routes[pathMatched.Method]
+	// checks that the entry do not exists
+	for _, r := range byMethod {
+		if r.OpenAPIPath == pathMatched.OpenAPIPath {
+			return
+		}
+	}
+	scope.routes[pathMatched.Method] = append(byMethod, pathMatched)
+}
+
+// removeRoute removes the record for a route
+func (pm *PathMatcher) removeRoute(pathMatched *PathMatched) {
+	scope, ok := pm.scopes[scopeKey(pathMatched)]
 	if !ok {
-		return nil
+		return
+	}
+	byMethod := scope.routes[pathMatched.Method]
+	for idx, r := range byMethod {
+		if r.OpenAPIPath == pathMatched.OpenAPIPath {
+			if idx < len(byMethod)-1 {
+				// denco router, does not care about order of records
+				// https://github.com/naoina/denco#url-pattern
+				// so we can swap last record with found one
+				byMethod[idx] = byMethod[len(byMethod)-1]
+			}
+			// just shorten the slice
+			scope.routes[pathMatched.Method] = byMethod[:len(byMethod)-1]
+			return
+		}
 	}
-	return p
 }
 
-func (pm *PathMatcher) buildRouter(records map[string][]denco.Record) map[string]*denco.Router {
-	routers := make(map[string]*denco.Router)
-	for method, records := range pm.records {
-		router := denco.New()
-		_ = router.Build(records)
-		routers[method] = router
+// clone returns a copy of the matcher routes, that can be modified
+// without changing the original ones. The routers are shared until
+// the copy is built.
+func (pm *PathMatcher) clone() *PathMatcher {
+	c := &PathMatcher{
+		scopes: make(map[string]*routeScope, len(pm.scopes)),
+		table:  pm.table,
+	}
+	for key, scope := range pm.scopes {
+		cs := &routeScope{
+			conds:      scope.conds,
+			precedence: scope.precedence,
+			routes:     make(map[string][]*PathMatched, len(scope.routes)),
+		}
+		for method, routes := range scope.routes {
+			cs.routes[method] = append([]*PathMatched(nil), routes...)
+		}
+		c.scopes[key] = cs
 	}
-	return routers
+	return c
 }
 
-func (pm *PathMatcher) Build() {
-	pm.routers = pm.buildRouter(pm.records)
+// removeAll removes all the records
+func (pm *PathMatcher) removeAll() {
+	pm.scopes = make(map[string]*routeScope)
+}
+
+func (pm *PathMatcher) LookupRoute(method, pathWithParams string) (*PathMatched, Params) {
+	return pm.table.lookup(method, "", nil, pathWithParams)
+}
+
+// LookupRequest finds the route for a request, taking into account
+// its host and headers. If the request has been normalized (see
+// Normalizer), its normalized path is used.
+func (pm *PathMatcher) LookupRequest(req *http.Request) (*PathMatched, Params) {
+	return pm.table.lookup(req.Method, req.Host, req.Header, matchPath(req))
+}
+
+// lookup checks the routers with higher precedence first, for the
+// exact host, its wildcard domains and any host. For the same
+// precedence, the routers for the exact host are checked first, then
+// the ones for its wildcard domains (from the longest to the
+// shortest), then the ones for any host, and for each host the ones
+// with more header conditions first.
+func (rt *routeTable) lookup(method, host string, header http.Header,
+	pathWithParams string) (*PathMatched, Params) {
+	method = strings.ToUpper(method)
+	// the scopes of each host tier, from the most to the least
+	// specific, are already sorted by precedence
+	tiers := make([][]*scopeRouters, 0, 4)
+	if len(host) > 0 && len(rt.hosts) > 0 {
+		host = requestHost(host)
+		tiers = append(tiers, rt.hosts[host])
+		for idx := strings.IndexByte(host, '.'); idx >= 0; {
+			tiers = append(tiers, rt.hosts["*"+host[idx:]])
+			next := strings.IndexByte(host[idx+1:], '.')
+			if next < 0 {
+				break
+			}
+			idx += next + 1
+		}
+	}
+	tiers = append(tiers, rt.anyHost)
+
+	for {
+		// merge the tiers, taking the scope with the highest
+		// precedence, or from the most specific tier on a tie
+		best := -1
+		for idx, scopes := range tiers {
+			if len(scopes) > 0 && (best < 0 ||
+				scopes[0].precedence > tiers[best][0].precedence) {
+				best = idx
+			}
+		}
+		if best < 0 {
+			return nil, nil
+		}
+		s := tiers[best][0]
+		tiers[best] = tiers[best][1:]
+		if p, ps := lookupScope(s, method, header, pathWithParams); p != nil {
+			return p, ps
+		}
+	}
+}
+
+func lookupScope(s *scopeRouters, method string, header http.Header,
+	pathWithParams string) (*PathMatched, Params) {
+	if len(s.headers) > 0 && !matchHeaders(s.headers, header) {
+		return nil, nil
+	}
+	if r, ok := s.routers[method]; ok {
+		if p, ps := r.lookup(pathWithParams); p != nil {
+			return p, ps
+		}
+	}
+	if r, ok := s.routers[AnyMethod]; ok && method != AnyMethod {
+		if p, ps := r.lookup(pathWithParams); p != nil {
+			return p, ps
+		}
+	}
+	return nil, nil
+}
+
+// buildTable builds the routers for all the routes, returning a
+// BuildError with the routes that fail (if any)
+func (pm *PathMatcher) buildTable() (*routeTable, error) {
+	rt := &routeTable{
+		hosts: make(map[string][]*scopeRouters),
+	}
+	var failed []*RouteError
+	for key, scope := range pm.scopes {
+		sr := &scopeRouters{
+			key:        key,
+			precedence: scope.precedence,
+			headers:    scope.conds.headerConds(),
+			routers:    make(map[string]*methodRouter),
+		}
+		for method, routes := range scope.routes {
+			mr, errs := newMethodRouter(routes)
+			failed = append(failed, errs...)
+			if mr != nil {
+				sr.routers[method] = mr
+			}
+		}
+		if len(scope.conds.Host) == 0 {
+			rt.anyHost = append(rt.anyHost, sr)
+			continue
+		}
+		host := strings.ToLower(scope.conds.Host)
+		rt.hosts[host] = append(rt.hosts[host], sr)
+	}
+	sortScopes(rt.anyHost)
+	for _, scopes := range rt.hosts {
+		sortScopes(scopes)
+	}
+	if len(failed) > 0 {
+		sort.Slice(failed, func(i, j int) bool {
+			return failed[i].Error() < failed[j].Error()
+		})
+		return nil, &BuildError{Routes: failed}
+	}
+	return rt, nil
+}
+
+// sortScopes puts first the scopes with higher precedence, and
+// then the ones with more header conditions
+func sortScopes(scopes []*scopeRouters) {
+	sort.Slice(scopes, func(i, j int) bool {
+		if scopes[i].precedence != scopes[j].precedence {
+			return scopes[i].precedence > scopes[j].precedence
+		}
+		if len(scopes[i].headers) != len(scopes[j].headers) {
+			return len(scopes[i].headers) > len(scopes[j].headers)
+		}
+		return scopes[i].key < scopes[j].key
+	})
+}
+
+// Build builds the routers for the current routes. If some of them
+// fail, it returns a BuildError with them, and keeps the previous
+// routers.
+func (pm *PathMatcher) Build() error {
+	table, err := pm.buildTable()
+	if err != nil {
+		return err
+	}
+	pm.table = table
+	return nil
 }
@@ -0,0 +1,466 @@
+package pathmatcher
+
+import (
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func Test_PathMatcherLookupRoute(t *testing.T) {
+	pm := NewPathMatcher()
+	pm.AddRoute("get", "/items/{id}")
+	pm.AddRoute("POST", "/items")
+	pm.Build()
+
+	p, ps := pm.LookupRoute("GET", "/items/42")
+	if p == nil {
+		t.Fatalf("want /items/{id} to match")
+	}
+	if p.RedisKey != "GET_/items/{id}" || p.Endpoint != "/items/{id}" {
+		t.Errorf("unexpected match %#v", p)
+	}
+	if ps.Get("id") != "42" {
+		t.Errorf("want id param 42, got %q", ps.Get("id"))
+	}
+	if p, _ := pm.LookupRoute("DELETE", "/items/42"); p != nil {
+		t.Errorf("want no match for DELETE, got %#v", p)
+	}
+	if p, _ := pm.LookupRoute("POST", "/items/42"); p != nil {
+		t.Errorf("want no match for POST /items/42, got %#v", p)
+	}
+}
+
+func Test_PathMatcherLookupRequestConditions(t *testing.T) {
+	pm := NewPathMatcher()
+	pm.AddRoute("GET", "/items/{id}")
+	pm.AddRouteWithConditions("GET", "/items/{id}",
+		RouteConditions{Host: "api.example.com"})
+	pm.AddRouteWithConditions("GET", "/items/{id}",
+		RouteConditions{Host: "*.example.com"})
+	pm.AddRouteWithConditions("GET", "/items/{id}",
+		RouteConditions{Host: "*.eu.example.com"})
+	pm.AddRouteWithConditions("GET", "/items/{id}",
+		RouteConditions{Host: "api.example.com",
+			Headers: map[string]string{"accept-version": "2"}})
+	pm.AddRouteWithConditions("GET", "/other",
+		RouteConditions{Headers: map[string]string{"Accept-Version": "2"}})
+	pm.Build()
+
+	cases := []struct {
+		host     string
+		version  string
+		path     string
+		endpoint string
+	}{
+		{"api.example.com", "", "/items/1", "@api.example.com/items/{id}"},
+		{"API.example.com:8080", "", "/items/1", "@api.example.com/items/{id}"},
+		{"api.example.com", "2", "/items/1",
+			"@api.example.com[Accept-Version=2]/items/{id}"},
+		{"api.example.com", "3", "/items/1", "@api.example.com/items/{id}"},
+		{"www.example.com", "", "/items/1", "@*.example.com/items/{id}"},
+		{"a.b.example.com", "", "/items/1", "@*.example.com/items/{id}"},
+		{"api.eu.example.com", "", "/items/1", "@*.eu.example.com/items/{id}"},
+		{"example.com", "", "/items/1", "/items/{id}"},
+		{"other.org", "", "/items/1", "/items/{id}"},
+		// falls back to the routes for any host
+		{"api.example.com", "2", "/other", "[Accept-Version=2]/other"},
+		{"api.example.com", "", "/other", ""},
+	}
+
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", c.path, nil)
+		req.Host = c.host
+		if len(c.version) > 0 {
+			req.Header.Set("Accept-Version", c.version)
+		}
+		p, _ := pm.LookupRequest(req)
+		got := ""
+		if p != nil {
+			got = p.Endpoint
+		}
+		if got != c.endpoint {
+			t.Errorf("%s %s (version %q): want %q, got %q", c.host, c.path,
+				c.version, c.endpoint, got)
+		}
+	}
+
+	// LookupRoute ignores the routes with conditions
+	if p, _ := pm.LookupRoute("GET", "/other"); p != nil {
+		t.Errorf("want no match, got %#v", p)
+	}
+}
+
+func Test_PathMatcherLookupRequestHostPrecedence(t *testing.T) {
+	pm := NewPathMatcher()
+	pm.AddRouteDef(Route{Method: "GET", Path: "/items/{id}",
+		Conditions: RouteConditions{Host: "api.example.com"}})
+	pm.AddRouteDef(Route{Method: "GET", Path: "/items/{id}",
+		Precedence: 10})
+	pm.AddRouteDef(Route{Method: "GET", Path: "/orders/{id}",
+		Conditions: RouteConditions{Host: "*.example.com"}, Precedence: 5})
+	pm.AddRouteDef(Route{Method: "GET", Path: "/orders/{id}",
+		Conditions: RouteConditions{Host: "api.example.com"}})
+	pm.AddRouteDef(Route{Method: "GET", Path: "/orders/{id}",
+		Precedence: 5})
+	pm.Build()
+
+	cases := []struct {
+		path       string
+		endpoint   string
+		precedence int
+	}{
+		// a higher precedence wins over a more specific host
+		{"/items/1", "/items/{id}", 10},
+		{"/orders/1", "@*.example.com/orders/{id}", 5},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", c.path, nil)
+		req.Host = "api.example.com"
+		p, _ := pm.LookupRequest(req)
+		if p == nil || p.Endpoint != c.endpoint || p.Precedence != c.precedence {
+			t.Errorf("%s: want %q (%d), got %#v", c.path, c.endpoint,
+				c.precedence, p)
+		}
+	}
+}
+
+func Test_RouteConditionsValidate(t *testing.T) {
+	cases := []struct {
+		host  string
+		valid bool
+	}{
+		{"", true},
+		{"api.example.com", true},
+		{"*.example.com", true},
+		{"*", false},
+		{"*.", false},
+		{"api.*.com", false},
+		{"api.example.com:80", false},
+	}
+	for _, c := range cases {
+		err := RouteConditions{Host: c.host}.Validate()
+		if (err == nil) != c.valid {
+			t.Errorf("%q: want valid %t, got %v", c.host, c.valid, err)
+		}
+	}
+}
+
+func Test_SharedPathMatcherChangeSet(t *testing.T) {
+	spm := NewSharedPathMatcher(NewPathMatcher())
+	cs := spm.StartChangeSet()
+	cs.AddRoute("GET", "/items/{id}")
+	cs.AddRouteWithConditions("GET", "/items/{id}",
+		RouteConditions{Host: "api.example.com"})
+	cs.Commit()
+
+	req := httptest.NewRequest("GET", "/items/1", nil)
+	req.Host = "api.example.com"
+	if p, _ := spm.LookupRequest(req); p == nil || p.Conditions.Host == "" {
+		t.Errorf("want the host route to match, got %#v", p)
+	}
+
+	cs = spm.StartChangeSet()
+	cs.RemoveRouteWithConditions("GET", "/items/{id}",
+		RouteConditions{Host: "api.example.com"})
+	cs.Commit()
+	if p, _ := spm.LookupRequest(req); p == nil || p.Conditions.Host != "" {
+		t.Errorf("want the route without conditions to match, got %#v", p)
+	}
+}
+
+func Test_PathMatcherWildcardRoutes(t *testing.T) {
+	pm := NewPathMatcher()
+	pm.AddRoute("GET", "/static/*")
+	pm.AddRoute("GET", "/static/img/logo.png")
+	pm.AddRoute("GET", "/files/{path*}")
+	pm.AddRoute("ANY", "/api/*")
+	pm.AddRoute("GET", "/api/users/{id}")
+	pm.AddRouteDef(Route{Method: "*", Path: "/api/users/admin", Precedence: 1})
+	pm.Build()
+
+	cases := []struct {
+		method string
+		path   string
+		want   string
+		kind   RouteKind
+		param  string
+	}{
+		{"GET", "/static/", "GET_/static/*", RoutePrefix, ""},
+		{"GET", "/static/a/b.css", "GET_/static/*", RoutePrefix, "a/b.css"},
+		{"GET", "/static/img/logo.png", "GET_/static/img/logo.png", RouteExact, ""},
+		{"GET", "/files/a/b/c", "GET_/files/{path*}", RouteCatchAll, "a/b/c"},
+		{"GET", "/files/", "", RouteExact, ""},
+		{"DELETE", "/api/users/1", "*_/api/*", RoutePrefix, "users/1"},
+		{"GET", "/api/users/1", "GET_/api/users/{id}", RouteParams, "1"},
+		{"GET", "/api/users/admin", "*_/api/users/admin", RouteExact, ""},
+		{"POST", "/api/users/admin", "*_/api/users/admin", RouteExact, ""},
+	}
+	for _, c := range cases {
+		p, ps := pm.LookupRoute(c.method, c.path)
+		if p == nil {
+			if c.want != "" {
+				t.Errorf("%s %s: want %s, got no match", c.method, c.path, c.want)
+			}
+			continue
+		}
+		if p.RedisKey != c.want || p.Kind != c.kind {
+			t.Errorf("%s %s: want %s (%s), got %s (%s)", c.method, c.path,
+				c.want, c.kind, p.RedisKey, p.Kind)
+		}
+		got := ""
+		if len(ps) > 0 {
+			got = ps[len(ps)-1].Value
+		}
+		if got != c.param {
+			t.Errorf("%s %s: want param %q, got %q", c.method, c.path,
+				c.param, got)
+		}
+	}
+}
+
+func Test_ValidatePath(t *testing.T) {
+	cases := []struct {
+		path  string
+		valid bool
+	}{
+		{"/items", true},
+		{"/items/{id}", true},
+		{"/static/*", true},
+		{"*", true},
+		{"/files/{path*}", true},
+		{"items", false},
+		{"/files/{path*}/meta", false},
+		{"/static/*/meta", false},
+		{"/static/a*", false},
+		{"/items/{id", false},
+		{"/items/{}", false},
+		{"/items/{a}{b}", false},
+	}
+	for _, c := range cases {
+		err := ValidatePath(c.path)
+		if (err == nil) != c.valid {
+			t.Errorf("%q: want valid %t, got %v", c.path, c.valid, err)
+		}
+	}
+}
+
+func Test_PathMatcherConstraints(t *testing.T) {
+	pm := NewPathMatcher()
+	pm.AddRoute("GET", "/items/{id:int}")
+	pm.AddRoute("GET", "/items/{id:int}.json")
+	pm.AddRoute("GET", "/items/{uuid:uuid}")
+	pm.AddRoute("GET", "/items/{name:[a-z]{2,4}}")
+	pm.AddRoute("GET", "/items/export")
+	pm.AddRoute("GET", "/items/*")
+	pm.AddRoute("GET", "/api/v{version:uint}/status")
+	pm.Build()
+
+	cases := []struct {
+		path  string
+		want  string
+		param string
+	}{
+		{"/items/42", "/items/{id:int}", "42"},
+		{"/items/42.json", "/items/{id:int}.json", "42"},
+		{"/items/x.json", "/items/*", "x.json"},
+		{"/items/0b8a2f2e-1d3c-4f4e-9a7b-2c6d8e0f1a3b", "/items/{uuid:uuid}",
+			"0b8a2f2e-1d3c-4f4e-9a7b-2c6d8e0f1a3b"},
+		{"/items/abc", "/items/{name:[a-z]{2,4}}", "abc"},
+		{"/items/export", "/items/export", ""},
+		{"/items/abcdef", "/items/*", "abcdef"},
+		{"/items/", "/items/*", ""},
+		{"/api/v2/status", "/api/v{version:uint}/status", "2"},
+		{"/api/vx/status", "", ""},
+	}
+	for _, c := range cases {
+		p, ps := pm.LookupRoute("GET", c.path)
+		got := ""
+		if p != nil {
+			got = p.OpenAPIPath
+		}
+		if got != c.want {
+			t.Errorf("%s: want %q, got %q", c.path, c.want, got)
+			continue
+		}
+		v := ""
+		if len(ps) > 0 {
+			v = ps[0].Value
+		}
+		if v != c.param {
+			t.Errorf("%s: want param %q, got %q", c.path, c.param, v)
+		}
+	}
+}
+
+func Test_ValidatePathConstraints(t *testing.T) {
+	cases := []struct {
+		path  string
+		valid bool
+	}{
+		{"/items/{id:int}", true},
+		{"/items/{id:uuid}.json", true},
+		{"/items/{code:[0-9]{3}}", true},
+		{"/items/{code:[0-9}", false},
+		{"/items/{id:}", false},
+		{"/items/{:int}", false},
+		{"/items/{id:(}", false},
+		{"/files/{path*:int}", false},
+	}
+	for _, c := range cases {
+		err := ValidatePath(c.path)
+		if (err == nil) != c.valid {
+			t.Errorf("%q: want valid %t, got %v", c.path, c.valid, err)
+		}
+	}
+}
+
+func Test_FindConflicts(t *testing.T) {
+	errs := FindConflicts([]Route{
+		{Method: "GET", Path: "/items/{id}"},
+		{Method: "GET", Path: "/items/{name}"},
+		{Method: "POST", Path: "/items/{name}"},
+		{Method: "GET", Path: "/items/{id:int}"},
+		{Method: "GET", Path: "/items/{n:[0-9]+}"},
+		{Method: "GET", Path: "/items/{n:uint}"},
+		{Method: "GET", Path: "/items/{id}.json"},
+		{Method: "GET", Path: "/items/{id}", Precedence: 1},
+		{Method: "GET", Path: "/items/{bad"},
+	})
+	// {name} vs {id}, {n:uint} vs {n:[0-9]+}, and the bad path
+	if len(errs) != 3 {
+		t.Errorf("want 3 errors, got %d: %v", len(errs), errs)
+	}
+}
+
+func Test_SharedPathMatcherAbort(t *testing.T) {
+	spm := NewSharedPathMatcher(NewPathMatcher())
+	cs := spm.StartChangeSet()
+	cs.AddRoute("GET", "/items/{id}")
+	cs.Commit()
+
+	cs = spm.StartChangeSet()
+	cs.RemoveAll()
+	cs.AddRoute("GET", "/other")
+	cs.Abort()
+	// aborting twice, or after committing, does nothing
+	cs.Abort()
+	cs.Commit()
+
+	if p, _ := spm.LookupRoute("GET", "/items/1"); p == nil {
+		t.Errorf("want the previous routes after aborting")
+	}
+	if p, _ := spm.LookupRoute("GET", "/other"); p != nil {
+		t.Errorf("want no aborted routes, got %#v", p)
+	}
+
+	// the lock has been released
+	cs = spm.StartChangeSet()
+	cs.AddRoute("GET", "/other")
+	cs.Commit()
+	if p, _ := spm.LookupRoute("GET", "/other"); p == nil {
+		t.Errorf("want the new route")
+	}
+	if p, _ := spm.LookupRoute("GET", "/items/1"); p == nil {
+		t.Errorf("want the previous routes to be kept")
+	}
+}
+
+func Test_SharedPathMatcherConcurrentUpdates(t *testing.T) {
+	spm := NewSharedPathMatcher(NewPathMatcher())
+	cs := spm.StartChangeSet()
+	cs.AddRoute("GET", "/items/{id}")
+	cs.Commit()
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if p, _ := spm.LookupRoute("GET", "/items/1"); p == nil {
+					t.Errorf("want /items/{id} to always match")
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 50; i++ {
+		cs := spm.StartChangeSet()
+		if i%2 == 0 {
+			cs.AddRoute("GET", "/other")
+		} else {
+			cs.RemoveRoute("GET", "/other")
+		}
+		cs.Commit()
+	}
+	close(done)
+	wg.Wait()
+}
+
+func Test_SharedPathMatcherCommitError(t *testing.T) {
+	spm := NewSharedPathMatcher(NewPathMatcher())
+	cs := spm.StartChangeSet()
+	cs.AddRoute("GET", "/items/{id}")
+	if err := cs.Commit(); err != nil {
+		t.Fatalf("unexpected error %s", err.Error())
+	}
+
+	cs = spm.StartChangeSet()
+	cs.RemoveAll()
+	cs.AddRoute("GET", "/other")
+	cs.AddRoute("GET", "/items/{id")
+	cs.AddRoute("POST", "/files/{path*}/meta")
+	err := cs.Commit()
+	be, ok := err.(*BuildError)
+	if !ok {
+		t.Fatalf("want a BuildError, got %v", err)
+	}
+	if len(be.Routes) != 2 || be.Routes[0].Path != "/items/{id" ||
+		be.Routes[1].Path != "/files/{path*}/meta" {
+		t.Errorf("unexpected failed routes %v", be)
+	}
+
+	// the previous routes are kept
+	if p, _ := spm.LookupRoute("GET", "/items/1"); p == nil {
+		t.Errorf("want the previous routes after a failed commit")
+	}
+	if p, _ := spm.LookupRoute("GET", "/other"); p != nil {
+		t.Errorf("want no routes from the failed commit, got %#v", p)
+	}
+
+	// and the lock has been released
+	cs = spm.StartChangeSet()
+	cs.AddRoute("GET", "/other")
+	if err := cs.Commit(); err != nil {
+		t.Errorf("unexpected error %s", err.Error())
+	}
+}
+
+func Test_RouteMatchContext(t *testing.T) {
+	pm := NewPathMatcher()
+	pm.AddRouteDef(Route{Method: "GET", Path: "/api/billing/{id}",
+		Upstream: "billing"})
+	if err := pm.Build(); err != nil {
+		t.Fatalf("unexpected error %s", err.Error())
+	}
+
+	req := httptest.NewRequest("GET", "/api/billing/42", nil)
+	if p, _ := GetRouteMatch(req); p != nil {
+		t.Errorf("unexpected route match %#v", p)
+	}
+	p, ps := pm.LookupRequest(req)
+	if p == nil || p.Upstream != "billing" {
+		t.Fatalf("want route with billing upstream, got %#v", p)
+	}
+	req = WithRouteMatch(req, p, ps)
+	got, gotParams := GetRouteMatch(req)
+	if got != p || gotParams.Get("id") != "42" {
+		t.Errorf("unexpected route match %#v %#v", got, gotParams)
+	}
+}
@@ -0,0 +1,163 @@
+package pathmatcher
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/go-openapi/runtime/middleware/denco"
+)
+
+// routeGroup holds the routes that have the same shape in the
+// router, sorted from the most to the least specific, as the first
+// one that matches the params constraints is selected.
+type routeGroup struct {
+	routes []*PathMatched
+}
+
+// methodRouter holds the routers for the routes of a method
+//
+// The fallback router only has the routes without params checks,
+// and is used when the routes found in the main router do not
+// pass them (so, for example, a prefix route can be found when
+// a route with the same shape but a constrained param fails).
+type methodRouter struct {
+	router   *denco.Router
+	fallback *denco.Router
+}
+
+// newMethodRouter builds the routers for a list of routes, or
+// returns nil if there are no routes. It also returns the errors
+// for the routes that can not be built.
+func newMethodRouter(routes []*PathMatched) (*methodRouter, []*RouteError) {
+	var failed []*RouteError
+	valid := make([]*PathMatched, 0, len(routes))
+	unguarded := make([]*PathMatched, 0, len(routes))
+	for _, r := range routes {
+		if r.parseErr != nil {
+			failed = append(failed, &RouteError{
+				Method: r.Method, Path: r.OpenAPIPath, Err: r.parseErr})
+			continue
+		}
+		valid = append(valid, r)
+		if !r.guarded() {
+			unguarded = append(unguarded, r)
+		}
+	}
+	if len(valid) == 0 {
+		return nil, failed
+	}
+	router, err := buildRouter(valid)
+	if err != nil {
+		// the router does not tell which record failed
+		for _, r := range valid {
+			failed = append(failed, &RouteError{
+				Method: r.Method, Path: r.OpenAPIPath, Err: err})
+		}
+		return nil, failed
+	}
+	mr := &methodRouter{router: router}
+	if len(unguarded) < len(valid) && len(unguarded) > 0 {
+		// with the same routes as the main router, it can not fail
+		mr.fallback, _ = buildRouter(unguarded)
+	}
+	return mr, failed
+}
+
+// buildRouter groups the routes by shape and builds a router with
+// them, adding a record for the base path of each prefix route
+// (like `/static/` for `/static/*`), as the denco wildcards need at
+// least one char, unless there is already a route for it.
+func buildRouter(routes []*PathMatched) (*denco.Router, error) {
+	groups := make(map[string]*routeGroup)
+	for _, r := range routes {
+		g, ok := groups[r.shape]
+		if !ok {
+			g = &routeGroup{}
+			groups[r.shape] = g
+		}
+		g.routes = append(g.routes, r)
+	}
+	records := make([]denco.Record, 0, len(groups))
+	bases := make(map[string]*routeGroup)
+	for shape, g := range groups {
+		sortGroupRoutes(g.routes)
+		records = append(records, denco.NewRecord(shape, g))
+		for _, r := range g.routes {
+			if r.Kind != RoutePrefix {
+				continue
+			}
+			base := shape[:strings.LastIndexByte(shape, '*')]
+			if _, ok := groups[base]; ok {
+				continue
+			}
+			if _, ok := bases[base]; !ok {
+				bases[base] = &routeGroup{}
+			}
+			bases[base].routes = append(bases[base].routes, r)
+		}
+	}
+	for base, g := range bases {
+		records = append(records, denco.NewRecord(base, g))
+	}
+	router := denco.New()
+	if err := router.Build(records); err != nil {
+		return nil, err
+	}
+	return router, nil
+}
+
+// sortGroupRoutes puts first the routes with more checked params,
+// and then the ones with more static text around the params.
+func sortGroupRoutes(routes []*PathMatched) {
+	score := func(r *PathMatched) (int, int) {
+		checked, static := 0, 0
+		for idx := range r.params {
+			pd := &r.params[idx]
+			if pd.guarded() {
+				checked++
+			}
+			static += len(pd.prefix) + len(pd.suffix)
+		}
+		return checked, static
+	}
+	sort.SliceStable(routes, func(i, j int) bool {
+		ci, si := score(routes[i])
+		cj, sj := score(routes[j])
+		if ci != cj {
+			return ci > cj
+		}
+		if si != sj {
+			return si > sj
+		}
+		return routes[i].OpenAPIPath < routes[j].OpenAPIPath
+	})
+}
+
+// lookup finds the route for a path in the main router, and if
+// its params checks fail, in the fallback router
+func (mr *methodRouter) lookup(pathWithParams string) (*PathMatched, Params) {
+	if p, ps := lookupGroup(mr.router, pathWithParams); p != nil {
+		return p, ps
+	}
+	if mr.fallback != nil {
+		return lookupGroup(mr.fallback, pathWithParams)
+	}
+	return nil, nil
+}
+
+func lookupGroup(r *denco.Router, pathWithParams string) (*PathMatched, Params) {
+	res, dps, found := r.Lookup(pathWithParams)
+	if !found {
+		return nil, nil
+	}
+	g, ok := res.(*routeGroup)
+	if !ok {
+		return nil, nil
+	}
+	for _, p := range g.routes {
+		if ps, ok := p.matchParams(dps); ok {
+			return p, ps
+		}
+	}
+	return nil, nil
+}
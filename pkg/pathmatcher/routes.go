@@ -0,0 +1,309 @@
+package pathmatcher
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// AnyMethod is the method of the routes that match any method
+// (it can also be written as `ANY` when adding a route)
+const AnyMethod string = "*"
+
+// RouteKind tells the kind of rule a route path defines
+type RouteKind int
+
+const (
+	// RouteExact matches a single path, like `/items`
+	RouteExact RouteKind = iota
+	// RouteParams matches paths with params, like `/items/{id}`
+	RouteParams
+	// RouteCatchAll has a last param that matches one or more
+	// segments, like `/files/{path*}`
+	RouteCatchAll
+	// RoutePrefix matches the path before the `*` and all the paths
+	// under it, like `/static/*`
+	RoutePrefix
+)
+
+// String returns the name of the route kind
+func (rk RouteKind) String() string {
+	switch rk {
+	case RouteExact:
+		return "exact"
+	case RouteParams:
+		return "params"
+	case RouteCatchAll:
+		return "catchall"
+	case RoutePrefix:
+		return "prefix"
+	}
+	return "unknown"
+}
+
+// PrefixParam is the name of the param with the part of the path
+// matched by the `*` of a prefix route
+const PrefixParam string = "*"
+
+// Route defines a rule to match requests:
+//
+//   - Method: the http method, or `*` / `ANY` to match any method.
+//   - Path: the path pattern, that can be an exact path, have params
+//     (`/items/{id}`), end with a catch-all param (`/files/{path*}`)
+//     or be a prefix (`/static/*`). Params can have a type or regex
+//     constraint (`{id:int}`, `{id:uuid}`, `{name:[a-z]+}`), and
+//     static text before or after them in the segment (`{id}.json`).
+//   - Conditions: the host and headers the request must have.
+//   - Precedence: when several routes match a request, the ones with
+//     higher precedence win. For the same precedence, exact segments
+//     win over params, and params over catch-alls and prefixes, and
+//     the routes for a method win over the ones for any method.
+//   - Upstream: the name of the upstream service the requests that
+//     match the route are sent to (empty for the default one). It
+//     does not change how the route is matched.
+type Route struct {
+	Method     string
+	Path       string
+	Conditions RouteConditions
+	Precedence int
+	Upstream   string
+}
+
+// constraintPatterns are the named param constraints
+var constraintPatterns = map[string]string{
+	"int":  `-?[0-9]+`,
+	"uint": `[0-9]+`,
+	"uuid": `[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`,
+}
+
+// paramDef is a path param, with the static text around it in
+// its segment, and its constraint (if any)
+type paramDef struct {
+	name       string
+	prefix     string
+	suffix     string
+	constraint string
+	re         *regexp.Regexp
+}
+
+// guarded returns true if the param has to be checked after
+// the router lookup
+func (pd *paramDef) guarded() bool {
+	return len(pd.prefix) > 0 || len(pd.suffix) > 0 || pd.re != nil
+}
+
+// match checks a value found by the router, returning the value
+// without the static prefix and suffix
+func (pd *paramDef) match(value string) (string, bool) {
+	if len(value) <= len(pd.prefix)+len(pd.suffix) ||
+		!strings.HasPrefix(value, pd.prefix) ||
+		!strings.HasSuffix(value, pd.suffix) {
+		return "", false
+	}
+	value = value[len(pd.prefix) : len(value)-len(pd.suffix)]
+	if pd.re != nil && !pd.re.MatchString(value) {
+		return "", false
+	}
+	return value, true
+}
+
+// parsedPath is a path pattern converted to the router format:
+//
+//   - routerPath: the denco path, with the param names
+//   - shape: the denco path with positional param names, that is
+//     the same for paths that only differ in the param names,
+//     constraints, or static text around the params.
+type parsedPath struct {
+	kind       RouteKind
+	routerPath string
+	shape      string
+	params     []paramDef
+}
+
+// routeMethod returns the method in upper case, converting `ANY`
+// to the AnyMethod
+func routeMethod(method string) string {
+	mn := strings.ToUpper(method)
+	if mn == "ANY" {
+		return AnyMethod
+	}
+	return mn
+}
+
+// parsePath converts a path pattern to the denco router format
+func parsePath(path string) (*parsedPath, error) {
+	if path == "*" {
+		path = "/*"
+	}
+	if !strings.HasPrefix(path, "/") {
+		return nil, fmt.Errorf("path %q must start with /", path)
+	}
+	pp := &parsedPath{kind: RouteExact}
+	var routerPath, shape strings.Builder
+	segments := strings.Split(path[1:], "/")
+	for idx, seg := range segments {
+		last := idx == len(segments)-1
+		routerPath.WriteString("/")
+		shape.WriteString("/")
+		if !strings.ContainsAny(seg, "{}*") {
+			routerPath.WriteString(seg)
+			shape.WriteString(seg)
+			continue
+		}
+		posName := fmt.Sprintf("p%d", len(pp.params))
+		if seg == "*" {
+			if !last {
+				return nil, fmt.Errorf("path %q: wildcards are only allowed as the last segment", path)
+			}
+			pp.kind = RoutePrefix
+			pp.params = append(pp.params, paramDef{name: PrefixParam})
+			routerPath.WriteString("*")
+			shape.WriteString("*" + posName)
+			continue
+		}
+		pd, err := parseParamSegment(seg)
+		if err != nil {
+			return nil, fmt.Errorf("path %q: %s", path, err.Error())
+		}
+		if strings.HasSuffix(pd.name, "*") {
+			if !last || pd.guarded() {
+				return nil, fmt.Errorf("path %q: catch-all params are only allowed as a whole last segment", path)
+			}
+			pd.name = strings.TrimSuffix(pd.name, "*")
+			pp.kind = RouteCatchAll
+			pp.params = append(pp.params, *pd)
+			routerPath.WriteString("*" + pd.name)
+			shape.WriteString("*" + posName)
+			continue
+		}
+		if pp.kind == RouteExact {
+			pp.kind = RouteParams
+		}
+		pp.params = append(pp.params, *pd)
+		routerPath.WriteString(":" + pd.name)
+		shape.WriteString(":" + posName)
+	}
+	pp.routerPath = routerPath.String()
+	pp.shape = shape.String()
+	return pp, nil
+}
+
+// parseParamSegment parses a segment with a param, like `{id}`,
+// `{id:int}.json` or `v{version:[0-9]{1,2}}`
+func parseParamSegment(seg string) (*paramDef, error) {
+	open := strings.IndexByte(seg, '{')
+	if open < 0 {
+		return nil, fmt.Errorf("bad param in segment %q", seg)
+	}
+	// the regex constraints can have braces too
+	depth := 0
+	closing := -1
+	for idx := open; idx < len(seg) && closing < 0; idx++ {
+		switch seg[idx] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				closing = idx
+			}
+		}
+	}
+	if closing < 0 {
+		return nil, fmt.Errorf("bad param in segment %q", seg)
+	}
+	pd := &paramDef{
+		prefix: seg[:open],
+		suffix: seg[closing+1:],
+	}
+	if strings.ContainsAny(pd.prefix, "{}*") || strings.ContainsAny(pd.suffix, "{}*") {
+		return nil, fmt.Errorf("only one param allowed in segment %q", seg)
+	}
+	inner := seg[open+1 : closing]
+	pd.name = inner
+	if sep := strings.IndexByte(inner, ':'); sep >= 0 {
+		pd.name = inner[:sep]
+		pd.constraint = inner[sep+1:]
+		if len(pd.constraint) == 0 {
+			return nil, fmt.Errorf("empty constraint in segment %q", seg)
+		}
+		pattern, ok := constraintPatterns[pd.constraint]
+		if !ok {
+			pattern = pd.constraint
+		}
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("bad constraint in segment %q: %s", seg, err.Error())
+		}
+		pd.re = re
+	}
+	if len(strings.TrimSuffix(pd.name, "*")) == 0 ||
+		strings.ContainsAny(strings.TrimSuffix(pd.name, "*"), "*:") {
+		return nil, fmt.Errorf("bad param name in segment %q", seg)
+	}
+	return pd, nil
+}
+
+// ValidatePath checks that a path pattern can be used to build
+// a route: it must start with `/`, params must be well formed, with
+// valid constraints, and prefixes and catch-all params can only be
+// in the last segment.
+func ValidatePath(path string) error {
+	_, err := parsePath(path)
+	return err
+}
+
+// PathParamNames returns the names of the params of a path pattern
+func PathParamNames(path string) []string {
+	pp, err := parsePath(path)
+	if err != nil {
+		return nil
+	}
+	names := make([]string, 0, len(pp.params))
+	for _, pd := range pp.params {
+		names = append(names, pd.name)
+	}
+	return names
+}
+
+// FindConflicts returns an error for each pair of routes that can
+// not be told apart: routes for the same method, conditions and
+// precedence, with paths that only differ in the param names (like
+// `/items/{id}` and `/items/{name}`), so only one of them would ever
+// match. It also returns an error for each path that can not be
+// parsed.
+func FindConflicts(routes []Route) []error {
+	var errs []error
+	seen := make(map[string]string, len(routes))
+	for _, r := range routes {
+		pm := NewRoutePathMatched(r)
+		if pm.parseErr != nil {
+			errs = append(errs, pm.parseErr)
+			continue
+		}
+		var sig strings.Builder
+		sig.WriteString(scopeKey(pm))
+		sig.WriteString(" ")
+		sig.WriteString(pm.Method)
+		sig.WriteString(" ")
+		sig.WriteString(pm.shape)
+		for idx := range pm.params {
+			pd := &pm.params[idx]
+			constraint := pd.constraint
+			if pattern, ok := constraintPatterns[constraint]; ok {
+				constraint = pattern
+			}
+			fmt.Fprintf(&sig, "|%q,%q,%q", pd.prefix, pd.suffix, constraint)
+		}
+		key := sig.String()
+		if other, ok := seen[key]; ok {
+			if other != r.Path {
+				errs = append(errs, fmt.Errorf("%s paths %q and %q conflict",
+					pm.Method, other, r.Path))
+			}
+			continue
+		}
+		seen[key] = r.Path
+	}
+	return errs
+}
@@ -1,39 +1,64 @@
 package pathmatcher
 
 import (
+	"net/http"
 	"sync"
-
-	"github.com/go-openapi/runtime/middleware/denco"
+	"sync/atomic"
 )
 
+// SharedPathMatcher is a PathMatcher that can be updated while it
+// is being used.
+//
+// Lookups are done without locks on an immutable snapshot of the
+// matcher. The updates are done with a ChangeSet, that works on a
+// copy of the current snapshot, and replaces it atomically when it
+// is committed.
 type SharedPathMatcher struct {
-	matcher       *PathMatcher
-	recordsAccess sync.RWMutex
-	routerAccess  sync.RWMutex
+	snapshot atomic.Value // *PathMatcher
+	changes  sync.Mutex
 }
 
+// ChangeSet holds a copy of the routes of a SharedPathMatcher to
+// be modified. Only one ChangeSet can be open at a time, so it must
+// be finished with Commit or Abort (that does nothing if it has
+// already been committed, so it can be deferred).
 type ChangeSet struct {
 	finished bool
 	spm      *SharedPathMatcher
+	matcher  *PathMatcher
 }
 
+// NewSharedPathMatcher creates a SharedPathMatcher with the routes
+// of a built matcher, that must not be modified afterwards.
 func NewSharedPathMatcher(matcher *PathMatcher) *SharedPathMatcher {
-	return &SharedPathMatcher{
-		matcher: matcher,
-	}
+	spm := &SharedPathMatcher{}
+	spm.snapshot.Store(matcher)
+	return spm
+}
+
+// current returns the current snapshot
+func (spm *SharedPathMatcher) current() *PathMatcher {
+	return spm.snapshot.Load().(*PathMatcher)
 }
 
-func (spm *SharedPathMatcher) LookupRoute(method, pathWithParams string) *PathMatched {
-	spm.routerAccess.RLock()
-	defer spm.routerAccess.RUnlock()
-	return spm.matcher.LookupRoute(method, pathWithParams)
+func (spm *SharedPathMatcher) LookupRoute(method, pathWithParams string) (*PathMatched, Params) {
+	return spm.current().LookupRoute(method, pathWithParams)
 }
 
+// LookupRequest finds the route for a request, taking into
+// account its host and headers
+func (spm *SharedPathMatcher) LookupRequest(req *http.Request) (*PathMatched, Params) {
+	return spm.current().LookupRequest(req)
+}
+
+// StartChangeSet waits until no other ChangeSet is open, and
+// returns a new one with a copy of the current routes.
 func (spm *SharedPathMatcher) StartChangeSet() *ChangeSet {
-	spm.recordsAccess.Lock()
+	spm.changes.Lock()
 	return &ChangeSet{
 		finished: false,
 		spm:      spm,
+		matcher:  spm.current().clone(),
 	}
 }
 
@@ -41,71 +66,80 @@ func (cs *ChangeSet) AddRoute(method, path string) {
 	if cs.finished {
 		return
 	}
-	pm := NewPathMatched(method, path)
-	byMethod, ok := cs.spm.matcher.records[pm.Method]
-	if ok {
-		// checks that the entry do not exists
-		for _, r := range byMethod {
-			if r.Key == pm.RouterPath {
-				return
-			}
-		}
-	} else {
-		byMethod = make([]denco.Record, 0, 4)
-	}
-	record := denco.NewRecord(pm.RouterPath, pm)
-	byMethod = append(byMethod, record)
-	cs.spm.matcher.records[pm.Method] = byMethod
+	cs.matcher.AddRoute(method, path)
 }
 
-func (cs *ChangeSet) RemoveRoute(method, path string) {
+// AddRouteWithConditions adds a route that only matches the
+// requests that meet the conditions
+func (cs *ChangeSet) AddRouteWithConditions(method, path string,
+	conds RouteConditions) {
 	if cs.finished {
 		return
 	}
-	// by creating a new path matches  we make sure
-	// method is upper case, and we have a path in
-	// the router format (the one that is stored in r.Key)
-	pm := NewPathMatched(method, path)
-	byMethod, ok := cs.spm.matcher.records[pm.Method]
-	if !ok {
+	cs.matcher.AddRouteWithConditions(method, path, conds)
+}
+
+// AddRouteDef adds a route definition
+func (cs *ChangeSet) AddRouteDef(r Route) {
+	if cs.finished {
 		return
 	}
+	cs.matcher.AddRouteDef(r)
+}
 
-	for idx, r := range byMethod {
-		if r.Key == pm.RouterPath {
-			if idx < len(byMethod)-1 {
-				// denco router, does not care about order of records
-				// https://github.com/naoina/denco#url-pattern
-				// so we can swap last record with found one
-				byMethod[idx] = byMethod[len(byMethod)-1]
-			}
-			// just shorten the slice
-			cs.spm.matcher.records[pm.Method] = byMethod[:len(byMethod)-1]
-		}
+func (cs *ChangeSet) RemoveRoute(method, path string) {
+	cs.RemoveRouteDef(Route{Method: method, Path: path})
+}
+
+// RemoveRouteWithConditions removes a route that was added with
+// some conditions
+func (cs *ChangeSet) RemoveRouteWithConditions(method, path string,
+	conds RouteConditions) {
+	cs.RemoveRouteDef(Route{Method: method, Path: path, Conditions: conds})
+}
+
+// RemoveRouteDef removes a route definition
+func (cs *ChangeSet) RemoveRouteDef(r Route) {
+	if cs.finished {
+		return
 	}
+	// by creating a new path matches  we make sure
+	// method is upper case, and the path is the same
+	// as the one that was stored
+	cs.matcher.removeRoute(NewRoutePathMatched(r))
 }
 
 func (cs *ChangeSet) RemoveAll() {
 	if cs.finished {
 		return
 	}
-	// clean the underlying dengo record by reseting all the slices
-	// but  maintaining their capacities
-	for k, _ := range cs.spm.matcher.records {
-		if len(cs.spm.matcher.records[k]) > 0 {
-			cs.spm.matcher.records[k] = cs.spm.matcher.records[k][:0]
-		}
+	cs.matcher.removeAll()
+}
+
+// Commit builds the routers for the modified routes, and replaces
+// the current snapshot with them. If some routes can not be built,
+// it returns a BuildError with them, and the current snapshot is
+// kept, as if the ChangeSet was aborted.
+func (cs *ChangeSet) Commit() error {
+	if cs.finished {
+		return nil
+	}
+	cs.finished = true
+	defer cs.spm.changes.Unlock()
+	err := cs.matcher.Build()
+	if err == nil {
+		cs.spm.snapshot.Store(cs.matcher)
 	}
+	cs.matcher = nil
+	return err
 }
 
-func (cs *ChangeSet) Commit() {
+// Abort discards the changes, keeping the current snapshot.
+func (cs *ChangeSet) Abort() {
 	if cs.finished {
 		return
 	}
 	cs.finished = true
-	newRouters := cs.spm.matcher.buildRouter(cs.spm.matcher.records)
-	cs.spm.routerAccess.Lock()
-	cs.spm.matcher.routers = newRouters
-	cs.spm.routerAccess.Unlock()
-	cs.spm.recordsAccess.Unlock()
+	cs.matcher = nil
+	cs.spm.changes.Unlock()
 }
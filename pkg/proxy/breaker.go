@@ -0,0 +1,206 @@
+package proxy
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CircuitBreaker defines when the circuit of an upstream opens, so
+// it does not receive requests for some time:
+//
+//   - FailureRatio: the ratio of failed requests in the window that
+//     opens the circuit (0 disables the circuit breaker).
+//   - MinRequests: the requests in the window required to open the
+//     circuit, so a few failures with low traffic do not open it.
+//   - Window: the time window where the requests are counted.
+//   - OpenFor: how long the circuit is open. After that, it is half
+//     open, and the upstream receives up to HalfOpenRequests at a
+//     time to probe it: the circuit closes with the first success, and
+//     opens again with the first failure.
+//
+// A request fails as for the PassiveEjection.
+type CircuitBreaker struct {
+	FailureRatio     float64
+	MinRequests      int
+	Window           time.Duration
+	OpenFor          time.Duration
+	HalfOpenRequests int
+}
+
+const (
+	circuitClosed int32 = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// breaker holds the state of the circuit of an upstream. The state
+// can be read without locks when picking an upstream.
+//
+// The probes word has the half open period (incremented each time
+// the circuit becomes half open) in its high 32 bits, and the probes
+// in flight in that period in its low 32 bits, so a probe slot is
+// taken and given back with a single compare and swap, and the
+// probes of a previous period can not give back a slot of the
+// current one.
+type breaker struct {
+	conf CircuitBreaker
+
+	state     int32
+	openUntil int64 // unix nanoseconds
+	probes    uint64
+
+	mu          sync.Mutex // protects the window counters
+	windowStart time.Time
+	requests    int
+	failures    int
+}
+
+func newBreaker(conf CircuitBreaker) *breaker {
+	if conf.HalfOpenRequests < 1 {
+		conf.HalfOpenRequests = 1
+	}
+	return &breaker{
+		conf: conf,
+	}
+}
+
+// probesMask selects the probes in flight from the probes word
+const probesMask uint64 = 1<<32 - 1
+
+// available returns true if the circuit lets the requests pass. It
+// does not take a probe slot (see start).
+func (b *breaker) available(now time.Time) bool {
+	switch atomic.LoadInt32(&b.state) {
+	case circuitOpen:
+		if now.UnixNano() < atomic.LoadInt64(&b.openUntil) {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&b.state, circuitOpen, circuitHalfOpen) {
+			b.newHalfOpenPeriod()
+		}
+		return b.hasProbeSlot()
+	case circuitHalfOpen:
+		return b.hasProbeSlot()
+	}
+	return true
+}
+
+// newHalfOpenPeriod starts a period without probes in flight
+func (b *breaker) newHalfOpenPeriod() {
+	for {
+		old := atomic.LoadUint64(&b.probes)
+		if atomic.CompareAndSwapUint64(&b.probes, old, (old>>32+1)<<32) {
+			return
+		}
+	}
+}
+
+func (b *breaker) hasProbeSlot() bool {
+	return atomic.LoadUint64(&b.probes)&probesMask < uint64(b.conf.HalfOpenRequests)
+}
+
+// start is called before sending a request. While the circuit is
+// half open, it takes a probe slot, and returns false if there are
+// none left. The returned function gives the slot back, so if the
+// probe ends without a result (like when the client is gone), the
+// next request can probe the upstream.
+func (b *breaker) start() (func(), bool) {
+	if atomic.LoadInt32(&b.state) != circuitHalfOpen {
+		return func() {}, true
+	}
+	for {
+		old := atomic.LoadUint64(&b.probes)
+		if old&probesMask >= uint64(b.conf.HalfOpenRequests) {
+			return nil, false
+		}
+		if atomic.CompareAndSwapUint64(&b.probes, old, old+1) {
+			return func() { b.endProbe(old >> 32) }, true
+		}
+	}
+}
+
+// endProbe gives back a probe slot, if its half open period has
+// not ended
+func (b *breaker) endProbe(period uint64) {
+	for {
+		old := atomic.LoadUint64(&b.probes)
+		if old>>32 != period || old&probesMask == 0 {
+			return
+		}
+		if atomic.CompareAndSwapUint64(&b.probes, old, old-1) {
+			return
+		}
+	}
+}
+
+// observe records the result of a request, and returns true
+// if it opened the circuit
+func (b *breaker) observe(failed bool, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch atomic.LoadInt32(&b.state) {
+	case circuitHalfOpen:
+		if failed {
+			b.open(now)
+			return true
+		}
+		b.resetWindow(now)
+		atomic.StoreInt32(&b.state, circuitClosed)
+		return false
+	case circuitOpen:
+		// the requests sent before the circuit opened
+		return false
+	}
+	if now.Sub(b.windowStart) >= b.conf.Window {
+		b.resetWindow(now)
+	}
+	b.requests++
+	if failed {
+		b.failures++
+	}
+	if b.requests >= b.conf.MinRequests &&
+		float64(b.failures) >= b.conf.FailureRatio*float64(b.requests) &&
+		b.failures > 0 {
+		b.open(now)
+		return true
+	}
+	return false
+}
+
+func (b *breaker) open(now time.Time) {
+	atomic.StoreInt64(&b.openUntil, now.Add(b.conf.OpenFor).UnixNano())
+	atomic.StoreInt32(&b.state, circuitOpen)
+}
+
+func (b *breaker) resetWindow(now time.Time) {
+	b.windowStart = now
+	b.requests = 0
+	b.failures = 0
+}
+
+// SetCircuitBreaker sets the circuit breaker of each upstream
+// of the pool
+func (up *UpstreamPool) SetCircuitBreaker(cb CircuitBreaker) {
+	for _, u := range up.upstreams {
+		if cb.FailureRatio <= 0 {
+			u.breaker = nil
+			continue
+		}
+		u.breaker = newBreaker(cb)
+	}
+}
+
+// observeBreaker records the result of a request in the circuit
+// breaker of the upstream
+func (up *UpstreamPool) observeBreaker(u *Upstream, failed bool) {
+	if u.breaker == nil {
+		return
+	}
+	if u.breaker.observe(failed, time.Now()) {
+		// TODO: change this for a log
+		fmt.Printf("upstream %s circuit open for %s\n", u.String(),
+			u.breaker.conf.OpenFor)
+	}
+}
@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func Test_CircuitBreaker(t *testing.T) {
+	ups := newTestUpstreams(1)
+	u := ups[0]
+	up := NewUpstreamPool(ups, RoundRobin)
+	up.SetCircuitBreaker(CircuitBreaker{
+		FailureRatio:     0.5,
+		MinRequests:      4,
+		Window:           time.Minute,
+		OpenFor:          20 * time.Millisecond,
+		HalfOpenRequests: 1,
+	})
+
+	up.observe(u, http.StatusOK, nil)
+	up.observe(u, 0, errors.New("connection refused"))
+	up.observe(u, http.StatusOK, nil)
+	if !u.Available() {
+		t.Fatalf("the circuit must not open before MinRequests")
+	}
+	up.observe(u, http.StatusBadGateway, nil)
+	if u.Available() {
+		t.Fatalf("the circuit should be open")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if !u.Available() {
+		t.Fatalf("the circuit should be half open")
+	}
+	release, ok := up.acquire(u)
+	if !ok || u.Available() {
+		t.Errorf("only one probe can be sent while half open")
+	}
+	if _, ok := up.acquire(u); ok {
+		t.Errorf("a second probe can not be acquired while half open")
+	}
+	up.observe(u, http.StatusServiceUnavailable, nil)
+	release()
+	if u.Available() {
+		t.Fatalf("a failed probe should open the circuit again")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	release, _ = up.acquire(up.Pick(newKeyRequest("k")))
+	up.observe(u, http.StatusOK, nil)
+	release()
+	for idx := 0; idx < 3; idx++ {
+		if !u.Available() {
+			t.Fatalf("a successful probe should close the circuit")
+		}
+		up.acquire(u)
+	}
+}
+
+func Test_CircuitBreakerCancelledProbe(t *testing.T) {
+	ups := newTestUpstreams(1)
+	u := ups[0]
+	up := NewUpstreamPool(ups, RoundRobin)
+	up.SetCircuitBreaker(CircuitBreaker{
+		FailureRatio:     0.5,
+		MinRequests:      1,
+		Window:           time.Minute,
+		OpenFor:          20 * time.Millisecond,
+		HalfOpenRequests: 1,
+	})
+
+	up.observe(u, http.StatusBadGateway, nil)
+	time.Sleep(30 * time.Millisecond)
+	sel, release := up.pickAndAcquire(newKeyRequest("k"))
+	if sel != u {
+		t.Fatalf("the circuit should be half open")
+	}
+	if sel, _ := up.pickAndAcquire(newKeyRequest("k")); sel != nil {
+		t.Errorf("only one probe can be sent while half open")
+	}
+	// the client of the probe is gone, and the result is not observed
+	release()
+	if sel, _ := up.pickAndAcquire(newKeyRequest("k")); sel != u {
+		t.Fatalf("a cancelled probe should let the next request probe")
+	}
+
+	// a probe of a previous half open period does not free a slot
+	up.observe(u, http.StatusBadGateway, nil)
+	time.Sleep(30 * time.Millisecond)
+	if sel, _ := up.pickAndAcquire(newKeyRequest("k")); sel != u {
+		t.Fatalf("the circuit should be half open again")
+	}
+	release()
+	if u.Available() {
+		t.Errorf("a stale probe must not free a slot of a new half open period")
+	}
+}
@@ -4,6 +4,9 @@ import (
 	"net/http"
 )
 
+// DupResponseWriter writes the response to two response writers,
+// like the client one and a recorder. The errors writing to the
+// second one are ignored.
 type DupResponseWriter struct {
 	headers           http.Header
 	arw               http.ResponseWriter
@@ -47,6 +50,26 @@ func (drw *DupResponseWriter) WriteHeader(statusCode int) {
 	drw.brw.WriteHeader(statusCode)
 }
 
+// Flush sends any buffered data to the first writer, if it
+// supports it, so the streaming responses are not delayed
+func (drw *DupResponseWriter) Flush() {
+	if !drw.writeHeaderCalled {
+		drw.WriteHeader(http.StatusOK)
+	}
+	if f, ok := drw.arw.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Finish copies the headers set after the response has been written
+// (the trailers) to both writers. It must be called once the handler
+// has written the whole response.
+func (drw *DupResponseWriter) Finish() {
+	if drw.writeHeaderCalled {
+		drw.setHeaders()
+	}
+}
+
 func (drw *DupResponseWriter) setHeaders() {
 	aH := drw.arw.Header()
 	bH := drw.brw.Header()
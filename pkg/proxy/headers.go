@@ -0,0 +1,191 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// hopHeaders are the hop-by-hop headers (RFC 7230, section 6.1),
+// that are meaningful only for a single connection, so they are
+// not forwarded.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection", // non-standard but still sent by some clients
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te", // canonicalized version of "TE"
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopByHopHeaders removes the hop-by-hop headers, and the
+// ones listed in the Connection header
+func removeHopByHopHeaders(h http.Header) {
+	for _, f := range h["Connection"] {
+		for _, sf := range strings.Split(f, ",") {
+			if sf = strings.TrimSpace(sf); sf != "" {
+				h.Del(sf)
+			}
+		}
+	}
+	for _, hh := range hopHeaders {
+		h.Del(hh)
+	}
+}
+
+// ForwardedHeaders selects the headers that are set in the requests
+// to the upstream to tell it about the client:
+//
+//   - XForwardedFor: append the client address to `X-Forwarded-For`
+//   - XForwardedProto: set `X-Forwarded-Proto` to the client scheme
+//   - XForwardedHost: set `X-Forwarded-Host` to the requested host
+//   - Forwarded: append an element to the `Forwarded` header (RFC 7239)
+//   - TrustedProxies: the networks of the proxies in front of this
+//     one. The forwarding headers received from them are kept (and
+//     appended to), while the ones received from any other client are
+//     discarded, as they could be forged.
+//   - PreserveHost: send the Host requested by the client to the
+//     upstream, instead of the upstream address
+type ForwardedHeaders struct {
+	XForwardedFor   bool
+	XForwardedProto bool
+	XForwardedHost  bool
+	Forwarded       bool
+	TrustedProxies  []*net.IPNet
+	PreserveHost    bool
+}
+
+// forwardingHeaders are the headers that can only be trusted when
+// they are received from a trusted proxy
+var forwardingHeaders = []string{
+	"X-Forwarded-For",
+	"X-Forwarded-Proto",
+	"X-Forwarded-Host",
+	"Forwarded",
+}
+
+// ParseTrustedProxies parses a comma separated list of IPs or
+// networks in CIDR notation (like `10.0.0.0/8,192.168.1.1`)
+func ParseTrustedProxies(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if len(s) == 0 {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("bad trusted proxy %q", s)
+			}
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("bad trusted proxy %q: %s", s, err.Error())
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// trusted returns true if the ip belongs to a trusted proxy
+func (fh *ForwardedHeaders) trusted(ip net.IP) bool {
+	return inNetworks(ip, fh.TrustedProxies)
+}
+
+// FromTrustedProxy returns true if the request was received from
+// one of the trusted proxies networks (see ParseTrustedProxies)
+func FromTrustedProxy(req *http.Request, trustedProxies []*net.IPNet) bool {
+	host := req.RemoteAddr
+	if h, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		host = h
+	}
+	return inNetworks(net.ParseIP(host), trustedProxies)
+}
+
+func inNetworks(ip net.IP, nets []*net.IPNet) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// apply sets the forwarding headers of the request to the upstream
+// (outreq) from the request received from the client (req)
+func (fh *ForwardedHeaders) apply(outreq, req *http.Request) {
+	clientIP := req.RemoteAddr
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		clientIP = host
+	}
+	if !fh.trusted(net.ParseIP(clientIP)) {
+		for _, h := range forwardingHeaders {
+			outreq.Header.Del(h)
+		}
+	}
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+	if fh.XForwardedFor && len(clientIP) > 0 {
+		if prior := outreq.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+			clientIP = strings.Join(prior, ", ") + ", " + clientIP
+		}
+		outreq.Header.Set("X-Forwarded-For", clientIP)
+	}
+	if fh.XForwardedProto && len(outreq.Header.Get("X-Forwarded-Proto")) == 0 {
+		outreq.Header.Set("X-Forwarded-Proto", proto)
+	}
+	if fh.XForwardedHost && len(outreq.Header.Get("X-Forwarded-Host")) == 0 {
+		outreq.Header.Set("X-Forwarded-Host", req.Host)
+	}
+	if fh.Forwarded {
+		outreq.Header.Add("Forwarded", forwardedElement(req, proto))
+	}
+}
+
+// forwardedElement returns the element of the Forwarded header
+// for this hop
+func forwardedElement(req *http.Request, proto string) string {
+	elems := make([]string, 0, 3)
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		if strings.Contains(host, ":") {
+			// IPv6 addresses must be quoted and enclosed in brackets
+			elems = append(elems, fmt.Sprintf("for=\"[%s]\"", host))
+		} else {
+			elems = append(elems, "for="+host)
+		}
+	}
+	if len(req.Host) > 0 {
+		elems = append(elems, fmt.Sprintf("host=%q", req.Host))
+	}
+	elems = append(elems, "proto="+proto)
+	return strings.Join(elems, ";")
+}
+
+// headerValuesContainToken returns true if any of the comma
+// separated values of a header is the token (case insensitive)
+func headerValuesContainToken(values []string, token string) bool {
+	for _, v := range values {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/dhontecillas/dynlimits/pkg/metrics"
+)
+
+// HealthCheck defines the active health checks of the upstreams
+// of a pool:
+//
+//   - Path: the path requested with a GET to each upstream, that
+//     passes the check when it answers with a 2xx status.
+//   - Interval: the time between checks.
+//   - Timeout: how long to wait for the response of a check.
+//   - UnhealthyThreshold: the failed checks in a row to mark a
+//     healthy upstream as unhealthy.
+//   - HealthyThreshold: the passed checks in a row to mark an
+//     unhealthy upstream as healthy.
+//   - Transport: the transport for the checks (nil for the default
+//     one), that should be the one used to forward the requests.
+type HealthCheck struct {
+	Path               string
+	Interval           time.Duration
+	Timeout            time.Duration
+	UnhealthyThreshold int
+	HealthyThreshold   int
+	Transport          http.RoundTripper
+}
+
+// StartHealthChecks launches a goroutine that checks the upstreams
+// of the pool at the interval, until StopHealthChecks is called.
+func (up *UpstreamPool) StartHealthChecks(hc HealthCheck) {
+	if up.stopChecks != nil {
+		return
+	}
+	if hc.UnhealthyThreshold < 1 {
+		hc.UnhealthyThreshold = 1
+	}
+	if hc.HealthyThreshold < 1 {
+		hc.HealthyThreshold = 1
+	}
+	client := &http.Client{
+		Transport: hc.Transport,
+		Timeout:   hc.Timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	stop := make(chan struct{})
+	up.stopChecks = stop
+	go func() {
+		ticker := time.NewTicker(hc.Interval)
+		defer ticker.Stop()
+		for {
+			for _, u := range up.upstreams {
+				up.checkUpstream(client, u, &hc)
+			}
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// StopHealthChecks stops the active health checks
+func (up *UpstreamPool) StopHealthChecks() {
+	if up.stopChecks == nil {
+		return
+	}
+	close(up.stopChecks)
+	up.stopChecks = nil
+}
+
+// checkUpstream requests the health check path to the upstream,
+// and updates its health once the thresholds are reached
+func (up *UpstreamPool) checkUpstream(client *http.Client, u *Upstream,
+	hc *HealthCheck) {
+	passed := false
+	res, err := client.Get(u.String() + hc.Path)
+	if err == nil {
+		io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+		passed = res.StatusCode >= 200 && res.StatusCode < 300
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	unhealthy := atomic.LoadInt32(&u.unhealthy) != 0
+	if passed {
+		u.checkFailed = 0
+		u.checkPassed++
+		if unhealthy && u.checkPassed >= hc.HealthyThreshold {
+			atomic.StoreInt32(&u.unhealthy, 0)
+			metrics.UpstreamHealthy.Set(u.String(), upstreamHealthyValue(1))
+			// TODO: change this for a log
+			fmt.Printf("upstream %s is healthy\n", u.String())
+		}
+		return
+	}
+	u.checkPassed = 0
+	u.checkFailed++
+	if !unhealthy && u.checkFailed >= hc.UnhealthyThreshold {
+		atomic.StoreInt32(&u.unhealthy, 1)
+		metrics.UpstreamHealthy.Set(u.String(), upstreamHealthyValue(0))
+		// TODO: change this for a log
+		fmt.Printf("upstream %s is unhealthy\n", u.String())
+	}
+}
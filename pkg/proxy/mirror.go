@@ -0,0 +1,304 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/dhontecillas/dynlimits/pkg/metrics"
+	"github.com/dhontecillas/dynlimits/pkg/pathmatcher"
+)
+
+// MirrorHeader is set in the requests replayed to the shadow upstream
+const MirrorHeader string = "X-Dynlimits-Mirror"
+
+// Mirror defines which requests are replayed to a shadow upstream,
+// to test a new version of a backend with real traffic:
+//
+//   - Upstream: the shadow upstream.
+//   - Percent: the percentage (0 to 100) of the requests replayed.
+//   - Endpoints: when set, only the requests to these endpoints are
+//     replayed. Each endpoint is a catalog path, optionally preceded
+//     by its method (like `GET /items/{id}`).
+//   - APIKeys: when set, only the requests with these api keys (read
+//     from the APIKeyHeader) are replayed.
+//   - Compare: compare the shadow responses with the primary ones,
+//     instead of discarding them.
+//   - MaxBodyBytes: the requests with larger bodies are not replayed,
+//     and only this part of the responses is compared.
+//   - Timeout: how long to wait for the shadow response (0 for no
+//     timeout).
+//   - MaxInFlight: the replays that can be waiting for the shadow
+//     upstream. When reached, the requests are not replayed.
+type Mirror struct {
+	Upstream     *Upstream
+	Percent      float64
+	Endpoints    []string
+	APIKeys      []string
+	APIKeyHeader string
+	Compare      bool
+	MaxBodyBytes int64
+	Timeout      time.Duration
+	MaxInFlight  int64
+}
+
+// MirrorResult is the result of replaying a request to the shadow
+// upstream. Diff describes how the shadow response differs from the
+// primary one (empty if they match, or if they are not compared).
+type MirrorResult struct {
+	Method string
+	Path   string
+	Status int
+	Diff   string
+	Err    error
+}
+
+// MirrorObserver is notified with the result of each replayed request
+type MirrorObserver interface {
+	ObserveMirror(result MirrorResult)
+}
+
+// MirrorHandler forwards the requests to the next handler, and
+// asynchronously replays a part of them to the shadow upstream once
+// the primary response has been sent. The shadow responses never
+// reach the clients.
+//
+// It uses the route matched by the rate limiter (see
+// pathmatcher.WithRouteMatch) to filter by endpoint. The upgraded
+// connections are not replayed.
+type MirrorHandler struct {
+	next      http.Handler
+	conf      Mirror
+	transport http.RoundTripper
+	endpoints map[string]bool
+	apiKeys   map[string]bool
+	observer  MirrorObserver
+	inFlight  int64
+}
+
+// NewMirrorHandler creates a MirrorHandler that sends the replayed
+// requests with the transport
+func NewMirrorHandler(next http.Handler, conf Mirror,
+	transport http.RoundTripper) *MirrorHandler {
+	mh := &MirrorHandler{
+		next:      next,
+		conf:      conf,
+		transport: transport,
+	}
+	if len(conf.Endpoints) > 0 {
+		mh.endpoints = make(map[string]bool, len(conf.Endpoints))
+		for _, ep := range conf.Endpoints {
+			mh.endpoints[ep] = true
+		}
+	}
+	if len(conf.APIKeys) > 0 {
+		mh.apiKeys = make(map[string]bool, len(conf.APIKeys))
+		for _, k := range conf.APIKeys {
+			mh.apiKeys[k] = true
+		}
+	}
+	return mh
+}
+
+// SetObserver sets an observer to be notified with the results
+// of the replayed requests
+func (mh *MirrorHandler) SetObserver(observer MirrorObserver) {
+	mh.observer = observer
+}
+
+func (mh *MirrorHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if !mh.shouldMirror(req) {
+		mh.next.ServeHTTP(rw, req)
+		return
+	}
+	body, ok := bufferBody(req, mh.conf.MaxBodyBytes)
+	if !ok {
+		mh.next.ServeHTTP(rw, req)
+		return
+	}
+	// the request is cloned before the next handler modifies it
+	shadowReq := mh.shadowRequest(req, body)
+
+	var primary *ResponseWriterRecorder
+	if mh.conf.Compare {
+		primary = NewResponseWriterRecorder(req, nil)
+		primary.MaxData = mh.conf.MaxBodyBytes
+		drw := NewDupResponseWriter(rw, primary)
+		mh.next.ServeHTTP(drw, req)
+		drw.Finish()
+	} else {
+		mh.next.ServeHTTP(rw, req)
+	}
+
+	if atomic.AddInt64(&mh.inFlight, 1) > mh.conf.MaxInFlight &&
+		mh.conf.MaxInFlight > 0 {
+		atomic.AddInt64(&mh.inFlight, -1)
+		metrics.MirroredRequests.Add("dropped", 1)
+		return
+	}
+	go mh.replay(shadowReq, primary)
+}
+
+// shouldMirror selects the requests to replay
+func (mh *MirrorHandler) shouldMirror(req *http.Request) bool {
+	if mh.conf.Upstream == nil || mh.conf.Percent <= 0 || IsUpgradeRequest(req) {
+		return false
+	}
+	if mh.apiKeys != nil && !mh.apiKeys[req.Header.Get(mh.conf.APIKeyHeader)] {
+		return false
+	}
+	if mh.endpoints != nil {
+		pm, _ := pathmatcher.GetRouteMatch(req)
+		if pm == nil || !(mh.endpoints[pm.OpenAPIPath] ||
+			mh.endpoints[pm.Method+" "+pm.OpenAPIPath]) {
+			return false
+		}
+	}
+	return mh.conf.Percent >= 100 || rand.Float64()*100 < mh.conf.Percent
+}
+
+// bufferBody reads the request body (up to max bytes, when max is
+// greater than zero) so it can be sent to both upstreams. If the
+// body is larger, the request is left ready to be forwarded, and
+// false is returned.
+func bufferBody(req *http.Request, max int64) ([]byte, bool) {
+	if req.Body == nil || req.Body == http.NoBody || req.ContentLength == 0 {
+		return nil, true
+	}
+	if max > 0 && req.ContentLength > max {
+		return nil, false
+	}
+	r := io.Reader(req.Body)
+	if max > 0 {
+		r = io.LimitReader(req.Body, max+1)
+	}
+	body, err := ioutil.ReadAll(r)
+	ok := err == nil && (max <= 0 || int64(len(body)) <= max)
+	rest := io.Reader(bytes.NewReader(body))
+	if !ok {
+		// the primary request still gets the whole body
+		rest = io.MultiReader(rest, req.Body)
+	}
+	req.Body = &bufferedBody{Reader: rest, Closer: req.Body}
+	return body, ok
+}
+
+// bufferedBody reads the buffered body, and closes the original one
+type bufferedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// shadowRequest creates the request for the shadow upstream
+func (mh *MirrorHandler) shadowRequest(req *http.Request, body []byte) *http.Request {
+	// the replay must not be cancelled when the client is gone
+	shadowReq := req.Clone(context.Background())
+	shadowReq.RequestURI = ""
+	shadowReq.Close = false
+	removeHopByHopHeaders(shadowReq.Header)
+	shadowReq.Header.Set(MirrorHeader, "true")
+	shadowReq.Host = mh.conf.Upstream.Addr
+	shadowReq.URL.Scheme = mh.conf.Upstream.Scheme
+	shadowReq.URL.Host = mh.conf.Upstream.Addr
+	shadowReq.Body = nil
+	shadowReq.ContentLength = int64(len(body))
+	if len(body) > 0 {
+		shadowReq.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	return shadowReq
+}
+
+// replay sends the request to the shadow upstream, and compares its
+// response with the primary one (if any)
+func (mh *MirrorHandler) replay(shadowReq *http.Request, primary *ResponseWriterRecorder) {
+	defer atomic.AddInt64(&mh.inFlight, -1)
+	result := MirrorResult{
+		Method: shadowReq.Method,
+		Path:   shadowReq.URL.Path,
+	}
+	defer mh.observe(&result)
+
+	if mh.conf.Timeout > 0 {
+		ctx, cancel := context.WithTimeout(shadowReq.Context(), mh.conf.Timeout)
+		defer cancel()
+		shadowReq = shadowReq.WithContext(ctx)
+	}
+	metrics.MirroredRequests.Add("sent", 1)
+	res, err := mh.transport.RoundTrip(shadowReq)
+	if err != nil {
+		result.Err = err
+		return
+	}
+	defer res.Body.Close()
+	result.Status = res.StatusCode
+	if primary == nil {
+		io.Copy(ioutil.Discard, res.Body)
+		return
+	}
+	shadow := NewResponseWriterRecorder(shadowReq, nil)
+	shadow.MaxData = mh.conf.MaxBodyBytes
+	shadow.Headers = res.Header
+	shadow.WriteHeader(res.StatusCode)
+	if _, err := io.Copy(shadow, res.Body); err != nil {
+		result.Err = err
+		return
+	}
+	result.Diff = diffResponses(primary, shadow)
+}
+
+func (mh *MirrorHandler) observe(result *MirrorResult) {
+	switch {
+	case result.Err != nil:
+		metrics.MirroredRequests.Add("failed", 1)
+		// TODO: change this for a log
+		fmt.Printf("cannot mirror %s %s: %s\n", result.Method, result.Path,
+			result.Err.Error())
+	case len(result.Diff) > 0:
+		metrics.MirroredRequests.Add("mismatch", 1)
+		fmt.Printf("mirror mismatch %s %s: %s\n", result.Method, result.Path,
+			result.Diff)
+	case mh.conf.Compare:
+		metrics.MirroredRequests.Add("match", 1)
+	}
+	if mh.observer != nil {
+		mh.observer.ObserveMirror(*result)
+	}
+}
+
+// diffResponses describes the differences between the primary and
+// the shadow responses, or returns an empty string if they match.
+// Only the recorded part of the bodies is compared.
+func diffResponses(primary, shadow *ResponseWriterRecorder) string {
+	var diffs []string
+	primaryStatus := primary.StatusCode
+	if primaryStatus == 0 {
+		primaryStatus = http.StatusOK
+	}
+	if primaryStatus != shadow.StatusCode {
+		diffs = append(diffs, fmt.Sprintf("status %d != %d", primaryStatus,
+			shadow.StatusCode))
+	}
+	pct, sct := primary.Headers.Get("Content-Type"), shadow.Headers.Get("Content-Type")
+	if pct != sct {
+		diffs = append(diffs, fmt.Sprintf("content type %q != %q", pct, sct))
+	}
+	var pb, sb []byte
+	if primary.Data != nil {
+		pb = primary.Data.Bytes()
+	}
+	if shadow.Data != nil {
+		sb = shadow.Data.Bytes()
+	}
+	if !bytes.Equal(pb, sb) || primary.Truncated != shadow.Truncated {
+		diffs = append(diffs, fmt.Sprintf("body differs (%d != %d bytes)",
+			len(pb), len(sb)))
+	}
+	return strings.Join(diffs, ", ")
+}
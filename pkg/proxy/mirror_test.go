@@ -0,0 +1,200 @@
+package proxy
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dhontecillas/dynlimits/pkg/pathmatcher"
+)
+
+// resultsObserver sends the mirror results to a channel
+type resultsObserver struct {
+	results chan MirrorResult
+}
+
+func (ro *resultsObserver) ObserveMirror(result MirrorResult) {
+	ro.results <- result
+}
+
+func (ro *resultsObserver) next(t *testing.T) MirrorResult {
+	select {
+	case r := <-ro.results:
+		return r
+	case <-time.After(2 * time.Second):
+		t.Fatalf("the request was not mirrored")
+	}
+	return MirrorResult{}
+}
+
+// echoBodyHandler answers with the request body, and a trailer
+func echoBodyHandler(status int, received chan<- *http.Request) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		if received != nil {
+			req.Body = ioutil.NopCloser(strings.NewReader(string(body)))
+			received <- req
+		}
+		rw.Header().Set("Content-Type", "text/plain")
+		rw.Header().Set("Trailer", "X-Checksum")
+		rw.WriteHeader(status)
+		rw.Write(body)
+		rw.Header().Set("X-Checksum", "abc")
+	})
+}
+
+func newTestMirror(t *testing.T, primary http.Handler, shadowStatus int,
+	conf Mirror) (*httptest.Server, *resultsObserver, chan *http.Request, func()) {
+	received := make(chan *http.Request, 10)
+	shadow := httptest.NewServer(echoBodyHandler(shadowStatus, received))
+	ph, _, closeProxy := newTestProxy(t, primary)
+	conf.Upstream = newServerUpstream(t, shadow)
+	mh := NewMirrorHandler(ph, conf, http.DefaultTransport)
+	ro := &resultsObserver{results: make(chan MirrorResult, 10)}
+	mh.SetObserver(ro)
+	ms := httptest.NewServer(mh)
+	return ms, ro, received, func() {
+		ms.Close()
+		closeProxy()
+		shadow.Close()
+	}
+}
+
+func Test_MirrorHandlerCompare(t *testing.T) {
+	ms, ro, received, closeAll := newTestMirror(t,
+		echoBodyHandler(http.StatusOK, nil), http.StatusOK,
+		Mirror{Percent: 100, Compare: true, MaxBodyBytes: 1024})
+	defer closeAll()
+
+	res, err := http.Post(ms.URL+"/items", "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatalf("cannot request: %s", err.Error())
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if string(body) != "hello" {
+		t.Errorf("want primary body hello, got %q", string(body))
+	}
+	if res.Trailer.Get("X-Checksum") != "abc" {
+		t.Errorf("want primary trailer, got %v", res.Trailer)
+	}
+
+	shadowReq := <-received
+	shadowBody, _ := ioutil.ReadAll(shadowReq.Body)
+	if string(shadowBody) != "hello" || shadowReq.URL.Path != "/items" {
+		t.Errorf("want shadow request /items hello, got %s %q",
+			shadowReq.URL.Path, string(shadowBody))
+	}
+	if shadowReq.Header.Get(MirrorHeader) != "true" {
+		t.Errorf("want %s header in the shadow request", MirrorHeader)
+	}
+	if r := ro.next(t); r.Err != nil || len(r.Diff) > 0 {
+		t.Errorf("want matching responses, got %v, %q", r.Err, r.Diff)
+	}
+}
+
+func Test_MirrorHandlerMismatch(t *testing.T) {
+	ms, ro, _, closeAll := newTestMirror(t,
+		echoBodyHandler(http.StatusOK, nil), http.StatusInternalServerError,
+		Mirror{Percent: 100, Compare: true, MaxBodyBytes: 1024})
+	defer closeAll()
+
+	res, err := http.Get(ms.URL + "/items")
+	if err != nil {
+		t.Fatalf("cannot request: %s", err.Error())
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("want the primary status 200, got %d", res.StatusCode)
+	}
+	r := ro.next(t)
+	if r.Status != http.StatusInternalServerError ||
+		!strings.Contains(r.Diff, "status 200 != 500") {
+		t.Errorf("want status mismatch, got %d %q", r.Status, r.Diff)
+	}
+}
+
+func Test_MirrorHandlerLargeBody(t *testing.T) {
+	primaryBodies := make(chan *http.Request, 1)
+	ms, _, received, closeAll := newTestMirror(t,
+		echoBodyHandler(http.StatusOK, primaryBodies), http.StatusOK,
+		Mirror{Percent: 100, MaxBodyBytes: 4})
+	defer closeAll()
+
+	// with an unknown length, the body must be read to know its size
+	pr, pw := io.Pipe()
+	go func() {
+		io.WriteString(pw, "larger than the max")
+		pw.Close()
+	}()
+	res, err := http.Post(ms.URL+"/items", "text/plain", pr)
+	if err != nil {
+		t.Fatalf("cannot request: %s", err.Error())
+	}
+	res.Body.Close()
+	primaryReq := <-primaryBodies
+	body, _ := ioutil.ReadAll(primaryReq.Body)
+	if string(body) != "larger than the max" {
+		t.Errorf("want the whole body in the primary, got %q", string(body))
+	}
+	select {
+	case <-received:
+		t.Errorf("want the large request not mirrored")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func Test_MirrorHandlerFilters(t *testing.T) {
+	newReq := func(apiKey string, pm *pathmatcher.PathMatched) *http.Request {
+		req := httptest.NewRequest("GET", "/items/1", nil)
+		req.Header.Set("X-Api-Key", apiKey)
+		if pm != nil {
+			req = pathmatcher.WithRouteMatch(req, pm, nil)
+		}
+		return req
+	}
+	items := pathmatcher.NewPathMatched("GET", "/items/{id}")
+	users := pathmatcher.NewPathMatched("GET", "/users/{id}")
+
+	mh := NewMirrorHandler(nil, Mirror{
+		Upstream:     NewUpstream("http", "10.0.0.1:8000"),
+		Percent:      100,
+		Endpoints:    []string{"GET /items/{id}", "/orders"},
+		APIKeys:      []string{"key1"},
+		APIKeyHeader: "X-Api-Key",
+	}, nil)
+	cases := []struct {
+		name string
+		req  *http.Request
+		want bool
+	}{
+		{"matching", newReq("key1", items), true},
+		{"other key", newReq("key2", items), false},
+		{"other endpoint", newReq("key1", users), false},
+		{"no route", newReq("key1", nil), false},
+	}
+	for _, c := range cases {
+		if got := mh.shouldMirror(c.req); got != c.want {
+			t.Errorf("%s: want %t, got %t", c.name, c.want, got)
+		}
+	}
+
+	mh.conf.Percent = 0
+	if mh.shouldMirror(newReq("key1", items)) {
+		t.Errorf("want no request mirrored with 0 percent")
+	}
+	mh.conf.Percent = 50
+	mirrored := 0
+	for idx := 0; idx < 1000; idx++ {
+		if mh.shouldMirror(newReq("key1", items)) {
+			mirrored++
+		}
+	}
+	if mirrored < 400 || mirrored > 600 {
+		t.Errorf("want about 500 requests mirrored, got %d", mirrored)
+	}
+}
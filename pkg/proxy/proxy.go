@@ -1,67 +1,280 @@
 package proxy
 
 import (
-	"bytes"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
 	"net/http"
+	"strings"
+	"sync"
+	"time"
 )
 
+// UpstreamObserver is notified with the result of each
+// request forwarded to the upstream
+type UpstreamObserver interface {
+	ObserveUpstream(latency time.Duration, statusCode int, err error)
+}
+
+// copyBufferSize is the size of the buffers used to copy the
+// response bodies, so the memory used by each request is bounded
+const copyBufferSize int = 32 * 1024
+
+var copyBufferPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, copyBufferSize)
+		return &b
+	},
+}
+
+// ProxyHandler forwards the requests to the upstream, streaming
+// the request and response bodies (without buffering them), with
+// the same semantics as the httputil.ReverseProxy:
+//
+//   - the response is flushed to the client at the flush interval.
+//     With a negative interval, it is flushed after each write.
+//     Streaming responses (server-sent events, or with an unknown
+//     length) are always flushed after each write.
+//   - the upstream response trailers are sent to the client.
+//   - redirects are not followed, they are sent to the client.
+//   - if the response body can not be copied once the status has
+//     been sent, the response is aborted.
+//   - the hop-by-hop headers are not forwarded, neither in the
+//     request nor in the response.
+//   - the forwarding headers are set as configured (see
+//     SetForwardedHeaders).
+//   - each request is sent to the upstream selected by the pool of
+//     its upstream service (see SetServices), or by the default pool.
+//   - the connections upgraded to another protocol (like WebSocket)
+//     are hijacked and piped to the upstream, checking the client
+//     messages with the MessageLimiter of the request (if any).
 type ProxyHandler struct {
-	scheme      string
-	forwardAddr string
-	client      *http.Client
+	upstreams     *UpstreamPool
+	services      map[string]*UpstreamPool
+	serviceRoutes []ServiceRoute
+	transport     http.RoundTripper
+	observer      UpstreamObserver
+	flushInterval time.Duration
+	forwarded     ForwardedHeaders
 }
 
+// NewProxyHandler creates a ProxyHandler that forwards all the
+// requests to a single upstream. The scheme must be http, https or
+// h2c (see ParseUpstream to validate an upstream url).
 func NewProxyHandler(scheme string, forwardAddr string) *ProxyHandler {
-	// TODO: check that scheme is http or https
+	return NewPoolProxyHandler(NewUpstreamPool(
+		[]*Upstream{NewUpstream(scheme, forwardAddr)}, RoundRobin))
+}
+
+// NewPoolProxyHandler creates a ProxyHandler that balances the
+// requests among the upstreams of the pool
+func NewPoolProxyHandler(upstreams *UpstreamPool) *ProxyHandler {
 	return &ProxyHandler{
-		scheme:      scheme,
-		forwardAddr: forwardAddr,
-		client:      &http.Client{},
+		upstreams: upstreams,
+		transport: http.DefaultTransport,
 	}
 }
 
+// SetObserver sets an observer to be notified with the latency
+// and the result of the upstream requests
+func (ph *ProxyHandler) SetObserver(observer UpstreamObserver) {
+	ph.observer = observer
+}
+
+// SetFlushInterval sets how often the response is flushed to the
+// client while it is being copied (0 to not flush it periodically,
+// and a negative value to flush it after each write).
+func (ph *ProxyHandler) SetFlushInterval(interval time.Duration) {
+	ph.flushInterval = interval
+}
+
+// SetForwardedHeaders selects the headers to set in the requests to
+// the upstream to tell it about the client, and if the Host header
+// must be preserved.
+func (ph *ProxyHandler) SetForwardedHeaders(fh ForwardedHeaders) {
+	ph.forwarded = fh
+}
+
 func (ph *ProxyHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
-	// just write the success header for now
-	// c := context.Background()
-	nr, err := http.NewRequestWithContext(req.Context(),
-		req.Method, req.URL.String(), req.Body)
-	if err != nil {
-		// TODO: log the error
-		fmt.Printf("error creating request: %s\n", err.Error())
+	pool := ph.upstreamPool(req)
+	if pool == nil {
 		rw.WriteHeader(http.StatusBadGateway)
 		return
 	}
-	// TODO: check the error
-	nr.Host = ph.forwardAddr
-	nr.URL.Scheme = ph.scheme
-	nr.URL.Host = ph.forwardAddr
-	nr.ContentLength = req.ContentLength
 
-	for key, slc := range req.Header {
-		nr.Header[key] = make([]string, len(slc))
-		copy(nr.Header[key], slc)
+	outreq := req.Clone(req.Context())
+	if req.ContentLength == 0 {
+		// the transport retries requests without body
+		outreq.Body = nil
+	}
+	if outreq.Body != nil {
+		// make sure the body is closed, even if the transport
+		// does not get to read it
+		defer outreq.Body.Close()
+	}
+	outreq.Close = false
+	outreq.RequestURI = ""
+	if outreq.Header == nil {
+		outreq.Header = make(http.Header)
 	}
+	reqUpType := upgradeType(outreq.Header)
+	removeHopByHopHeaders(outreq.Header)
+	if len(reqUpType) > 0 {
+		setUpgradeHeaders(outreq.Header, reqUpType)
+	}
+	// the clients must tell that they support trailers, and as
+	// we forward them, tell it to the upstream too
+	if headerValuesContainToken(req.Header["Te"], "trailers") {
+		outreq.Header.Set("Te", "trailers")
+	}
+	ph.forwarded.apply(outreq, req)
 
-	res, err := ph.client.Do(nr)
+	res, release, err := ph.forward(pool, req, outreq)
 	if err != nil {
-		// TODO: log the error
-		// fmt.Printf("error proxying the request: %s\n", err.Error())
-		rw.WriteHeader(http.StatusBadGateway)
+		if req.Context().Err() != nil {
+			// the client is gone, so there is no one to answer
+			rw.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		status, cause := upstreamErrorStatus(err)
+		// TODO: change this for a log
+		fmt.Printf("cannot forward %s %s (%s): %s\n", req.Method,
+			req.URL.Path, cause, err.Error())
+		rw.WriteHeader(status)
+		return
+	}
+	defer release()
+	if res.StatusCode == http.StatusSwitchingProtocols {
+		ph.handleUpgradeResponse(rw, req, res)
 		return
 	}
+	defer res.Body.Close()
+
+	removeHopByHopHeaders(res.Header)
 	dstH := rw.Header()
-	for key, slc := range res.Header {
-		dstH[key] = make([]string, len(slc))
-		copy(dstH[key], slc)
+	copyHeader(dstH, res.Header)
+
+	// announce the trailers, so they can be sent after the body
+	announced := len(res.Trailer)
+	if announced > 0 {
+		trailerKeys := make([]string, 0, len(res.Trailer))
+		for k := range res.Trailer {
+			trailerKeys = append(trailerKeys, k)
+		}
+		dstH.Add("Trailer", strings.Join(trailerKeys, ", "))
+		// the trailers can only be sent with a chunked body (like
+		// the HTTP/2 upstreams send with empty bodies)
+		dstH.Del("Content-Length")
 	}
+
 	rw.WriteHeader(res.StatusCode)
 
-	var buf []byte
-	if res.ContentLength >= 0 {
-		buf = make([]byte, 0, res.ContentLength)
+	err = ph.copyResponse(rw, res.Body, ph.responseFlushInterval(res))
+	if err != nil {
+		// the status has already been sent, so the only way to
+		// tell the client that the response is not complete is
+		// to abort it
+		// TODO: change this for a log
+		fmt.Printf("error copying the response: %s\n", err.Error())
+		panic(http.ErrAbortHandler)
+	}
+
+	// the trailers are handled as in httputil.ReverseProxy (see the
+	// license of copy.go)
+	if len(res.Trailer) > 0 {
+		// force chunking if we saw a response trailer, so the
+		// trailers can be sent
+		if f, ok := rw.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+	if len(res.Trailer) == announced {
+		copyHeader(dstH, res.Trailer)
+		return
+	}
+	// the trailers that were not announced are sent with
+	// the TrailerPrefix
+	for k, vv := range res.Trailer {
+		k = http.TrailerPrefix + k
+		for _, v := range vv {
+			dstH.Add(k, v)
+		}
+	}
+}
+
+// forward sends the request to an upstream of the pool, and retries
+// it if it fails and the pool retry policy allows it. It returns
+// the upstream response and the function to call once it has been
+// copied to the client.
+func (ph *ProxyHandler) forward(pool *UpstreamPool, req *http.Request,
+	outreq *http.Request) (*http.Response, func(), error) {
+	if pool.retries != nil {
+		pool.retries.request()
+	}
+	for retries := 0; ; retries++ {
+		upstream, release := pool.pickAndAcquire(req)
+		if upstream == nil {
+			return nil, nil, errNoUpstream
+		}
+		if retries > 0 {
+			// the transport can keep using the previous request
+			outreq = outreq.Clone(outreq.Context())
+		}
+		outreq.Host = upstream.Addr
+		if ph.forwarded.PreserveHost {
+			outreq.Host = req.Host
+		}
+		outreq.URL.Scheme = upstream.Scheme
+		outreq.URL.Host = upstream.Addr
+
+		start := time.Now()
+		res, err := ph.transport.RoundTrip(outreq)
+		statusCode := 0
+		if err == nil {
+			statusCode = res.StatusCode
+		}
+		if req.Context().Err() == nil {
+			// if the client is gone, it is not an upstream issue
+			pool.observe(upstream, statusCode, err)
+			if ph.observer != nil {
+				ph.observer.ObserveUpstream(time.Since(start), statusCode, err)
+			}
+		}
+		if !pool.canRetry(outreq, retries, statusCode, err) {
+			if err != nil {
+				release()
+				return nil, nil, fmt.Errorf("upstream %s: %w", upstream, err)
+			}
+			return res, release, nil
+		}
+		if err == nil {
+			// TODO: change this for a log
+			fmt.Printf("retrying %s %s: upstream %s answered %d\n",
+				req.Method, req.URL.Path, upstream, statusCode)
+			io.Copy(ioutil.Discard, res.Body)
+			res.Body.Close()
+		} else {
+			fmt.Printf("retrying %s %s: upstream %s: %s\n",
+				req.Method, req.URL.Path, upstream, err.Error())
+		}
+		release()
+	}
+}
+
+// responseFlushInterval returns the flush interval to use for the
+// response, that for streaming responses is to flush after each write
+func (ph *ProxyHandler) responseFlushInterval(res *http.Response) time.Duration {
+	mediaType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if mediaType == "text/event-stream" || res.ContentLength == -1 {
+		return -1
+	}
+	return ph.flushInterval
+}
+
+func copyHeader(dst, src http.Header) {
+	for key, slc := range src {
+		dst[key] = make([]string, len(slc))
+		copy(dst[key], slc)
 	}
-	b := bytes.NewBuffer(buf)
-	b.ReadFrom(res.Body)
-	rw.Write(b.Bytes())
 }
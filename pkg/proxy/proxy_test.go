@@ -0,0 +1,287 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestProxy creates a proxy server forwarding to the upstream
+func newTestProxy(t *testing.T, upstream http.Handler) (*ProxyHandler,
+	*httptest.Server, func()) {
+	us := httptest.NewServer(upstream)
+	u, err := url.Parse(us.URL)
+	if err != nil {
+		t.Fatalf("cannot parse upstream url: %s", err.Error())
+	}
+	ph := NewProxyHandler("http", u.Host)
+	ps := httptest.NewServer(ph)
+	return ph, ps, func() {
+		ps.Close()
+		us.Close()
+	}
+}
+
+func Test_ProxyHandlerStreamsResponse(t *testing.T) {
+	release := make(chan struct{})
+	upstream := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "text/event-stream")
+		rw.WriteHeader(http.StatusOK)
+		io.WriteString(rw, "data: first\n\n")
+		rw.(http.Flusher).Flush()
+		<-release
+		io.WriteString(rw, "data: second\n\n")
+	})
+	_, ps, closeAll := newTestProxy(t, upstream)
+	defer closeAll()
+	defer close(release)
+
+	res, err := http.Get(ps.URL + "/events")
+	if err != nil {
+		t.Fatalf("unexpected error %s", err.Error())
+	}
+	defer res.Body.Close()
+
+	lines := make(chan string)
+	go func() {
+		br := bufio.NewReader(res.Body)
+		line, _ := br.ReadString('\n')
+		lines <- line
+	}()
+	select {
+	case line := <-lines:
+		if line != "data: first\n" {
+			t.Errorf("unexpected line %q", line)
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("want the first event before the response is complete")
+	}
+}
+
+func Test_ProxyHandlerStreamsRequestBody(t *testing.T) {
+	upstream := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		io.Copy(rw, req.Body)
+	})
+	_, ps, closeAll := newTestProxy(t, upstream)
+	defer closeAll()
+
+	body := strings.Repeat("0123456789", 100*1024)
+	res, err := http.Post(ps.URL+"/echo", "text/plain", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("unexpected error %s", err.Error())
+	}
+	defer res.Body.Close()
+	got, _ := ioutil.ReadAll(res.Body)
+	if string(got) != body {
+		t.Errorf("want %d bytes echoed, got %d", len(body), len(got))
+	}
+}
+
+func Test_ProxyHandlerTrailers(t *testing.T) {
+	upstream := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Trailer", "X-Checksum")
+		rw.WriteHeader(http.StatusOK)
+		io.WriteString(rw, "body")
+		rw.Header().Set("X-Checksum", "abc")
+		rw.Header().Set(http.TrailerPrefix+"X-Late", "def")
+	})
+	_, ps, closeAll := newTestProxy(t, upstream)
+	defer closeAll()
+
+	res, err := http.Get(ps.URL + "/trailers")
+	if err != nil {
+		t.Fatalf("unexpected error %s", err.Error())
+	}
+	defer res.Body.Close()
+	ioutil.ReadAll(res.Body)
+	if res.Trailer.Get("X-Checksum") != "abc" {
+		t.Errorf("want trailer X-Checksum, got %#v", res.Trailer)
+	}
+	if res.Trailer.Get("X-Late") != "def" {
+		t.Errorf("want trailer X-Late, got %#v", res.Trailer)
+	}
+}
+
+func Test_ProxyHandlerDoesNotFollowRedirects(t *testing.T) {
+	upstream := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		http.Redirect(rw, req, "/other", http.StatusFound)
+	})
+	_, ps, closeAll := newTestProxy(t, upstream)
+	defer closeAll()
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	res, err := client.Get(ps.URL + "/redirect")
+	if err != nil {
+		t.Fatalf("unexpected error %s", err.Error())
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusFound || res.Header.Get("Location") != "/other" {
+		t.Errorf("want the redirect, got %d %q", res.StatusCode,
+			res.Header.Get("Location"))
+	}
+}
+
+func Test_ProxyHandlerBadGateway(t *testing.T) {
+	ph := NewProxyHandler("http", "127.0.0.1:1")
+	rw := httptest.NewRecorder()
+	ph.ServeHTTP(rw, httptest.NewRequest("GET", "/", nil))
+	if rw.Code != http.StatusBadGateway {
+		t.Errorf("want status %d, got %d", http.StatusBadGateway, rw.Code)
+	}
+}
+
+func Test_ProxyHandlerRemovesHopByHopHeaders(t *testing.T) {
+	var received http.Header
+	upstream := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		received = req.Header.Clone()
+		rw.Header().Set("Connection", "X-Upstream-Hop")
+		rw.Header().Set("X-Upstream-Hop", "hop")
+		rw.Header().Set("Keep-Alive", "timeout=5")
+		rw.Header().Set("X-Upstream-End", "end")
+		rw.WriteHeader(http.StatusOK)
+	})
+	_, ps, closeAll := newTestProxy(t, upstream)
+	defer closeAll()
+
+	req, _ := http.NewRequest(http.MethodGet, ps.URL+"/hops", nil)
+	req.Header.Set("Connection", "X-Client-Hop")
+	req.Header.Set("X-Client-Hop", "hop")
+	req.Header.Set("Proxy-Connection", "keep-alive")
+	req.Header.Set("Te", "trailers, deflate")
+	req.Header.Set("X-Client-End", "end")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err.Error())
+	}
+	res.Body.Close()
+
+	for _, h := range []string{"Connection", "X-Client-Hop", "Proxy-Connection"} {
+		if v := received.Get(h); v != "" {
+			t.Errorf("unexpected request header %s: %s", h, v)
+		}
+	}
+	if v := received.Get("Te"); v != "trailers" {
+		t.Errorf("want Te: trailers, got %q", v)
+	}
+	if received.Get("X-Client-End") != "end" {
+		t.Errorf("end to end request header not forwarded")
+	}
+	for _, h := range []string{"X-Upstream-Hop", "Keep-Alive"} {
+		if v := res.Header.Get(h); v != "" {
+			t.Errorf("unexpected response header %s: %s", h, v)
+		}
+	}
+	if res.Header.Get("X-Upstream-End") != "end" {
+		t.Errorf("end to end response header not forwarded")
+	}
+}
+
+func Test_ProxyHandlerForwardedHeaders(t *testing.T) {
+	var received *http.Request
+	upstream := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		received = req
+		rw.WriteHeader(http.StatusOK)
+	})
+	ph, _, closeAll := newTestProxy(t, upstream)
+	defer closeAll()
+
+	trusted, _ := ParseTrustedProxies("10.0.0.0/8")
+	fh := ForwardedHeaders{
+		XForwardedFor:   true,
+		XForwardedProto: true,
+		XForwardedHost:  true,
+		Forwarded:       true,
+		TrustedProxies:  trusted,
+	}
+	ph.SetForwardedHeaders(fh)
+
+	newReq := func(remoteAddr string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "http://api.example.com/fwd", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("X-Forwarded-For", "1.2.3.4")
+		req.Header.Set("X-Forwarded-Proto", "https")
+		req.Header.Set("Forwarded", "for=1.2.3.4")
+		return req
+	}
+
+	// untrusted client: the received headers are discarded
+	ph.ServeHTTP(httptest.NewRecorder(), newReq("192.168.1.5:3333"))
+	if v := received.Header.Get("X-Forwarded-For"); v != "192.168.1.5" {
+		t.Errorf("unexpected X-Forwarded-For %q", v)
+	}
+	if v := received.Header.Get("X-Forwarded-Proto"); v != "http" {
+		t.Errorf("unexpected X-Forwarded-Proto %q", v)
+	}
+	if v := received.Header.Get("X-Forwarded-Host"); v != "api.example.com" {
+		t.Errorf("unexpected X-Forwarded-Host %q", v)
+	}
+	if v := received.Header.Values("Forwarded"); len(v) != 1 ||
+		v[0] != `for=192.168.1.5;host="api.example.com";proto=http` {
+		t.Errorf("unexpected Forwarded %#v", v)
+	}
+	upstreamAddr := ph.upstreams.Upstreams()[0].Addr
+	if received.Host != upstreamAddr {
+		t.Errorf("want host %s, got %s", upstreamAddr, received.Host)
+	}
+
+	// trusted proxy: the received headers are kept
+	ph.ServeHTTP(httptest.NewRecorder(), newReq("10.1.1.1:3333"))
+	if v := received.Header.Get("X-Forwarded-For"); v != "1.2.3.4, 10.1.1.1" {
+		t.Errorf("unexpected X-Forwarded-For %q", v)
+	}
+	if v := received.Header.Get("X-Forwarded-Proto"); v != "https" {
+		t.Errorf("unexpected X-Forwarded-Proto %q", v)
+	}
+	if v := received.Header.Values("Forwarded"); len(v) != 2 || v[0] != "for=1.2.3.4" {
+		t.Errorf("unexpected Forwarded %#v", v)
+	}
+
+	fh.PreserveHost = true
+	ph.SetForwardedHeaders(fh)
+	ph.ServeHTTP(httptest.NewRecorder(), newReq("[2001:db8::1]:3333"))
+	if received.Host != "api.example.com" {
+		t.Errorf("want preserved host, got %s", received.Host)
+	}
+	if v := received.Header.Get("Forwarded"); v !=
+		`for="[2001:db8::1]";host="api.example.com";proto=http` {
+		t.Errorf("unexpected Forwarded %q", v)
+	}
+}
+
+func Test_ParseTrustedProxies(t *testing.T) {
+	nets, err := ParseTrustedProxies("10.0.0.0/8, 192.168.1.10,::1")
+	if err != nil {
+		t.Fatalf("unexpected error %s", err.Error())
+	}
+	if len(nets) != 3 {
+		t.Fatalf("want 3 networks, got %d", len(nets))
+	}
+	fh := &ForwardedHeaders{TrustedProxies: nets}
+	for ip, want := range map[string]bool{
+		"10.2.3.4":     true,
+		"192.168.1.10": true,
+		"192.168.1.11": false,
+		"::1":          true,
+	} {
+		if got := fh.trusted(net.ParseIP(ip)); got != want {
+			t.Errorf("%s: want trusted %t, got %t", ip, want, got)
+		}
+	}
+	if _, err := ParseTrustedProxies("10.0.0.0/33"); err == nil {
+		t.Errorf("expected error for bad network")
+	}
+	if _, err := ParseTrustedProxies("not-an-ip"); err == nil {
+		t.Errorf("expected error for bad ip")
+	}
+}
@@ -10,6 +10,10 @@ type ResponseWriterRecorder struct {
 	StatusCode int
 	Headers    http.Header
 	Data       *bytes.Buffer
+	// MaxData is the max number of bytes kept in Data (0 for no
+	// limit). Truncated is set when the rest of the data is dropped.
+	MaxData   int64
+	Truncated bool
 }
 
 func NewResponseWriterRecorder(req *http.Request,
@@ -33,13 +37,24 @@ func (rwr *ResponseWriterRecorder) Write(data []byte) (int, error) {
 	// WriteHeader only writes the header if it has not been
 	// previously written
 	rwr.WriteHeader(http.StatusOK)
+	n := len(data)
+	if rwr.MaxData > 0 {
+		kept := rwr.MaxData
+		if rwr.Data != nil {
+			kept -= int64(rwr.Data.Len())
+		}
+		if int64(len(data)) > kept {
+			rwr.Truncated = true
+			data = data[:kept]
+		}
+	}
 	// TODO: perhaps we can use a bytes.Buffer ?
 	if rwr.Data == nil {
 		rwr.Data = bytes.NewBuffer(data)
 	} else {
 		rwr.Data.Write(data)
 	}
-	return len(data), nil
+	return n, nil
 }
 
 func (rwr *ResponseWriterRecorder) WriteHeader(statusCode int) {
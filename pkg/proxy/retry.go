@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RetryPolicy defines when a failed request is sent again to
+// another upstream (or to the same one, if it is the only one
+// available):
+//
+//   - MaxRetries: the max number of retries of a request (0
+//     disables the retries).
+//   - BudgetRatio: the retries, as a ratio of the requests, that
+//     can be done in the budget window.
+//   - BudgetMinPerSec: the retries per second that can be done
+//     even if the BudgetRatio does not allow them, so the retries
+//     also work with low traffic.
+//
+// Only the idempotent requests without a body are retried, when they
+// can not be sent or the upstream answers with a 502 or a 503. The
+// timeouts are not retried, as the request could take too long.
+type RetryPolicy struct {
+	MaxRetries      int
+	BudgetRatio     float64
+	BudgetMinPerSec int
+}
+
+// retryBudgetWindow is the time window where the requests and
+// retries are counted for the retry budget
+const retryBudgetWindow time.Duration = 10 * time.Second
+
+// retryBudget limits the retries of a pool, so they do not overload
+// the upstreams when most of the requests are failing
+type retryBudget struct {
+	policy RetryPolicy
+
+	mu          sync.Mutex
+	windowStart time.Time
+	requests    int
+	retries     int
+}
+
+func newRetryBudget(policy RetryPolicy) *retryBudget {
+	return &retryBudget{
+		policy: policy,
+	}
+}
+
+// roll starts a new window if the current one has finished
+func (rb *retryBudget) roll(now time.Time) {
+	if now.Sub(rb.windowStart) < retryBudgetWindow {
+		return
+	}
+	rb.windowStart = now
+	rb.requests = 0
+	rb.retries = 0
+}
+
+// request counts a request (not a retry) in the budget
+func (rb *retryBudget) request() {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	rb.roll(time.Now())
+	rb.requests++
+}
+
+// withdraw returns true if a retry can be done, and counts it
+func (rb *retryBudget) withdraw() bool {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	rb.roll(time.Now())
+	allowed := int(rb.policy.BudgetRatio*float64(rb.requests)) +
+		rb.policy.BudgetMinPerSec*int(retryBudgetWindow/time.Second)
+	if rb.retries >= allowed {
+		return false
+	}
+	rb.retries++
+	return true
+}
+
+// isIdempotent returns true for the methods that can be sent
+// again without changing the result (RFC 7231, section 4.2.2)
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions,
+		http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// canRetry returns true if the request can be retried after it
+// failed with the error or status code
+func (up *UpstreamPool) canRetry(req *http.Request, retries int,
+	statusCode int, err error) bool {
+	if up.retries == nil || retries >= up.retries.policy.MaxRetries ||
+		req.Body != nil || !isIdempotent(req.Method) ||
+		req.Context().Err() != nil {
+		return false
+	}
+	if err != nil {
+		if status, _ := upstreamErrorStatus(err); status == http.StatusGatewayTimeout {
+			return false
+		}
+	} else if statusCode != http.StatusBadGateway &&
+		statusCode != http.StatusServiceUnavailable {
+		return false
+	}
+	return up.retries.withdraw()
+}
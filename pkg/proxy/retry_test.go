@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newServerUpstream(t *testing.T, s *httptest.Server) *Upstream {
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatalf("cannot parse upstream url: %s", err.Error())
+	}
+	return NewUpstream("http", u.Host)
+}
+
+func Test_RetryBudget(t *testing.T) {
+	rb := newRetryBudget(RetryPolicy{MaxRetries: 1, BudgetRatio: 0.5})
+	for idx := 0; idx < 10; idx++ {
+		rb.request()
+	}
+	for idx := 0; idx < 5; idx++ {
+		if !rb.withdraw() {
+			t.Fatalf("retry %d should be allowed", idx)
+		}
+	}
+	if rb.withdraw() {
+		t.Errorf("retry over the budget should not be allowed")
+	}
+
+	rb = newRetryBudget(RetryPolicy{MaxRetries: 1, BudgetMinPerSec: 1})
+	for idx := 0; idx < int(retryBudgetWindow/time.Second); idx++ {
+		if !rb.withdraw() {
+			t.Fatalf("retry %d should be allowed", idx)
+		}
+	}
+	if rb.withdraw() {
+		t.Errorf("retry over the budget should not be allowed")
+	}
+}
+
+func Test_ProxyHandlerRetries(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	working := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer working.Close()
+
+	up := NewUpstreamPool([]*Upstream{newServerUpstream(t, failing),
+		newServerUpstream(t, working)}, RoundRobin)
+	up.SetRetryPolicy(RetryPolicy{MaxRetries: 1, BudgetMinPerSec: 100})
+	ph := NewPoolProxyHandler(up)
+
+	for idx := 0; idx < 4; idx++ {
+		rec := httptest.NewRecorder()
+		ph.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("GET %d: want status 200, got %d", idx, rec.Code)
+		}
+	}
+
+	// the non idempotent requests and the requests with a body
+	// are not retried
+	failed := 0
+	for idx := 0; idx < 4; idx++ {
+		rec := httptest.NewRecorder()
+		ph.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", nil))
+		if rec.Code == http.StatusServiceUnavailable {
+			failed++
+		}
+		rec = httptest.NewRecorder()
+		ph.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/",
+			strings.NewReader("body")))
+		if rec.Code == http.StatusServiceUnavailable {
+			failed++
+		}
+	}
+	if failed != 4 {
+		t.Errorf("want 4 failed requests, got %d", failed)
+	}
+}
+
+func Test_ProxyHandlerUpstreamErrors(t *testing.T) {
+	// a closed port refuses the connections
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err.Error())
+	}
+	closedAddr := l.Addr().String()
+	l.Close()
+
+	rec := httptest.NewRecorder()
+	NewProxyHandler("http", closedAddr).ServeHTTP(rec,
+		httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("want status 502, got %d", rec.Code)
+	}
+
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	defer close(release)
+	ph := NewPoolProxyHandler(NewUpstreamPool(
+		[]*Upstream{newServerUpstream(t, slow)}, RoundRobin))
+	ph.SetTransport(NewTransport(Timeouts{
+		Dial:           time.Second,
+		ResponseHeader: 20 * time.Millisecond,
+	}, nil))
+	rec = httptest.NewRecorder()
+	ph.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Errorf("want status 504, got %d", rec.Code)
+	}
+}
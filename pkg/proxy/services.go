@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/dhontecillas/dynlimits/pkg/metrics"
+	"github.com/dhontecillas/dynlimits/pkg/pathmatcher"
+)
+
+// ServiceRoute sends the requests whose matched route path (or
+// request path, if it did not match any route) starts with the
+// Prefix to the Service upstreams.
+type ServiceRoute struct {
+	Prefix  string
+	Service string
+}
+
+// ParseServices parses a `;` separated list of upstream services,
+// each one with its name and its comma separated upstream base urls,
+// like `billing=http://10.0.0.1:8000,http://10.0.0.2:8000;users=http://10.0.1.1:8000`
+func ParseServices(list string) (map[string][]*Upstream, error) {
+	services := make(map[string][]*Upstream)
+	for _, s := range strings.Split(list, ";") {
+		s = strings.TrimSpace(s)
+		if len(s) == 0 {
+			continue
+		}
+		parts := strings.SplitN(s, "=", 2)
+		name := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || len(name) == 0 {
+			return nil, fmt.Errorf("bad upstream service %q", s)
+		}
+		if _, ok := services[name]; ok {
+			return nil, fmt.Errorf("duplicated upstream service %q", name)
+		}
+		ups, err := ParseUpstreams(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("bad upstream service %q: %s", name,
+				err.Error())
+		}
+		if len(ups) == 0 {
+			return nil, fmt.Errorf("upstream service %q without upstreams", name)
+		}
+		services[name] = ups
+	}
+	return services, nil
+}
+
+// ParseServiceRoutes parses a `;` separated list of path prefixes
+// and their upstream service, like `/api/billing/=billing;/api/users/=users`
+func ParseServiceRoutes(list string) ([]ServiceRoute, error) {
+	var routes []ServiceRoute
+	for _, s := range strings.Split(list, ";") {
+		s = strings.TrimSpace(s)
+		if len(s) == 0 {
+			continue
+		}
+		parts := strings.SplitN(s, "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], "/") ||
+			len(strings.TrimSpace(parts[1])) == 0 {
+			return nil, fmt.Errorf("bad service route %q", s)
+		}
+		routes = append(routes, ServiceRoute{
+			Prefix:  parts[0],
+			Service: strings.TrimSpace(parts[1]),
+		})
+	}
+	return routes, nil
+}
+
+// SetServices sets the named upstream services, that the requests
+// are sent to when their route has an Upstream, or when they match
+// a service route
+func (ph *ProxyHandler) SetServices(services map[string]*UpstreamPool) {
+	ph.services = services
+}
+
+// SetServiceRoutes sets the path prefixes of the upstream services.
+// The longest prefix that matches a request wins.
+func (ph *ProxyHandler) SetServiceRoutes(routes []ServiceRoute) error {
+	for _, r := range routes {
+		if _, ok := ph.services[r.Service]; !ok {
+			return fmt.Errorf("service route %q to unknown upstream service %q",
+				r.Prefix, r.Service)
+		}
+	}
+	sorted := append([]ServiceRoute(nil), routes...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return len(sorted[i].Prefix) > len(sorted[j].Prefix)
+	})
+	ph.serviceRoutes = sorted
+	return nil
+}
+
+// HasService returns true if there is an upstream service
+// with that name
+func (ph *ProxyHandler) HasService(name string) bool {
+	_, ok := ph.services[name]
+	return ok
+}
+
+// upstreamPool returns the pool for the request, using the route
+// matched by the rate limiter (see pathmatcher.WithRouteMatch), so
+// the request is not matched again. It returns nil if the upstream
+// service does not exist.
+func (ph *ProxyHandler) upstreamPool(req *http.Request) *UpstreamPool {
+	var service, path string
+	if pm, _ := pathmatcher.GetRouteMatch(req); pm != nil {
+		service = pm.Upstream
+		path = pm.OpenAPIPath
+	} else if rp, ok := pathmatcher.GetRequestPaths(req); ok {
+		path = rp.Normalized
+	} else {
+		path = req.URL.Path
+	}
+	if len(service) == 0 {
+		for _, r := range ph.serviceRoutes {
+			if strings.HasPrefix(path, r.Prefix) {
+				service = r.Service
+				break
+			}
+		}
+	}
+	if len(service) == 0 {
+		return ph.upstreams
+	}
+	pool, ok := ph.services[service]
+	if !ok {
+		// TODO: change this for a log
+		fmt.Printf("unknown upstream service %q for %s %s\n", service,
+			req.Method, req.URL.Path)
+		metrics.UnknownUpstreamService.Add(service, 1)
+		return nil
+	}
+	return pool
+}
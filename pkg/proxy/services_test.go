@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/dhontecillas/dynlimits/pkg/metrics"
+	"github.com/dhontecillas/dynlimits/pkg/pathmatcher"
+)
+
+// newNamedUpstream creates an upstream server that answers with
+// its name, and a pool for it
+func newNamedUpstream(t *testing.T, name string) (*UpstreamPool, func()) {
+	us := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte(name))
+	}))
+	u, err := url.Parse(us.URL)
+	if err != nil {
+		t.Fatalf("cannot parse upstream url: %s", err.Error())
+	}
+	return NewUpstreamPool([]*Upstream{NewUpstream("http", u.Host)},
+		RoundRobin), us.Close
+}
+
+func Test_ParseServices(t *testing.T) {
+	services, err := ParseServices(
+		"billing=http://10.0.0.1:8000,http://10.0.0.2:8000; users=http://10.0.1.1:8000")
+	if err != nil {
+		t.Fatalf("unexpected error %s", err.Error())
+	}
+	if len(services["billing"]) != 2 || len(services["users"]) != 1 {
+		t.Errorf("unexpected services %#v", services)
+	}
+	for _, bad := range []string{"billing", "=http://10.0.0.1",
+		"billing=", "billing=ftp://10.0.0.1", "a=http://a;a=http://b"} {
+		if _, err := ParseServices(bad); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func Test_ParseServiceRoutes(t *testing.T) {
+	routes, err := ParseServiceRoutes("/api/billing/=billing;/api/users/=users")
+	if err != nil {
+		t.Fatalf("unexpected error %s", err.Error())
+	}
+	if len(routes) != 2 || routes[1].Prefix != "/api/users/" ||
+		routes[1].Service != "users" {
+		t.Errorf("unexpected routes %#v", routes)
+	}
+	for _, bad := range []string{"api/billing=billing", "/api/billing=",
+		"/api/billing"} {
+		if _, err := ParseServiceRoutes(bad); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func Test_ProxyHandlerServices(t *testing.T) {
+	defaultPool, closeDefault := newNamedUpstream(t, "default")
+	defer closeDefault()
+	billing, closeBilling := newNamedUpstream(t, "billing")
+	defer closeBilling()
+	users, closeUsers := newNamedUpstream(t, "users")
+	defer closeUsers()
+
+	ph := NewPoolProxyHandler(defaultPool)
+	ph.SetServices(map[string]*UpstreamPool{
+		"billing": billing,
+		"users":   users,
+	})
+	if err := ph.SetServiceRoutes([]ServiceRoute{
+		{Prefix: "/api/", Service: "billing"},
+		{Prefix: "/api/users/", Service: "users"},
+	}); err != nil {
+		t.Fatalf("unexpected error %s", err.Error())
+	}
+	if err := ph.SetServiceRoutes([]ServiceRoute{
+		{Prefix: "/api/", Service: "orders"},
+	}); err == nil {
+		t.Errorf("expected error for unknown service")
+	}
+
+	serve := func(req *http.Request) (int, string) {
+		rec := httptest.NewRecorder()
+		ph.ServeHTTP(rec, req)
+		body, _ := ioutil.ReadAll(rec.Body)
+		return rec.Code, string(body)
+	}
+
+	// the matched route upstream wins over the service routes
+	req := httptest.NewRequest(http.MethodGet, "/api/users/1", nil)
+	req = pathmatcher.WithRouteMatch(req, pathmatcher.NewRoutePathMatched(
+		pathmatcher.Route{Method: "GET", Path: "/api/users/{id}",
+			Upstream: "billing"}), nil)
+	if _, body := serve(req); body != "billing" {
+		t.Errorf("want billing, got %q", body)
+	}
+
+	// the matched route path selects the service route
+	req = httptest.NewRequest(http.MethodGet, "/api/users/1", nil)
+	req = pathmatcher.WithRouteMatch(req, pathmatcher.NewPathMatched(
+		"GET", "/api/users/{id}"), nil)
+	if _, body := serve(req); body != "users" {
+		t.Errorf("want users, got %q", body)
+	}
+
+	// without a matched route, the request path is used
+	req = httptest.NewRequest(http.MethodGet, "/api/invoices", nil)
+	if _, body := serve(req); body != "billing" {
+		t.Errorf("want billing, got %q", body)
+	}
+	req = httptest.NewRequest(http.MethodGet, "/health", nil)
+	if _, body := serve(req); body != "default" {
+		t.Errorf("want default, got %q", body)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api/orders/1", nil)
+	req = pathmatcher.WithRouteMatch(req, pathmatcher.NewRoutePathMatched(
+		pathmatcher.Route{Method: "GET", Path: "/api/orders/{id}",
+			Upstream: "orders"}), nil)
+	if code, _ := serve(req); code != http.StatusBadGateway {
+		t.Errorf("want status 502 for unknown service, got %d", code)
+	}
+	if v := metrics.UnknownUpstreamService.Get("orders"); v == nil || v.String() != "1" {
+		t.Errorf("want the unknown service counted, got %v", v)
+	}
+}
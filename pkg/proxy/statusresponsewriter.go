@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// StatusResponseWriter wraps an http.ResponseWriter to record
+// the status code sent to the client, without buffering the
+// response.
+type StatusResponseWriter struct {
+	rw         http.ResponseWriter
+	StatusCode int
+}
+
+func NewStatusResponseWriter(rw http.ResponseWriter) *StatusResponseWriter {
+	return &StatusResponseWriter{
+		rw: rw,
+	}
+}
+
+func (srw *StatusResponseWriter) Header() http.Header {
+	return srw.rw.Header()
+}
+
+func (srw *StatusResponseWriter) Write(data []byte) (int, error) {
+	// WriteHeader only writes the header if it has not been
+	// previously written
+	srw.WriteHeader(http.StatusOK)
+	return srw.rw.Write(data)
+}
+
+func (srw *StatusResponseWriter) WriteHeader(statusCode int) {
+	if srw.StatusCode != 0 {
+		return
+	}
+	srw.StatusCode = statusCode
+	srw.rw.WriteHeader(statusCode)
+}
+
+// Flush sends any buffered data to the client, if the wrapped
+// response writer supports it
+func (srw *StatusResponseWriter) Flush() {
+	if f, ok := srw.rw.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack takes over the client connection, if the wrapped response
+// writer supports it, so it can be upgraded to another protocol
+func (srw *StatusResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := srw.rw.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("the response writer can not be hijacked")
+	}
+	conn, brw, err := hj.Hijack()
+	if err == nil && srw.StatusCode == 0 {
+		srw.StatusCode = http.StatusSwitchingProtocols
+	}
+	return conn, brw, err
+}
+
+// Status returns the status code sent to the client, that
+// defaults to 200 if nothing has been written
+func (srw *StatusResponseWriter) Status() int {
+	if srw.StatusCode == 0 {
+		return http.StatusOK
+	}
+	return srw.StatusCode
+}
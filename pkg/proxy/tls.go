@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// UpstreamTLS defines the TLS connections to the https upstreams:
+//
+//   - CAFile: the PEM encoded CAs to verify the upstream certificates,
+//     instead of the system ones.
+//   - CertFile, KeyFile: the PEM encoded client certificate and key,
+//     for the upstreams that require mutual TLS.
+//   - ServerName: the name sent in the SNI extension, and expected in
+//     the upstream certificates, instead of the upstream host.
+//   - InsecureSkipVerify: do not verify the upstream certificates.
+//     Only for development.
+type UpstreamTLS struct {
+	CAFile             string
+	CertFile           string
+	KeyFile            string
+	ServerName         string
+	InsecureSkipVerify bool
+}
+
+// NewUpstreamTLSConfig creates the TLS configuration for the
+// connections to the upstreams
+func NewUpstreamTLSConfig(conf UpstreamTLS) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         conf.ServerName,
+		InsecureSkipVerify: conf.InsecureSkipVerify,
+	}
+	if len(conf.CAFile) > 0 {
+		pem, err := ioutil.ReadFile(conf.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read upstream CA file: %s", err.Error())
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in upstream CA file %s",
+				conf.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if len(conf.CertFile) > 0 || len(conf.KeyFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load upstream client certificate: %s",
+				err.Error())
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+)
+
+func newTLSTestProxy(t *testing.T, us *httptest.Server,
+	conf UpstreamTLS) *httptest.Server {
+	u, err := url.Parse(us.URL)
+	if err != nil {
+		t.Fatalf("cannot parse upstream url: %s", err.Error())
+	}
+	tlsConfig, err := NewUpstreamTLSConfig(conf)
+	if err != nil {
+		t.Fatalf("cannot create upstream TLS config: %s", err.Error())
+	}
+	ph := NewProxyHandler("https", u.Host)
+	ph.SetTransport(NewTransport(Timeouts{Dial: time.Second}, tlsConfig))
+	return httptest.NewServer(ph)
+}
+
+func Test_ProxyHandlerUpstreamTLS(t *testing.T) {
+	var sni string
+	us := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(rw http.ResponseWriter, req *http.Request) {
+			sni = req.TLS.ServerName
+			rw.WriteHeader(http.StatusOK)
+		}))
+	us.StartTLS()
+	defer us.Close()
+
+	caFile, err := ioutil.TempFile("", "dynlimits_ca")
+	if err != nil {
+		t.Fatalf("cannot create CA file: %s", err.Error())
+	}
+	defer os.Remove(caFile.Name())
+	pem.Encode(caFile, &pem.Block{Type: "CERTIFICATE", Bytes: us.Certificate().Raw})
+	caFile.Close()
+
+	cases := []struct {
+		name       string
+		conf       UpstreamTLS
+		wantStatus int
+		wantSNI    string
+	}{
+		{"unknown CA", UpstreamTLS{}, http.StatusBadGateway, ""},
+		{"custom CA", UpstreamTLS{CAFile: caFile.Name()}, http.StatusOK, ""},
+		{"SNI override", UpstreamTLS{CAFile: caFile.Name(), ServerName: "example.com"},
+			http.StatusOK, "example.com"},
+		{"SNI not in certificate", UpstreamTLS{CAFile: caFile.Name(),
+			ServerName: "other.org"}, http.StatusBadGateway, ""},
+		{"insecure skip verify", UpstreamTLS{InsecureSkipVerify: true},
+			http.StatusOK, ""},
+	}
+	for _, c := range cases {
+		sni = ""
+		ps := newTLSTestProxy(t, us, c.conf)
+		res, err := http.Get(ps.URL)
+		ps.Close()
+		if err != nil {
+			t.Errorf("%s: cannot request proxy: %s", c.name, err.Error())
+			continue
+		}
+		res.Body.Close()
+		if res.StatusCode != c.wantStatus {
+			t.Errorf("%s: want status %d, got %d", c.name, c.wantStatus,
+				res.StatusCode)
+		}
+		if sni != c.wantSNI {
+			t.Errorf("%s: want SNI %q, got %q", c.name, c.wantSNI, sni)
+		}
+	}
+}
+
+func Test_NewUpstreamTLSConfigErrors(t *testing.T) {
+	if _, err := NewUpstreamTLSConfig(UpstreamTLS{CAFile: "/not/found.pem"}); err == nil {
+		t.Errorf("want error for missing CA file")
+	}
+	if _, err := NewUpstreamTLSConfig(UpstreamTLS{CertFile: "/not/found.pem"}); err == nil {
+		t.Errorf("want error for missing client certificate")
+	}
+}
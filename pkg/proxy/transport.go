@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// Timeouts of the requests to the upstreams (zero for no timeout):
+//
+//   - Dial: to establish a connection.
+//   - ResponseHeader: to receive the response headers once the
+//     request has been sent.
+//   - IdleConn: to keep an idle connection open to be reused.
+type Timeouts struct {
+	Dial           time.Duration
+	ResponseHeader time.Duration
+	IdleConn       time.Duration
+}
+
+// NewTransport creates a transport for the upstreams with the
+// timeouts and the TLS configuration (nil for the default one, see
+// NewUpstreamTLSConfig), and the same settings as the
+// http.DefaultTransport for the rest of them.
+//
+// The https upstreams are sent HTTP/2 requests when they support it,
+// and the h2c upstreams always receive cleartext HTTP/2 requests
+// (with prior knowledge).
+func NewTransport(timeouts Timeouts, tlsConfig *tls.Config) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   timeouts.Dial,
+		KeepAlive: 30 * time.Second,
+	}
+	t := &http.Transport{
+		TLSClientConfig:       tlsConfig,
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   100,
+		IdleConnTimeout:       timeouts.IdleConn,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		ResponseHeaderTimeout: timeouts.ResponseHeader,
+	}
+	// the http2.Transport takes the timeouts from the http.Transport
+	// it is configured for (that is only used for its settings), and
+	// configuring a new one can not fail
+	h2t, _ := http2.ConfigureTransports(&http.Transport{
+		IdleConnTimeout:       timeouts.IdleConn,
+		ExpectContinueTimeout: 1 * time.Second,
+		ResponseHeaderTimeout: timeouts.ResponseHeader,
+	})
+	// the configured pool does not dial, as it expects the connections
+	// from the http.Transport, so the default one is used
+	h2t.ConnPool = nil
+	h2t.AllowHTTP = true
+	h2t.DialTLSContext = func(ctx context.Context, network, addr string,
+		_ *tls.Config) (net.Conn, error) {
+		return dialer.DialContext(ctx, network, addr)
+	}
+	t.RegisterProtocol("h2c", &h2cTransport{transport: h2t})
+	return t
+}
+
+// h2cTransport sends the requests with the h2c scheme as cleartext
+// HTTP/2 requests
+type h2cTransport struct {
+	transport *http2.Transport
+}
+
+func (ht *h2cTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// the request must not be modified
+	h2req := new(http.Request)
+	*h2req = *req
+	u := *req.URL
+	u.Scheme = "http"
+	h2req.URL = &u
+	return ht.transport.RoundTrip(h2req)
+}
+
+// SetTransport sets the transport used to send the requests to
+// the upstreams (http.DefaultTransport by default)
+func (ph *ProxyHandler) SetTransport(transport http.RoundTripper) {
+	ph.transport = transport
+}
+
+// errNoUpstream is returned when none of the upstreams of the
+// pool can receive the request
+var errNoUpstream = errors.New("no upstream available")
+
+// upstreamErrorStatus returns the status to send to the client when a
+// request can not be forwarded (504 for the timeouts, 502 otherwise),
+// and the cause of the error for the logs
+func upstreamErrorStatus(err error) (int, string) {
+	if errors.Is(err, errNoUpstream) {
+		return http.StatusBadGateway, "no upstream available"
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusGatewayTimeout, "timeout"
+	}
+	var terr interface{ Timeout() bool }
+	if errors.As(err, &terr) && terr.Timeout() {
+		var operr *net.OpError
+		if errors.As(err, &operr) && operr.Op == "dial" {
+			return http.StatusGatewayTimeout, "dial timeout"
+		}
+		return http.StatusGatewayTimeout, "timeout"
+	}
+	var operr *net.OpError
+	if errors.As(err, &operr) && operr.Op == "dial" {
+		return http.StatusBadGateway, "connection refused"
+	}
+	return http.StatusBadGateway, "connection error"
+}
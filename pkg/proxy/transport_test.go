@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func Test_ProxyHandlerH2CUpstream(t *testing.T) {
+	var proto, te string
+	h2s := &http2.Server{}
+	us := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(
+		func(rw http.ResponseWriter, req *http.Request) {
+			proto = req.Proto
+			te = req.Header.Get("Te")
+			rw.Header().Set("Trailer", "Grpc-Status")
+			rw.WriteHeader(http.StatusOK)
+			rw.Header().Set("Grpc-Status", "0")
+		}), h2s))
+	defer us.Close()
+	u, _ := url.Parse(us.URL)
+
+	up, err := ParseUpstream("h2c://" + u.Host)
+	if err != nil {
+		t.Fatalf("cannot parse h2c upstream: %s", err.Error())
+	}
+	ph := NewPoolProxyHandler(NewUpstreamPool([]*Upstream{up}, RoundRobin))
+	ph.SetTransport(NewTransport(Timeouts{Dial: time.Second}, nil))
+	ps := httptest.NewServer(ph)
+	defer ps.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, ps.URL+"/pkg.Service/Method",
+		strings.NewReader("payload"))
+	req.Header.Set("Te", "trailers")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("cannot request proxy: %s", err.Error())
+	}
+	ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("want status 200, got %d", res.StatusCode)
+	}
+	if proto != "HTTP/2.0" {
+		t.Errorf("want upstream HTTP/2.0 request, got %s", proto)
+	}
+	if te != "trailers" {
+		t.Errorf("want Te trailers forwarded, got %q", te)
+	}
+	if res.Trailer.Get("Grpc-Status") != "0" {
+		t.Errorf("want Grpc-Status trailer, got %v", res.Trailer)
+	}
+}
+
+func Test_ProxyHandlerH2CUpstreamResponseHeaderTimeout(t *testing.T) {
+	release := make(chan struct{})
+	us := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(
+		func(rw http.ResponseWriter, req *http.Request) {
+			<-release
+		}), &http2.Server{}))
+	defer us.Close()
+	defer close(release)
+	u, _ := url.Parse(us.URL)
+
+	up, err := ParseUpstream("h2c://" + u.Host)
+	if err != nil {
+		t.Fatalf("cannot parse h2c upstream: %s", err.Error())
+	}
+	ph := NewPoolProxyHandler(NewUpstreamPool([]*Upstream{up}, RoundRobin))
+	ph.SetTransport(NewTransport(Timeouts{
+		Dial:           time.Second,
+		ResponseHeader: 20 * time.Millisecond,
+	}, nil))
+	rec := httptest.NewRecorder()
+	ph.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Errorf("want status 504, got %d", rec.Code)
+	}
+}
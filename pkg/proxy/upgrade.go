@@ -0,0 +1,213 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MessageLimiter decides if a message received from the client in
+// an upgraded (WebSocket) connection can be forwarded to the upstream
+type MessageLimiter interface {
+	AllowMessage() bool
+}
+
+type messageLimiterKey struct{}
+
+// WithMessageLimiter returns a copy of the request with a limiter for
+// the messages sent by the client once the connection is upgraded
+func WithMessageLimiter(req *http.Request, ml MessageLimiter) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(),
+		messageLimiterKey{}, ml))
+}
+
+// messageLimiter returns the limiter set with WithMessageLimiter (if any)
+func messageLimiter(req *http.Request) MessageLimiter {
+	ml, _ := req.Context().Value(messageLimiterKey{}).(MessageLimiter)
+	return ml
+}
+
+// IsUpgradeRequest returns true if the client asks to switch
+// the connection to another protocol (like WebSocket)
+func IsUpgradeRequest(req *http.Request) bool {
+	return len(upgradeType(req.Header)) > 0
+}
+
+// upgradeType returns the protocol in the Upgrade header, when
+// the Connection header asks for it
+func upgradeType(h http.Header) string {
+	if !headerValuesContainToken(h["Connection"], "Upgrade") {
+		return ""
+	}
+	return h.Get("Upgrade")
+}
+
+// setUpgradeHeaders restores the hop-by-hop headers required
+// to upgrade the connection
+func setUpgradeHeaders(h http.Header, upType string) {
+	h.Set("Connection", "Upgrade")
+	h.Set("Upgrade", upType)
+}
+
+// handleUpgradeResponse sends the upstream 101 response to the client,
+// and pipes the data between both connections until any of them is
+// closed.
+func (ph *ProxyHandler) handleUpgradeResponse(rw http.ResponseWriter,
+	req *http.Request, res *http.Response) {
+	// the body is the upgraded connection to the upstream
+	defer res.Body.Close()
+	reqUpType := upgradeType(req.Header)
+	resUpType := upgradeType(res.Header)
+	if !strings.EqualFold(reqUpType, resUpType) {
+		fmt.Printf("upstream switched to protocol %q when %q was requested\n",
+			resUpType, reqUpType)
+		rw.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	backConn, ok := res.Body.(io.ReadWriteCloser)
+	if !ok {
+		rw.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	hj, ok := rw.(http.Hijacker)
+	if !ok {
+		rw.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	removeHopByHopHeaders(res.Header)
+	setUpgradeHeaders(res.Header, resUpType)
+	copyHeader(rw.Header(), res.Header)
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		fmt.Printf("cannot hijack the connection: %s\n", err.Error())
+		return
+	}
+	defer conn.Close()
+	// the deadlines set by the server for the request are not
+	// valid for the upgraded connection
+	conn.SetDeadline(time.Time{})
+
+	res.Header = rw.Header()
+	res.Body = nil
+	if err := res.Write(brw); err != nil {
+		return
+	}
+	if err := brw.Flush(); err != nil {
+		return
+	}
+
+	clientW := &lockedWriter{w: conn}
+	errc := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(clientW, backConn)
+		errc <- err
+	}()
+	go func() {
+		ml := messageLimiter(req)
+		if ml == nil || !strings.EqualFold(reqUpType, "websocket") {
+			_, err := io.Copy(backConn, brw.Reader)
+			errc <- err
+			return
+		}
+		errc <- copyWebSocketFrames(backConn, brw.Reader, clientW, ml)
+	}()
+	// once any of the sides is done, the connections are closed,
+	// and that finishes the other side too
+	<-errc
+}
+
+// lockedWriter serializes the writes to the client, as the frames
+// from the upstream and the close frame sent when the messages are
+// limited are written from different goroutines
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (lw *lockedWriter) Write(p []byte) (int, error) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	return lw.w.Write(p)
+}
+
+// errMessagesLimited is returned when the client has exceeded
+// its messages limit
+var errMessagesLimited = fmt.Errorf("websocket messages limit exceeded")
+
+// wsPolicyViolation is the WebSocket close code (RFC 6455, section
+// 7.4.1) sent to the clients that exceed their messages limit
+const wsPolicyViolation uint16 = 1008
+
+// copyWebSocketFrames copies the WebSocket frames (RFC 6455) sent by
+// the client to the upstream, checking with the limiter the first
+// frame of each data message. When a message is not allowed, a close
+// frame is sent to the client instead of forwarding it.
+func copyWebSocketFrames(dst io.Writer, src *bufio.Reader, client io.Writer,
+	ml MessageLimiter) error {
+	// the largest frame header: 2 bytes, 8 bytes of extended length
+	// and 4 bytes of masking key
+	var hdr [14]byte
+	for {
+		if _, err := io.ReadFull(src, hdr[:2]); err != nil {
+			return err
+		}
+		hdrLen := 2
+		payloadLen := uint64(hdr[1] & 0x7f)
+		switch payloadLen {
+		case 126:
+			hdrLen += 2
+		case 127:
+			hdrLen += 8
+		}
+		if hdr[1]&0x80 != 0 {
+			// the client frames are masked
+			hdrLen += 4
+		}
+		if _, err := io.ReadFull(src, hdr[2:hdrLen]); err != nil {
+			return err
+		}
+		switch payloadLen {
+		case 126:
+			payloadLen = uint64(binary.BigEndian.Uint16(hdr[2:4]))
+		case 127:
+			payloadLen = binary.BigEndian.Uint64(hdr[2:10])
+		}
+
+		// text (1) and binary (2) frames start a message, while the
+		// continuation (0) and control frames (>= 8) do not count
+		if opcode := hdr[0] & 0x0f; opcode == 1 || opcode == 2 {
+			if !ml.AllowMessage() {
+				client.Write(closeFrame(wsPolicyViolation,
+					"messages limit exceeded"))
+				return errMessagesLimited
+			}
+		}
+		if _, err := dst.Write(hdr[:hdrLen]); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(dst, src, int64(payloadLen)); err != nil {
+			return err
+		}
+	}
+}
+
+// closeFrame returns an unmasked (server to client) close
+// frame, with its status code and reason
+func closeFrame(code uint16, reason string) []byte {
+	// control frames payload can not be longer than 125 bytes
+	if len(reason) > 123 {
+		reason = reason[:123]
+	}
+	frame := make([]byte, 4, 4+len(reason))
+	frame[0] = 0x88 // FIN + close opcode
+	frame[1] = byte(2 + len(reason))
+	binary.BigEndian.PutUint16(frame[2:4], code)
+	return append(frame, reason...)
+}
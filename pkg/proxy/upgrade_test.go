@@ -0,0 +1,175 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// echoUpgradeHandler switches to the requested protocol, and
+// echoes back everything it receives
+var echoUpgradeHandler = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+	if req.Header.Get("Upgrade") != "websocket" ||
+		req.Header.Get("Connection") != "Upgrade" {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	conn, brw, err := rw.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	brw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Connection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+	brw.Flush()
+	io.Copy(conn, brw.Reader)
+})
+
+// dialUpgrade opens a connection to the server, and upgrades it
+// to the websocket protocol
+func dialUpgrade(t *testing.T, addr string) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("cannot dial: %s", err.Error())
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "GET /ws HTTP/1.1\r\nHost: "+addr+"\r\n"+
+		"Connection: keep-alive, Upgrade\r\nUpgrade: websocket\r\n\r\n")
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("cannot read response: %s", err.Error())
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("want status 101, got %d", res.StatusCode)
+	}
+	if res.Header.Get("Upgrade") != "websocket" {
+		t.Fatalf("unexpected Upgrade header %q", res.Header.Get("Upgrade"))
+	}
+	return conn, br
+}
+
+// maskedTextFrame returns a client text frame
+func maskedTextFrame(text string) []byte {
+	mask := []byte{1, 2, 3, 4}
+	frame := []byte{0x81, 0x80 | byte(len(text))}
+	frame = append(frame, mask...)
+	for idx := 0; idx < len(text); idx++ {
+		frame = append(frame, text[idx]^mask[idx%4])
+	}
+	return frame
+}
+
+func Test_ProxyHandlerUpgrade(t *testing.T) {
+	_, ps, closeAll := newTestProxy(t, echoUpgradeHandler)
+	defer closeAll()
+
+	conn, br := dialUpgrade(t, ps.Listener.Addr().String())
+	defer conn.Close()
+
+	io.WriteString(conn, "ping")
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(br, got); err != nil {
+		t.Fatalf("cannot read echo: %s", err.Error())
+	}
+	if string(got) != "ping" {
+		t.Errorf("want ping, got %q", got)
+	}
+}
+
+type countingMessageLimiter struct {
+	max   int
+	count int
+}
+
+func (cml *countingMessageLimiter) AllowMessage() bool {
+	cml.count++
+	return cml.count <= cml.max
+}
+
+func Test_ProxyHandlerUpgradeMessageLimiter(t *testing.T) {
+	ml := &countingMessageLimiter{max: 2}
+	ph, _, closeAll := newTestProxy(t, echoUpgradeHandler)
+	defer closeAll()
+	ps := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		ph.ServeHTTP(rw, WithMessageLimiter(req, ml))
+	}))
+	defer ps.Close()
+
+	conn, br := dialUpgrade(t, ps.Listener.Addr().String())
+	defer conn.Close()
+
+	for _, msg := range []string{"one", "two"} {
+		frame := maskedTextFrame(msg)
+		conn.Write(frame)
+		got := make([]byte, len(frame))
+		if _, err := io.ReadFull(br, got); err != nil {
+			t.Fatalf("cannot read echo: %s", err.Error())
+		}
+		if string(got) != string(frame) {
+			t.Errorf("want echoed frame %v, got %v", frame, got)
+		}
+	}
+
+	conn.Write(maskedTextFrame("three"))
+	hdr := make([]byte, 4)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		t.Fatalf("cannot read close frame: %s", err.Error())
+	}
+	if hdr[0] != 0x88 {
+		t.Fatalf("want close frame, got %x", hdr[0])
+	}
+	if code := binary.BigEndian.Uint16(hdr[2:4]); code != wsPolicyViolation {
+		t.Errorf("want close code %d, got %d", wsPolicyViolation, code)
+	}
+	reason := make([]byte, int(hdr[1])-2)
+	io.ReadFull(br, reason)
+	if _, err := br.ReadByte(); err == nil {
+		t.Errorf("the connection should be closed")
+	}
+}
+
+func Test_ProxyHandlerUpgradeProtocolMismatch(t *testing.T) {
+	closed := make(chan error, 1)
+	_, ps, closeAll := newTestProxy(t, http.HandlerFunc(
+		func(rw http.ResponseWriter, req *http.Request) {
+			conn, brw, err := rw.(http.Hijacker).Hijack()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			brw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+				"Connection: Upgrade\r\nUpgrade: other\r\n\r\n")
+			brw.Flush()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			_, err = brw.ReadByte()
+			closed <- err
+		}))
+	defer closeAll()
+
+	addr := ps.Listener.Addr().String()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("cannot dial: %s", err.Error())
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "GET /ws HTTP/1.1\r\nHost: "+addr+"\r\n"+
+		"Connection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("cannot read response: %s", err.Error())
+	}
+	if res.StatusCode != http.StatusBadGateway {
+		t.Errorf("want status 502, got %d", res.StatusCode)
+	}
+	// the upgraded connection to the upstream is closed
+	if err := <-closed; err != io.EOF {
+		t.Errorf("want the upstream connection closed, got %v", err)
+	}
+}
@@ -0,0 +1,392 @@
+package proxy
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dhontecillas/dynlimits/pkg/metrics"
+)
+
+// BalancingStrategy selects how the requests are distributed
+// among the upstreams of a pool
+type BalancingStrategy int
+
+const (
+	// RoundRobin sends the requests to each upstream in turn
+	RoundRobin BalancingStrategy = iota
+	// LeastConnections sends the requests to the upstream with
+	// less requests in flight
+	LeastConnections
+	// ConsistentHash sends the requests with the same api key to
+	// the same upstream, and only moves the ones of an upstream
+	// when it is not available
+	ConsistentHash
+)
+
+// ParseBalancingStrategy converts a strategy name (`roundrobin`,
+// `leastconn` or `hash`) to its BalancingStrategy value
+func ParseBalancingStrategy(name string) (BalancingStrategy, error) {
+	switch strings.ToLower(name) {
+	case "", "roundrobin":
+		return RoundRobin, nil
+	case "leastconn":
+		return LeastConnections, nil
+	case "hash":
+		return ConsistentHash, nil
+	}
+	return RoundRobin, fmt.Errorf("balancing strategy %q not valid", name)
+}
+
+// Upstream is a server the requests can be forwarded to
+//
+// An upstream is available when it passes the active health checks
+// (if enabled), it has not been ejected because of its errors, and
+// its circuit (if any) lets the requests pass.
+type Upstream struct {
+	Scheme string
+	Addr   string
+
+	inFlight     int64
+	unhealthy    int32
+	ejectedUntil int64 // unix nanoseconds
+	breaker      *breaker
+
+	mu          sync.Mutex // protects the counters below
+	failures    int
+	checkPassed int
+	checkFailed int
+}
+
+// NewUpstream creates an upstream from its scheme and address
+// (`host:port`)
+func NewUpstream(scheme string, addr string) *Upstream {
+	return &Upstream{
+		Scheme: scheme,
+		Addr:   addr,
+	}
+}
+
+// ParseUpstream creates an upstream from its base url (like
+// `http://10.0.0.1:8000`). The `h2c` scheme is for the upstreams
+// that use cleartext HTTP/2 (see NewTransport).
+func ParseUpstream(rawURL string) (*Upstream, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("bad upstream %q: %s", rawURL, err.Error())
+	}
+	if u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "h2c" {
+		return nil, fmt.Errorf("bad upstream %q: scheme must be http, https or h2c",
+			rawURL)
+	}
+	if len(u.Host) == 0 {
+		return nil, fmt.Errorf("bad upstream %q: missing host", rawURL)
+	}
+	return NewUpstream(u.Scheme, u.Host), nil
+}
+
+// ParseUpstreams creates the upstreams from a comma separated
+// list of base urls
+func ParseUpstreams(list string) ([]*Upstream, error) {
+	var ups []*Upstream
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if len(s) == 0 {
+			continue
+		}
+		u, err := ParseUpstream(s)
+		if err != nil {
+			return nil, err
+		}
+		ups = append(ups, u)
+	}
+	return ups, nil
+}
+
+func (u *Upstream) String() string {
+	return u.Scheme + "://" + u.Addr
+}
+
+// InFlight returns the number of requests being forwarded
+// to the upstream
+func (u *Upstream) InFlight() int64 {
+	return atomic.LoadInt64(&u.inFlight)
+}
+
+// Available returns true if requests can be sent to the upstream
+func (u *Upstream) Available() bool {
+	return u.available(true)
+}
+
+// available returns true if requests can be sent to the upstream,
+// ignoring if it has been ejected when ejection is false
+func (u *Upstream) available(ejection bool) bool {
+	if atomic.LoadInt32(&u.unhealthy) != 0 {
+		return false
+	}
+	now := time.Now()
+	if ejection && now.UnixNano() < atomic.LoadInt64(&u.ejectedUntil) {
+		return false
+	}
+	return u.breaker == nil || u.breaker.available(now)
+}
+
+// PassiveEjection ejects an upstream from the pool for EjectFor
+// once it fails MaxFails requests in a row (0 disables it). A
+// request fails when it can not be forwarded or the upstream
+// answers with a 502, 503 or 504 status. The last available
+// upstream of a pool is not ejected.
+type PassiveEjection struct {
+	MaxFails int
+	EjectFor time.Duration
+}
+
+// ringPoint is a point of the consistent hash ring
+type ringPoint struct {
+	hash     uint32
+	upstream *Upstream
+}
+
+// ringReplicas is the number of points of each upstream in the
+// consistent hash ring, so the keys are evenly distributed
+const ringReplicas int = 100
+
+// UpstreamPool selects the upstream for each request with its
+// balancing strategy, among the available ones. When none of them
+// is available, no upstream is selected.
+type UpstreamPool struct {
+	upstreams  []*Upstream
+	strategy   BalancingStrategy
+	hashHeader string
+	ring       []ringPoint
+	next       uint64
+	ejection   PassiveEjection
+	retries    *retryBudget
+
+	stopChecks chan struct{}
+}
+
+// NewUpstreamPool creates a pool with the upstreams, that uses
+// the `X-Api-Key` header for the ConsistentHash strategy.
+func NewUpstreamPool(upstreams []*Upstream, strategy BalancingStrategy) *UpstreamPool {
+	up := &UpstreamPool{
+		upstreams:  upstreams,
+		strategy:   strategy,
+		hashHeader: "X-Api-Key",
+	}
+	for _, u := range upstreams {
+		for idx := 0; idx < ringReplicas; idx++ {
+			up.ring = append(up.ring, ringPoint{
+				hash:     hashKey(u.Addr + "#" + strconv.Itoa(idx)),
+				upstream: u,
+			})
+		}
+		metrics.UpstreamHealthy.Set(u.String(), upstreamHealthyValue(1))
+	}
+	sort.Slice(up.ring, func(i, j int) bool {
+		return up.ring[i].hash < up.ring[j].hash
+	})
+	return up
+}
+
+// SetHashHeader sets the header with the api key used by the
+// ConsistentHash strategy
+func (up *UpstreamPool) SetHashHeader(header string) {
+	up.hashHeader = header
+}
+
+// SetPassiveEjection sets when the upstreams are ejected because
+// of their errors
+func (up *UpstreamPool) SetPassiveEjection(pe PassiveEjection) {
+	up.ejection = pe
+}
+
+// SetRetryPolicy sets when the failed requests are retried, with
+// a retry budget for the pool
+func (up *UpstreamPool) SetRetryPolicy(rp RetryPolicy) {
+	if rp.MaxRetries <= 0 {
+		up.retries = nil
+		return
+	}
+	up.retries = newRetryBudget(rp)
+}
+
+// Upstreams returns the upstreams of the pool
+func (up *UpstreamPool) Upstreams() []*Upstream {
+	return up.upstreams
+}
+
+// Pick selects the upstream for the request, or returns nil if
+// none of them is available. When all the upstreams that are not
+// unhealthy have been ejected, the ejection is ignored, so the
+// errors of the upstreams do not take the whole pool out.
+func (up *UpstreamPool) Pick(req *http.Request) *Upstream {
+	if u := up.pick(req, true); u != nil {
+		return u
+	}
+	return up.pick(req, false)
+}
+
+// pick selects the upstream for the request with the balancing
+// strategy, ignoring the ejections when ejection is false
+func (up *UpstreamPool) pick(req *http.Request, ejection bool) *Upstream {
+	switch len(up.upstreams) {
+	case 0:
+		return nil
+	case 1:
+		if up.upstreams[0].available(ejection) {
+			return up.upstreams[0]
+		}
+		return nil
+	}
+	switch up.strategy {
+	case LeastConnections:
+		return up.pickLeastConnections(ejection)
+	case ConsistentHash:
+		return up.pickHash(req.Header.Get(up.hashHeader), ejection)
+	}
+	return up.pickRoundRobin(ejection)
+}
+
+func (up *UpstreamPool) pickRoundRobin(ejection bool) *Upstream {
+	n := uint64(len(up.upstreams))
+	start := atomic.AddUint64(&up.next, 1)
+	for idx := uint64(0); idx < n; idx++ {
+		if u := up.upstreams[(start+idx)%n]; u.available(ejection) {
+			return u
+		}
+	}
+	return nil
+}
+
+// pickLeastConnections starts at a different upstream each time,
+// so the ties are distributed among the upstreams
+func (up *UpstreamPool) pickLeastConnections(ejection bool) *Upstream {
+	n := uint64(len(up.upstreams))
+	start := atomic.AddUint64(&up.next, 1)
+	var best *Upstream
+	for idx := uint64(0); idx < n; idx++ {
+		u := up.upstreams[(start+idx)%n]
+		if !u.available(ejection) {
+			continue
+		}
+		if best == nil || u.InFlight() < best.InFlight() {
+			best = u
+		}
+	}
+	return best
+}
+
+// pickHash selects the first available upstream found in the ring
+// from the key hash
+func (up *UpstreamPool) pickHash(key string, ejection bool) *Upstream {
+	h := hashKey(key)
+	start := sort.Search(len(up.ring), func(i int) bool {
+		return up.ring[i].hash >= h
+	})
+	for idx := 0; idx < len(up.ring); idx++ {
+		if u := up.ring[(start+idx)%len(up.ring)].upstream; u.available(ejection) {
+			return u
+		}
+	}
+	return nil
+}
+
+func hashKey(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
+
+// acquire counts a request in flight to the upstream, and returns
+// the function to call when it is completed. It returns false if
+// the request can not be sent, because the circuit of the upstream
+// is half open and all its probe slots have been taken since it
+// was picked.
+func (up *UpstreamPool) acquire(u *Upstream) (func(), bool) {
+	endProbe := func() {}
+	if u.breaker != nil {
+		var ok bool
+		if endProbe, ok = u.breaker.start(); !ok {
+			return nil, false
+		}
+	}
+	atomic.AddInt64(&u.inFlight, 1)
+	return func() {
+		atomic.AddInt64(&u.inFlight, -1)
+		endProbe()
+	}, true
+}
+
+// pickAndAcquire selects the upstream for the request and acquires
+// it, picking again (up to once per upstream) if it can not be
+// acquired. It returns nil if no upstream can receive the request.
+func (up *UpstreamPool) pickAndAcquire(req *http.Request) (*Upstream, func()) {
+	for attempt := 0; attempt < len(up.upstreams); attempt++ {
+		u := up.Pick(req)
+		if u == nil {
+			return nil, nil
+		}
+		if release, ok := up.acquire(u); ok {
+			return u, release
+		}
+	}
+	return nil, nil
+}
+
+// observe records the result of a request to the upstream, for
+// the circuit breaker and the passive ejection
+func (up *UpstreamPool) observe(u *Upstream, statusCode int, err error) {
+	failed := err != nil || statusCode == http.StatusBadGateway ||
+		statusCode == http.StatusServiceUnavailable ||
+		statusCode == http.StatusGatewayTimeout
+	up.observeBreaker(u, failed)
+	if up.ejection.MaxFails <= 0 {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if !failed {
+		u.failures = 0
+		return
+	}
+	u.failures++
+	if u.failures < up.ejection.MaxFails {
+		return
+	}
+	u.failures = 0
+	if !up.availableBesides(u) {
+		// the last available upstream is not ejected
+		return
+	}
+	atomic.StoreInt64(&u.ejectedUntil,
+		time.Now().Add(up.ejection.EjectFor).UnixNano())
+	// TODO: change this for a log
+	fmt.Printf("upstream %s ejected for %s\n", u.String(), up.ejection.EjectFor)
+}
+
+// availableBesides returns true if there is an available upstream
+// in the pool other than u
+func (up *UpstreamPool) availableBesides(u *Upstream) bool {
+	for _, other := range up.upstreams {
+		if other != u && other.Available() {
+			return true
+		}
+	}
+	return false
+}
+
+// upstreamHealthyValue is an expvar.Var for the health of
+// an upstream (1 when healthy, 0 when not)
+type upstreamHealthyValue int
+
+func (v upstreamHealthyValue) String() string {
+	return strconv.Itoa(int(v))
+}
@@ -0,0 +1,223 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestUpstreams(n int) []*Upstream {
+	ups := make([]*Upstream, n)
+	for idx := range ups {
+		ups[idx] = NewUpstream("http", fmt.Sprintf("10.0.0.%d:8000", idx+1))
+	}
+	return ups
+}
+
+func newKeyRequest(apiKey string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Api-Key", apiKey)
+	return req
+}
+
+func Test_ParseUpstreams(t *testing.T) {
+	ups, err := ParseUpstreams("http://10.0.0.1:8000, https://api.example.com")
+	if err != nil {
+		t.Fatalf("unexpected error %s", err.Error())
+	}
+	if len(ups) != 2 || ups[0].String() != "http://10.0.0.1:8000" ||
+		ups[1].Scheme != "https" || ups[1].Addr != "api.example.com" {
+		t.Errorf("unexpected upstreams %v", ups)
+	}
+	for _, bad := range []string{"ftp://10.0.0.1", "10.0.0.1:8000", "http://"} {
+		if _, err := ParseUpstreams(bad); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func Test_ParseBalancingStrategy(t *testing.T) {
+	for name, want := range map[string]BalancingStrategy{
+		"":           RoundRobin,
+		"roundrobin": RoundRobin,
+		"LeastConn":  LeastConnections,
+		"hash":       ConsistentHash,
+	} {
+		got, err := ParseBalancingStrategy(name)
+		if err != nil || got != want {
+			t.Errorf("%q: want %d, got %d (err: %v)", name, want, got, err)
+		}
+	}
+	if _, err := ParseBalancingStrategy("random"); err == nil {
+		t.Errorf("expected error for unknown strategy")
+	}
+}
+
+func Test_UpstreamPoolRoundRobin(t *testing.T) {
+	ups := newTestUpstreams(3)
+	up := NewUpstreamPool(ups, RoundRobin)
+	picked := make(map[*Upstream]int)
+	for idx := 0; idx < 9; idx++ {
+		picked[up.Pick(newKeyRequest("k"))]++
+	}
+	for _, u := range ups {
+		if picked[u] != 3 {
+			t.Errorf("%s: want 3 requests, got %d", u, picked[u])
+		}
+	}
+}
+
+func Test_UpstreamPoolLeastConnections(t *testing.T) {
+	ups := newTestUpstreams(3)
+	up := NewUpstreamPool(ups, LeastConnections)
+	release0, _ := up.acquire(ups[0])
+	up.acquire(ups[2])
+	for idx := 0; idx < 5; idx++ {
+		if u := up.Pick(newKeyRequest("k")); u != ups[1] {
+			t.Fatalf("want %s, got %s", ups[1], u)
+		}
+	}
+	up.acquire(ups[1])
+	up.acquire(ups[1])
+	release0()
+	if u := up.Pick(newKeyRequest("k")); u != ups[0] {
+		t.Errorf("want %s, got %s", ups[0], u)
+	}
+}
+
+func Test_UpstreamPoolConsistentHash(t *testing.T) {
+	ups := newTestUpstreams(3)
+	up := NewUpstreamPool(ups, ConsistentHash)
+	up.SetPassiveEjection(PassiveEjection{MaxFails: 1, EjectFor: time.Minute})
+
+	keys := make([]string, 50)
+	before := make(map[string]*Upstream)
+	for idx := range keys {
+		keys[idx] = fmt.Sprintf("key-%d", idx)
+		before[keys[idx]] = up.Pick(newKeyRequest(keys[idx]))
+		if again := up.Pick(newKeyRequest(keys[idx])); again != before[keys[idx]] {
+			t.Fatalf("key %s moved from %s to %s", keys[idx],
+				before[keys[idx]], again)
+		}
+	}
+
+	// only the keys of the ejected upstream move
+	up.observe(ups[0], 0, errors.New("connection refused"))
+	for _, k := range keys {
+		u := up.Pick(newKeyRequest(k))
+		if u == ups[0] {
+			t.Fatalf("key %s sent to the ejected upstream", k)
+		}
+		if before[k] != ups[0] && u != before[k] {
+			t.Errorf("key %s moved from %s to %s", k, before[k], u)
+		}
+	}
+}
+
+func Test_UpstreamPoolPassiveEjection(t *testing.T) {
+	ups := newTestUpstreams(2)
+	up := NewUpstreamPool(ups, RoundRobin)
+	up.SetPassiveEjection(PassiveEjection{MaxFails: 2, EjectFor: time.Minute})
+
+	up.observe(ups[0], http.StatusServiceUnavailable, nil)
+	up.observe(ups[0], http.StatusOK, nil)
+	up.observe(ups[0], http.StatusBadGateway, nil)
+	if !ups[0].Available() {
+		t.Fatalf("the failures count must be reset by a success")
+	}
+	up.observe(ups[0], http.StatusGatewayTimeout, nil)
+	if ups[0].Available() {
+		t.Fatalf("the upstream should be ejected")
+	}
+	for idx := 0; idx < 4; idx++ {
+		if u := up.Pick(newKeyRequest("k")); u != ups[1] {
+			t.Errorf("want %s, got %s", ups[1], u)
+		}
+	}
+	// the last available upstream is not ejected
+	up.observe(ups[1], 0, errors.New("timeout"))
+	up.observe(ups[1], 0, errors.New("timeout"))
+	if !ups[1].Available() {
+		t.Errorf("the last available upstream must not be ejected")
+	}
+
+	// if all of them end up ejected, they still receive the requests
+	atomic.StoreInt64(&ups[1].ejectedUntil, time.Now().Add(time.Minute).UnixNano())
+	if u := up.Pick(newKeyRequest("k")); u == nil {
+		t.Errorf("want an ejected upstream picked, got none")
+	}
+	atomic.StoreInt32(&ups[0].unhealthy, 1)
+	atomic.StoreInt32(&ups[1].unhealthy, 1)
+	if u := up.Pick(newKeyRequest("k")); u != nil {
+		t.Errorf("want no upstream available, got %s", u)
+	}
+}
+
+func Test_UpstreamPoolPassiveEjectionSingleUpstream(t *testing.T) {
+	ups := newTestUpstreams(1)
+	up := NewUpstreamPool(ups, RoundRobin)
+	up.SetPassiveEjection(PassiveEjection{MaxFails: 2, EjectFor: time.Minute})
+
+	for idx := 0; idx < 5; idx++ {
+		up.observe(ups[0], http.StatusServiceUnavailable, nil)
+	}
+	if u := up.Pick(newKeyRequest("k")); u != ups[0] {
+		t.Errorf("want %s, got %v", ups[0], u)
+	}
+}
+
+func Test_UpstreamPoolHealthChecks(t *testing.T) {
+	var healthy int32 = 1
+	us := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/health" || atomic.LoadInt32(&healthy) == 0 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer us.Close()
+	u, err := ParseUpstream(us.URL)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err.Error())
+	}
+	up := NewUpstreamPool([]*Upstream{u}, RoundRobin)
+	up.StartHealthChecks(HealthCheck{
+		Path:               "/health",
+		Interval:           5 * time.Millisecond,
+		Timeout:            time.Second,
+		UnhealthyThreshold: 2,
+		HealthyThreshold:   2,
+	})
+	defer up.StopHealthChecks()
+
+	waitFor := func(available bool) {
+		deadline := time.Now().Add(2 * time.Second)
+		for u.Available() != available {
+			if time.Now().After(deadline) {
+				t.Fatalf("want available %t", available)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	atomic.StoreInt32(&healthy, 0)
+	waitFor(false)
+	atomic.StoreInt32(&healthy, 1)
+	waitFor(true)
+}
+
+func Test_ProxyHandlerNoUpstreamAvailable(t *testing.T) {
+	ups := newTestUpstreams(1)
+	up := NewUpstreamPool(ups, RoundRobin)
+	up.SetPassiveEjection(PassiveEjection{MaxFails: 1, EjectFor: time.Minute})
+	up.observe(ups[0], 0, errors.New("connection refused"))
+
+	rec := httptest.NewRecorder()
+	NewPoolProxyHandler(up).ServeHTTP(rec, newKeyRequest("k"))
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("want status 502, got %d", rec.Code)
+	}
+}
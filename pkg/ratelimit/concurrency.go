@@ -0,0 +1,187 @@
+package ratelimit
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+const (
+	RedisConcurrencyPattern string = "dynlimits_inflight_%s"
+)
+
+// ConcurrencyLimiter limits the number of requests that can be
+// in flight at the same time for a given key.
+//
+// Acquire tries to get a slot for the key, and returns if it has
+// been acquired, and a function to release the slot once the
+// request has been completed.
+type ConcurrencyLimiter interface {
+	Acquire(key string, limit int64) (release func(), acquired bool, err error)
+}
+
+// InMemConcurrencyLimiter keeps the count of in flight requests
+// in memory, so the limits are only local to the proxy instance.
+type InMemConcurrencyLimiter struct {
+	access   sync.Mutex
+	inFlight map[string]int64
+}
+
+// NewInMemConcurrencyLimiter creates a new InMemConcurrencyLimiter
+func NewInMemConcurrencyLimiter() *InMemConcurrencyLimiter {
+	return &InMemConcurrencyLimiter{
+		inFlight: make(map[string]int64),
+	}
+}
+
+// Acquire gets a slot for the key if there are less than
+// limit requests in flight.
+func (imcl *InMemConcurrencyLimiter) Acquire(key string,
+	limit int64) (func(), bool, error) {
+	imcl.access.Lock()
+	defer imcl.access.Unlock()
+	if imcl.inFlight[key] >= limit {
+		return nil, false, nil
+	}
+	imcl.inFlight[key]++
+
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			imcl.access.Lock()
+			imcl.inFlight[key]--
+			if imcl.inFlight[key] <= 0 {
+				delete(imcl.inFlight, key)
+			}
+			imcl.access.Unlock()
+		})
+	}
+	return release, true, nil
+}
+
+// InFlight returns the number of requests in flight for a key
+func (imcl *InMemConcurrencyLimiter) InFlight(key string) int64 {
+	imcl.access.Lock()
+	defer imcl.access.Unlock()
+	return imcl.inFlight[key]
+}
+
+// RedisConcurrencyLimiter shares the count of in flight requests
+// between proxy instances using a redis sorted set per key, where
+// each in flight request holds a lease with an expiration time.
+//
+// The leases are renewed while the request is in flight, so if a
+// proxy instance dies, its leases expire after leaseTTL.
+type RedisConcurrencyLimiter struct {
+	redisPool *redis.Pool
+	leaseTTL  time.Duration
+}
+
+// NewRedisConcurrencyLimiter creates a new RedisConcurrencyLimiter
+func NewRedisConcurrencyLimiter(redisPool *redis.Pool,
+	leaseTTL time.Duration) *RedisConcurrencyLimiter {
+	if leaseTTL < time.Second {
+		leaseTTL = time.Second
+	}
+	return &RedisConcurrencyLimiter{
+		redisPool: redisPool,
+		leaseTTL:  leaseTTL,
+	}
+}
+
+// Acquire gets a lease for the key if there are less than
+// limit non expired leases.
+func (rcl *RedisConcurrencyLimiter) Acquire(key string,
+	limit int64) (func(), bool, error) {
+	lease, err := newLeaseID()
+	if err != nil {
+		return nil, false, err
+	}
+	setKey := fmt.Sprintf(RedisConcurrencyPattern, key)
+
+	conn := rcl.redisPool.Get()
+	defer conn.Close()
+
+	// we add the lease first, and then check the number of leases, so
+	// concurrent requests from different proxies can never get more
+	// than limit leases
+	nowMs := time.Now().UnixNano() / int64(time.Millisecond)
+	ttlMs := int64(rcl.leaseTTL / time.Millisecond)
+	if err = conn.Send("MULTI"); err != nil {
+		return nil, false, err
+	}
+	if err = conn.Send("ZREMRANGEBYSCORE", setKey, "-inf", nowMs); err != nil {
+		return nil, false, err
+	}
+	if err = conn.Send("ZADD", setKey, nowMs+ttlMs, lease); err != nil {
+		return nil, false, err
+	}
+	if err = conn.Send("ZCARD", setKey); err != nil {
+		return nil, false, err
+	}
+	if err = conn.Send("PEXPIRE", setKey, ttlMs); err != nil {
+		return nil, false, err
+	}
+	res, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return nil, false, err
+	}
+	if len(res) != 4 {
+		return nil, false, fmt.Errorf("unexpected number of results %d", len(res))
+	}
+	inFlight, err := redis.Int64(res[2], nil)
+	if err != nil {
+		return nil, false, err
+	}
+	if inFlight > limit {
+		_, err = conn.Do("ZREM", setKey, lease)
+		return nil, false, err
+	}
+
+	done := make(chan struct{})
+	go rcl.keepAlive(setKey, lease, done)
+
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			close(done)
+			conn := rcl.redisPool.Get()
+			defer conn.Close()
+			conn.Do("ZREM", setKey, lease)
+		})
+	}
+	return release, true, nil
+}
+
+// keepAlive renews the lease until the done channel is closed
+func (rcl *RedisConcurrencyLimiter) keepAlive(setKey string, lease string,
+	done <-chan struct{}) {
+	ticker := time.NewTicker(rcl.leaseTTL / 3)
+	defer ticker.Stop()
+	ttlMs := int64(rcl.leaseTTL / time.Millisecond)
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			nowMs := time.Now().UnixNano() / int64(time.Millisecond)
+			conn := rcl.redisPool.Get()
+			conn.Send("ZADD", setKey, "XX", nowMs+ttlMs, lease)
+			conn.Do("PEXPIRE", setKey, ttlMs)
+			conn.Close()
+		}
+	}
+}
+
+// newLeaseID creates a random id for a lease
+func newLeaseID() (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
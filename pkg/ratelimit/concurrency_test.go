@@ -0,0 +1,45 @@
+package ratelimit
+
+import (
+	"testing"
+)
+
+func Test_InMemConcurrencyLimiter(t *testing.T) {
+	imcl := NewInMemConcurrencyLimiter()
+
+	releaseA, ok, _ := imcl.Acquire("k", 2)
+	if !ok {
+		t.Errorf("want first slot acquired")
+		return
+	}
+	releaseB, ok, _ := imcl.Acquire("k", 2)
+	if !ok {
+		t.Errorf("want second slot acquired")
+		return
+	}
+	if _, ok, _ = imcl.Acquire("k", 2); ok {
+		t.Errorf("want third slot rejected")
+		return
+	}
+	// other keys have their own slots
+	if _, ok, _ = imcl.Acquire("other", 2); !ok {
+		t.Errorf("want slot for other key acquired")
+		return
+	}
+
+	releaseA()
+	// releasing twice has no effect
+	releaseA()
+	if imcl.InFlight("k") != 1 {
+		t.Errorf("want 1 in flight, got %d", imcl.InFlight("k"))
+		return
+	}
+	if _, ok, _ = imcl.Acquire("k", 2); !ok {
+		t.Errorf("want slot acquired after release")
+		return
+	}
+	releaseB()
+	if imcl.InFlight("k") != 1 {
+		t.Errorf("want 1 in flight, got %d", imcl.InFlight("k"))
+	}
+}
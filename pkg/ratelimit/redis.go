@@ -58,18 +58,35 @@ func NewRedisPool(conf *RedisPoolConf) *redis.Pool {
 }
 
 // AdToRedisSlidingCountersWindow increments the counters for a
-// a give second timestamp
+// a give second timestamp by the cost of the request
 func AddToRedisSlidingCountersWindow(conn redis.Conn, key string,
-	timestampSec int64) error {
+	timestampSec int64, cost int64) error {
+	return AddToRedisSlidingCountersWindows(conn, []string{key},
+		timestampSec, cost)
+}
+
+// AddToRedisSlidingCountersWindows increments the counters of several
+// keys for a given second timestamp by the cost of the request, in a
+// single round trip
+func AddToRedisSlidingCountersWindows(conn redis.Conn, keys []string,
+	timestampSec int64, cost int64) error {
 
 	min := timestampSec / 60
 	secIdx := timestampSec % 60
-	sliceName := fmt.Sprintf(RedisSlidingCountersWindowPattern, min, key)
 	var err error
-	if err = conn.Send("HINCRBY", sliceName, secIdx, 1); err != nil {
-		return err
+	for idx, key := range keys {
+		sliceName := fmt.Sprintf(RedisSlidingCountersWindowPattern, min, key)
+		if err = conn.Send("HINCRBY", sliceName, secIdx, cost); err != nil {
+			return err
+		}
+		if idx < len(keys)-1 {
+			if err = conn.Send("EXPIRE", sliceName, 3*60); err != nil {
+				return err
+			}
+			continue
+		}
+		_, err = conn.Do("EXPIRE", sliceName, 3*60)
 	}
-	_, err = conn.Do("EXPIRE", sliceName, 3*60)
 	return err
 }
 
@@ -80,20 +97,46 @@ func SetRedisRateLimit(conn redis.Conn, key string, reqPerMin int64) error {
 	return err
 }
 
+// WindowQuery selects a SlidingCountersWindow to fetch from redis.
+// If ReqPerMin is zero, the limit for the key is read from redis too,
+// from LimitKey if it is set (so several counters can share the
+// same limit), or from Key otherwise.
+type WindowQuery struct {
+	Key       string
+	LimitKey  string
+	ReqPerMin int64
+}
+
 // GetRedisSlidingCountersWindow returns an SlidingCountersWindow for
 // a given Key
 func GetRedisSlidingCountersWindow(conn redis.Conn, key string,
 	timestampSec int64) (*SlidingCountersWindow, error) {
-	min := timestampSec / 60
-	curSecIdx := timestampSec % 60
+	wnds, err := GetRedisSlidingCountersWindows(conn, timestampSec,
+		WindowQuery{Key: key})
+	if err != nil {
+		return nil, err
+	}
+	return wnds[0], nil
+}
 
-	rrl := SlidingCountersWindow{
-		ReqPerMin: 600,
+// GetRedisSlidingCountersWindowWithLimit returns an SlidingCountersWindow
+// for a given Key, using the provided limit instead of reading it
+// from redis.
+func GetRedisSlidingCountersWindowWithLimit(conn redis.Conn, key string,
+	timestampSec int64, reqPerMin int64) (*SlidingCountersWindow, error) {
+	wnds, err := GetRedisSlidingCountersWindows(conn, timestampSec,
+		WindowQuery{Key: key, ReqPerMin: reqPerMin})
+	if err != nil {
+		return nil, err
 	}
+	return wnds[0], nil
+}
 
-	rateLimitKey := fmt.Sprintf(RedisReqPerMinPattern, key)
-	curSlice := fmt.Sprintf(RedisSlidingCountersWindowPattern, min, key)
-	prevSlice := fmt.Sprintf(RedisSlidingCountersWindowPattern, min-1, key)
+// GetRedisSlidingCountersWindows returns the SlidingCountersWindow for
+// each one of the queries, fetching all of them in a single round trip.
+func GetRedisSlidingCountersWindows(conn redis.Conn, timestampSec int64,
+	queries ...WindowQuery) ([]*SlidingCountersWindow, error) {
+	min := timestampSec / 60
 
 	// fetch current slice of seconds, and previous one, to
 	// get our "custom" slice ending  at the current second
@@ -101,44 +144,83 @@ func GetRedisSlidingCountersWindow(conn redis.Conn, key string,
 	if err = conn.Send("MULTI"); err != nil {
 		return nil, err
 	}
-	if err = conn.Send("GET", rateLimitKey); err != nil {
-		return nil, err
-	}
-	if err = conn.Send("HGETALL", curSlice); err != nil {
-		return nil, err
-	}
-	if err = conn.Send("HGETALL", prevSlice); err != nil {
-		return nil, err
+	for _, q := range queries {
+		if q.ReqPerMin <= 0 {
+			limitKey := q.Key
+			if q.LimitKey != "" {
+				limitKey = q.LimitKey
+			}
+			rateLimitKey := fmt.Sprintf(RedisReqPerMinPattern, limitKey)
+			if err = conn.Send("GET", rateLimitKey); err != nil {
+				return nil, err
+			}
+		}
+		curSlice := fmt.Sprintf(RedisSlidingCountersWindowPattern, min, q.Key)
+		prevSlice := fmt.Sprintf(RedisSlidingCountersWindowPattern, min-1, q.Key)
+		if err = conn.Send("HGETALL", curSlice); err != nil {
+			return nil, err
+		}
+		if err = conn.Send("HGETALL", prevSlice); err != nil {
+			return nil, err
+		}
 	}
 	res, err := redis.Values(conn.Do("EXEC"))
 	if err != nil {
 		return nil, err
 	}
 
-	// read the limit (if not set the result would be nil)
-	if res[0] == nil {
-		// there is no rate limit for this api key + endpoint
-		// TODO: define per configuration what to do if there
-		// is no apikey entry rate limit.
-		// For now, by default, is closed.
-		return nil, fmt.Errorf("limit for api key and endpoint not found")
-	}
+	wnds := make([]*SlidingCountersWindow, 0, len(queries))
+	for _, q := range queries {
+		rrl := SlidingCountersWindow{
+			ReqPerMin: q.ReqPerMin,
+		}
+		if q.ReqPerMin <= 0 {
+			rrl.ReqPerMin = 600
+			if len(res) < 1 {
+				return nil, fmt.Errorf("missing results for %s", q.Key)
+			}
+			// read the limit (if not set the result would be nil)
+			if res[0] == nil {
+				// there is no rate limit for this api key + endpoint
+				// TODO: define per configuration what to do if there
+				// is no apikey entry rate limit.
+				// For now, by default, is closed.
+				return nil, fmt.Errorf("limit for api key and endpoint not found")
+			}
 
-	reqsPerMinBytes, ok := res[0].([]byte)
-	if ok {
-		reqPerMin, err := strconv.ParseInt(string(reqsPerMinBytes), 10, 64)
-		if err == nil {
-			rrl.ReqPerMin = reqPerMin
-		} // else, means we have a weird format here ! who set this value !?
+			reqsPerMinBytes, ok := res[0].([]byte)
+			if ok {
+				reqPerMin, err := strconv.ParseInt(string(reqsPerMinBytes), 10, 64)
+				if err == nil {
+					rrl.ReqPerMin = reqPerMin
+				} // else, means we have a weird format here ! who set this value !?
+			}
+			res = res[1:]
+		}
+		if len(res) < 2 {
+			return nil, fmt.Errorf("missing results for %s", q.Key)
+		}
+		if err = fillSlidingCountersWindow(&rrl, res[:2], timestampSec); err != nil {
+			return nil, err
+		}
+		res = res[2:]
+		wnds = append(wnds, &rrl)
 	}
+	return wnds, nil
+}
 
-	for idx, ires := range res[1:3] {
+// fillSlidingCountersWindow reads the HGETALL results for the current
+// and the previous minute slices into the window.
+func fillSlidingCountersWindow(rrl *SlidingCountersWindow,
+	slices []interface{}, timestampSec int64) error {
+	curSecIdx := timestampSec % 60
+	for idx, ires := range slices {
 		keyvals, ok := ires.([]interface{})
 		if !ok {
-			return nil, fmt.Errorf("cannot get key val pair: %#v", ires)
+			return fmt.Errorf("cannot get key val pair: %#v", ires)
 		}
 		if len(keyvals)%2 != 0 {
-			return nil, fmt.Errorf("hmap keyval odd result")
+			return fmt.Errorf("hmap keyval odd result")
 		}
 
 		numKeyVals := len(keyvals)
@@ -166,7 +248,7 @@ func GetRedisSlidingCountersWindow(conn redis.Conn, key string,
 			}
 		}
 	}
-	return &rrl, nil
+	return nil
 }
 
 // getHMapPair reads a couple of int64 from an slice of bytes
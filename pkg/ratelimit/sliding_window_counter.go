@@ -27,3 +27,20 @@ func (scw *SlidingCountersWindow) NumEmptySlotsAtStart() int {
 	}
 	return 60
 }
+
+// SecondsUntilCapacity gives the number of seconds that must pass
+// before there is room in the window for a request of the given
+// cost, or -1 if the request will never fit in the window.
+func (scw *SlidingCountersWindow) SecondsUntilCapacity(cost int64) int {
+	if cost > scw.ReqPerMin {
+		return -1
+	}
+	sum := scw.Sum
+	for idx, v := range scw.Window {
+		if sum+cost <= scw.ReqPerMin {
+			return idx
+		}
+		sum -= v
+	}
+	return 60
+}
@@ -0,0 +1,35 @@
+package ratelimit
+
+import (
+	"testing"
+)
+
+func Test_SlidingCountersWindowSecondsUntilCapacity(t *testing.T) {
+	scw := SlidingCountersWindow{
+		ReqPerMin: 10,
+	}
+	scw.Window[3] = 4
+	scw.Window[10] = 2
+	scw.Window[59] = 4
+	scw.Sum = 10
+
+	cases := map[int64]int{
+		1:  4,
+		4:  4,
+		5:  11,
+		6:  11,
+		7:  60,
+		11: -1,
+	}
+	for cost, want := range cases {
+		if got := scw.SecondsUntilCapacity(cost); got != want {
+			t.Errorf("cost %d: want %d secs, got %d", cost, want, got)
+		}
+	}
+
+	scw.Window[59] = 0
+	scw.Sum = 6
+	if got := scw.SecondsUntilCapacity(4); got != 0 {
+		t.Errorf("want 0 secs, got %d", got)
+	}
+}
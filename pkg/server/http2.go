@@ -0,0 +1,53 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// HTTP2Conf defines the HTTP/2 support of the server:
+//
+//   - Enabled: serve HTTP/2 to the clients that negotiate it with
+//     TLS (ALPN). Without it, only HTTP/1.1 is served.
+//   - H2C: also serve cleartext HTTP/2 (h2c) in a server without TLS,
+//     with prior knowledge or upgrading an HTTP/1.1 connection.
+//   - MaxConcurrentStreams: the streams each client can open in a
+//     connection (0 for the default 250).
+//
+// Each stream is a request for the handler, so the rate limits are
+// applied per stream, not per connection.
+type HTTP2Conf struct {
+	Enabled              bool
+	H2C                  bool
+	MaxConcurrentStreams uint32
+}
+
+// ConfigureHTTP2 sets up the HTTP/2 support of the server, that
+// must already have its Handler and its TLSConfig (if any)
+func ConfigureHTTP2(srv *http.Server, conf HTTP2Conf) error {
+	if !conf.Enabled {
+		if conf.H2C {
+			return fmt.Errorf("h2c needs HTTP/2 enabled")
+		}
+		// a non nil map disables the automatic HTTP/2 support
+		srv.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+		return nil
+	}
+	h2s := &http2.Server{
+		MaxConcurrentStreams: conf.MaxConcurrentStreams,
+	}
+	if srv.TLSConfig != nil {
+		if conf.H2C {
+			return fmt.Errorf("h2c can not be used with TLS")
+		}
+		return http2.ConfigureServer(srv, h2s)
+	}
+	if conf.H2C {
+		srv.Handler = h2c.NewHandler(srv.Handler, h2s)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"testing"
+
+	"golang.org/x/net/http2"
+)
+
+// serveTestHTTP2 serves a handler that answers with the protocol
+// of the request, and returns the server address
+func serveTestHTTP2(t *testing.T, tlsConfig *tls.Config, conf HTTP2Conf) (string, func()) {
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.Header().Set("X-Proto", req.Proto)
+		}),
+		TLSConfig: tlsConfig,
+	}
+	if err := ConfigureHTTP2(srv, conf); err != nil {
+		t.Fatalf("cannot configure HTTP/2: %s", err.Error())
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err.Error())
+	}
+	if tlsConfig != nil {
+		go srv.ServeTLS(ln, "", "")
+	} else {
+		go srv.Serve(ln)
+	}
+	return ln.Addr().String(), func() { srv.Close() }
+}
+
+func getProto(t *testing.T, client *http.Client, url string) string {
+	res, err := client.Get(url)
+	if err != nil {
+		t.Errorf("cannot request %s: %s", url, err.Error())
+		return ""
+	}
+	res.Body.Close()
+	return res.Header.Get("X-Proto")
+}
+
+func Test_HTTP2OverTLS(t *testing.T) {
+	cert := newTestCert(t, "localhost", false, nil)
+	roots := x509.NewCertPool()
+	roots.AddCert(cert.cert)
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: roots},
+			ForceAttemptHTTP2: true,
+		},
+	}
+
+	for _, enabled := range []bool{true, false} {
+		tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert.tlsCertificate()}}
+		addr, closeSrv := serveTestHTTP2(t, tlsConfig, HTTP2Conf{Enabled: enabled})
+		proto := getProto(t, client, "https://"+addr)
+		closeSrv()
+		want := "HTTP/2.0"
+		if !enabled {
+			want = "HTTP/1.1"
+		}
+		if proto != want {
+			t.Errorf("HTTP/2 enabled %t: want %s, got %s", enabled, want, proto)
+		}
+	}
+}
+
+func Test_HTTP2Cleartext(t *testing.T) {
+	addr, closeSrv := serveTestHTTP2(t, nil, HTTP2Conf{Enabled: true, H2C: true})
+	defer closeSrv()
+
+	h2cClient := &http.Client{
+		Transport: &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string,
+				_ *tls.Config) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, addr)
+			},
+		},
+	}
+	if proto := getProto(t, h2cClient, "http://"+addr); proto != "HTTP/2.0" {
+		t.Errorf("want HTTP/2.0 with prior knowledge, got %s", proto)
+	}
+	// the HTTP/1.1 clients are still served
+	if proto := getProto(t, http.DefaultClient, "http://"+addr); proto != "HTTP/1.1" {
+		t.Errorf("want HTTP/1.1, got %s", proto)
+	}
+}
+
+func Test_HTTP2ConfErrors(t *testing.T) {
+	if err := ConfigureHTTP2(&http.Server{}, HTTP2Conf{H2C: true}); err == nil {
+		t.Errorf("want error for h2c without HTTP/2")
+	}
+	srv := &http.Server{TLSConfig: &tls.Config{}}
+	if err := ConfigureHTTP2(srv, HTTP2Conf{Enabled: true, H2C: true}); err == nil {
+		t.Errorf("want error for h2c with TLS")
+	}
+}
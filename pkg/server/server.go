@@ -2,6 +2,7 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"net/http"
 	"os"
@@ -29,6 +30,48 @@ func LaunchBlockingServer(addr string, hfn http.Handler) {
 	}
 }
 
+// ServerConf has the optional settings of the server
+type ServerConf struct {
+	// TLS is the configuration to serve HTTPS (see NewTLSConfig),
+	// or nil to serve plain HTTP
+	TLS   *tls.Config
+	HTTP2 HTTP2Conf
+}
+
+// LaunchBlockingServerConf serves HTTP, or HTTPS when the conf has
+// a TLS configuration, until the server is shut down. It returns
+// the error if the conf is not valid, or if the server can not be
+// started (like when the address is already in use) or stops for
+// any reason other than a shutdown.
+func LaunchBlockingServerConf(addr string, hfn http.Handler, conf ServerConf) error {
+	if len(addr) == 0 {
+		addr = "0.0.0.0:7777"
+	}
+	srv := &http.Server{
+		Addr:      addr,
+		Handler:   hfn,
+		TLSConfig: conf.TLS,
+	}
+	if err := ConfigureHTTP2(srv, conf.HTTP2); err != nil {
+		return err
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	go signalHandler(sigChan, srv)
+
+	var err error
+	if srv.TLSConfig != nil {
+		// the certificate is provided by the TLSConfig
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
 func LaunchBackgroundServer(addr string, hfn http.Handler) *http.Server {
 	if len(addr) == 0 {
 		addr = "0.0.0.0:7777"
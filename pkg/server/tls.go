@@ -0,0 +1,229 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TLSConf defines how the server terminates TLS:
+//
+//   - CertFile, KeyFile: the PEM encoded certificate (with its chain)
+//     and private key. They are reloaded when they change, so the
+//     certificate can be renewed without restarting the server.
+//   - MinVersion: the minimum TLS version accepted (see ParseTLSVersion).
+//   - CipherSuites: the cipher suites enabled for TLS 1.2 and lower
+//     (empty for the Go defaults). TLS 1.3 suites are not configurable.
+//   - ClientCAFile: the PEM encoded CAs used to verify the client
+//     certificates.
+//   - ClientAuth: the policy for the client certificates (see
+//     ParseClientAuth).
+//   - ReloadInterval: how often the certificate files are checked
+//     for changes (0 to not reload them).
+type TLSConf struct {
+	CertFile       string
+	KeyFile        string
+	MinVersion     uint16
+	CipherSuites   []uint16
+	ClientCAFile   string
+	ClientAuth     tls.ClientAuthType
+	ReloadInterval time.Duration
+}
+
+// NewTLSConfig creates the tls.Config for the server, and returns
+// the function to stop reloading the certificate.
+func NewTLSConfig(conf TLSConf) (*tls.Config, func(), error) {
+	cr, err := newCertReloader(conf.CertFile, conf.KeyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	tlsConfig := &tls.Config{
+		GetCertificate: cr.GetCertificate,
+		MinVersion:     conf.MinVersion,
+		CipherSuites:   conf.CipherSuites,
+		ClientAuth:     conf.ClientAuth,
+	}
+	if len(conf.ClientCAFile) > 0 {
+		pool, err := loadCertPool(conf.ClientCAFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		tlsConfig.ClientCAs = pool
+	} else if conf.ClientAuth >= tls.VerifyClientCertIfGiven {
+		return nil, nil, fmt.Errorf("client certificates can not be verified without a client CA file")
+	}
+	stop := func() {}
+	if conf.ReloadInterval > 0 {
+		stop = cr.watch(conf.ReloadInterval)
+	}
+	return tlsConfig, stop, nil
+}
+
+// loadCertPool reads the PEM encoded certificates of a file
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read CA file: %s", err.Error())
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in CA file %s", file)
+	}
+	return pool, nil
+}
+
+// certReloader holds the server certificate, and reloads it when
+// its files change
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	modTimes [2]time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	cr := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if _, err := cr.reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// GetCertificate returns the current certificate
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return cr.cert, nil
+}
+
+// reload loads the certificate if its files have changed, and
+// returns true if it has been replaced. If the new files can not
+// be loaded, the current certificate is kept.
+func (cr *certReloader) reload() (bool, error) {
+	var modTimes [2]time.Time
+	for idx, f := range []string{cr.certFile, cr.keyFile} {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return false, fmt.Errorf("cannot read certificate: %s", err.Error())
+		}
+		modTimes[idx] = fi.ModTime()
+	}
+	cr.mu.RLock()
+	unchanged := cr.cert != nil && modTimes == cr.modTimes
+	cr.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return false, fmt.Errorf("cannot load certificate: %s", err.Error())
+	}
+	cr.mu.Lock()
+	cr.cert = &cert
+	cr.modTimes = modTimes
+	cr.mu.Unlock()
+	return true, nil
+}
+
+// watch checks the certificate files at the interval, until the
+// returned function is called
+func (cr *certReloader) watch(interval time.Duration) func() {
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			reloaded, err := cr.reload()
+			// TODO: change this for a log
+			if err != nil {
+				fmt.Printf("keeping the current certificate: %s\n", err.Error())
+			} else if reloaded {
+				fmt.Printf("certificate reloaded from %s\n", cr.certFile)
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(stop) })
+	}
+}
+
+// ParseTLSVersion converts a TLS version (`1.0`, `1.1`, `1.2` or
+// `1.3`) to its tls package value
+func ParseTLSVersion(version string) (uint16, error) {
+	switch version {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("TLS version %q not valid", version)
+}
+
+// ParseCipherSuites converts a comma separated list of cipher suite
+// names (like `TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256`) to their ids
+func ParseCipherSuites(list string) ([]uint16, error) {
+	byName := make(map[string]uint16)
+	for _, cs := range tls.CipherSuites() {
+		byName[cs.Name] = cs.ID
+	}
+	for _, cs := range tls.InsecureCipherSuites() {
+		byName[cs.Name] = cs.ID
+	}
+	var ids []uint16
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if len(name) == 0 {
+			continue
+		}
+		id, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// ParseClientAuth converts a client certificates policy name to
+// its tls.ClientAuthType:
+//
+//   - `none` (the default): the client certificates are not requested.
+//   - `request`: they are requested, but not required nor verified.
+//   - `require`: they are required, but not verified.
+//   - `verifyifgiven`: they are verified, if the client sends one.
+//   - `requireandverify`: they are required and verified.
+func ParseClientAuth(name string) (tls.ClientAuthType, error) {
+	switch strings.ToLower(name) {
+	case "", "none":
+		return tls.NoClientCert, nil
+	case "request":
+		return tls.RequestClientCert, nil
+	case "require":
+		return tls.RequireAnyClientCert, nil
+	case "verifyifgiven":
+		return tls.VerifyClientCertIfGiven, nil
+	case "requireandverify":
+		return tls.RequireAndVerifyClientCert, nil
+	}
+	return tls.NoClientCert, fmt.Errorf("client auth %q not valid", name)
+}
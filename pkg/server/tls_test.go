@@ -0,0 +1,283 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate and its key, signed by its parent (or
+// self signed when there is no parent)
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCert(t *testing.T, cn string, isCA bool, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("cannot generate key: %s", err.Error())
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{cn},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth,
+			x509.ExtKeyUsageClientAuth},
+	}
+	if isCA {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	}
+	signer, signerKey := tmpl, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer,
+		&key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("cannot create certificate: %s", err.Error())
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+// write stores the certificate and key PEM files in the dir
+func (tc *testCert) write(t *testing.T, dir string, name string) (string, string) {
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	keyDer, err := x509.MarshalECPrivateKey(tc.key)
+	if err != nil {
+		t.Fatalf("cannot marshal key: %s", err.Error())
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tc.der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err := ioutil.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatalf("cannot write certificate: %s", err.Error())
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatalf("cannot write key: %s", err.Error())
+	}
+	return certFile, keyFile
+}
+
+func (tc *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{
+		Certificate: [][]byte{tc.der},
+		PrivateKey:  tc.key,
+	}
+}
+
+func Test_TLSConfigReloadsCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dynlimits_tls")
+	if err != nil {
+		t.Fatalf("cannot create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	first := newTestCert(t, "first.example.com", false, nil)
+	certFile, keyFile := first.write(t, dir, "server")
+	cr, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Errorf("cannot load certificate: %s", err.Error())
+		return
+	}
+	cert, _ := cr.GetCertificate(nil)
+	parsed, _ := x509.ParseCertificate(cert.Certificate[0])
+	if parsed.Subject.CommonName != "first.example.com" {
+		t.Errorf("want first certificate, got %s", parsed.Subject.CommonName)
+	}
+
+	if reloaded, err := cr.reload(); reloaded || err != nil {
+		t.Errorf("want unchanged certificate, got %t, %v", reloaded, err)
+	}
+
+	second := newTestCert(t, "second.example.com", false, nil)
+	second.write(t, dir, "server")
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+	os.Chtimes(keyFile, future, future)
+	if reloaded, err := cr.reload(); !reloaded || err != nil {
+		t.Errorf("want reloaded certificate, got %t, %v", reloaded, err)
+		return
+	}
+	cert, _ = cr.GetCertificate(nil)
+	parsed, _ = x509.ParseCertificate(cert.Certificate[0])
+	if parsed.Subject.CommonName != "second.example.com" {
+		t.Errorf("want second certificate, got %s", parsed.Subject.CommonName)
+	}
+
+	// a bad certificate keeps the current one
+	ioutil.WriteFile(certFile, []byte("not a certificate"), 0600)
+	future = future.Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+	if reloaded, err := cr.reload(); reloaded || err == nil {
+		t.Errorf("want error loading bad certificate, got %t, %v", reloaded, err)
+	}
+	cert, _ = cr.GetCertificate(nil)
+	parsed, _ = x509.ParseCertificate(cert.Certificate[0])
+	if parsed.Subject.CommonName != "second.example.com" {
+		t.Errorf("want second certificate kept, got %s", parsed.Subject.CommonName)
+	}
+}
+
+func Test_TLSConfigClientCertificates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dynlimits_tls")
+	if err != nil {
+		t.Fatalf("cannot create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, "Test CA", true, nil)
+	caFile, _ := ca.write(t, dir, "ca")
+	serverCert := newTestCert(t, "localhost", false, ca)
+	certFile, keyFile := serverCert.write(t, dir, "server")
+
+	tlsConfig, stop, err := NewTLSConfig(TLSConf{
+		CertFile:       certFile,
+		KeyFile:        keyFile,
+		MinVersion:     tls.VersionTLS12,
+		ClientCAFile:   caFile,
+		ClientAuth:     tls.RequireAndVerifyClientCert,
+		ReloadInterval: time.Minute,
+	})
+	if err != nil {
+		t.Errorf("cannot create TLS config: %s", err.Error())
+		return
+	}
+	defer stop()
+
+	// httptest.Server would set its own certificate
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err.Error())
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(
+		func(rw http.ResponseWriter, req *http.Request) {
+			rw.WriteHeader(http.StatusOK)
+		})}
+	go srv.Serve(ln)
+	defer srv.Close()
+	srvURL := "https://" + ln.Addr().String()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	newClient := func(certs []tls.Certificate) *http.Client {
+		return &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{
+					RootCAs:      roots,
+					Certificates: certs,
+				},
+			},
+		}
+	}
+
+	if _, err := newClient(nil).Get(srvURL); err == nil {
+		t.Errorf("want error without client certificate")
+	}
+
+	other := newTestCert(t, "client", false, nil)
+	if _, err := newClient([]tls.Certificate{other.tlsCertificate()}).Get(srvURL); err == nil {
+		t.Errorf("want error with a client certificate from another CA")
+	}
+
+	client := newTestCert(t, "client", false, ca)
+	res, err := newClient([]tls.Certificate{client.tlsCertificate()}).Get(srvURL)
+	if err != nil {
+		t.Errorf("want request with client certificate, got %s", err.Error())
+		return
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("want status 200, got %d", res.StatusCode)
+	}
+}
+
+func Test_TLSConfigVerifyWithoutClientCA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dynlimits_tls")
+	if err != nil {
+		t.Fatalf("cannot create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := newTestCert(t, "localhost", false, nil).write(t, dir, "server")
+	_, _, err = NewTLSConfig(TLSConf{
+		CertFile:   certFile,
+		KeyFile:    keyFile,
+		ClientAuth: tls.RequireAndVerifyClientCert,
+	})
+	if err == nil {
+		t.Errorf("want error verifying client certificates without CA")
+	}
+}
+
+func Test_ParseTLSOptions(t *testing.T) {
+	if v, err := ParseTLSVersion("1.3"); err != nil || v != tls.VersionTLS13 {
+		t.Errorf("want TLS 1.3, got %d, %v", v, err)
+	}
+	if v, err := ParseTLSVersion(""); err != nil || v != tls.VersionTLS12 {
+		t.Errorf("want default TLS 1.2, got %d, %v", v, err)
+	}
+	if _, err := ParseTLSVersion("2.0"); err == nil {
+		t.Errorf("want error for TLS 2.0")
+	}
+
+	suites, err := ParseCipherSuites(
+		"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384")
+	if err != nil || len(suites) != 2 ||
+		suites[0] != tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 ||
+		suites[1] != tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384 {
+		t.Errorf("bad cipher suites: %v, %v", suites, err)
+	}
+	if suites, err := ParseCipherSuites(""); err != nil || len(suites) != 0 {
+		t.Errorf("want no cipher suites, got %v, %v", suites, err)
+	}
+	if _, err := ParseCipherSuites("TLS_FAKE"); err == nil {
+		t.Errorf("want error for unknown cipher suite")
+	}
+
+	if ca, err := ParseClientAuth("requireandverify"); err != nil ||
+		ca != tls.RequireAndVerifyClientCert {
+		t.Errorf("want RequireAndVerifyClientCert, got %d, %v", ca, err)
+	}
+	if _, err := ParseClientAuth("always"); err == nil {
+		t.Errorf("want error for unknown client auth")
+	}
+}
+
+func Test_LaunchBlockingServerConfListenError(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err.Error())
+	}
+	defer ln.Close()
+	tc := newTestCert(t, "localhost", false, nil)
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{tc.tlsCertificate()}}
+
+	// the address is already in use
+	err = LaunchBlockingServerConf(ln.Addr().String(), http.NotFoundHandler(),
+		ServerConf{TLS: tlsConfig})
+	if err == nil {
+		t.Errorf("want a listen error, got none")
+	}
+}